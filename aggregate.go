@@ -0,0 +1,407 @@
+package pangolin
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+type AggregateFunc int
+
+const (
+	Count AggregateFunc = iota
+	Sum
+	Min
+	Max
+	Mean
+	First
+	Last
+	// Stddev is the population standard deviation.
+	Stddev
+)
+
+func (f AggregateFunc) String() string {
+	switch f {
+	case Count:
+		return "count"
+	case Sum:
+		return "sum"
+	case Min:
+		return "min"
+	case Max:
+		return "max"
+	case Mean:
+		return "mean"
+	case First:
+		return "first"
+	case Last:
+		return "last"
+	case Stddev:
+		return "stddev"
+	default:
+		return "unknown"
+	}
+}
+
+// AggregateRequest aggregates the points in [StartTime, EndTime) which match
+// the filter over windows of Window nanoseconds aligned on the epoch, the
+// whole range is a single window if Window is not positive.
+//
+// The points are grouped by series if GroupBy is nil, otherwise by the values
+// of the labels in GroupBy, an empty GroupBy aggregates every series at once.
+// The metric can be grouped by with MetricLabel.
+type AggregateRequest struct {
+	StartTime int64
+	EndTime   int64
+	Filter    *QueryFilter
+
+	Window       int64
+	Aggregations []AggregateFunc
+	GroupBy      []string
+}
+
+// AggregateSeries is the result of a group, its metric and labels are those
+// of the series or the grouped by labels.
+type AggregateSeries struct {
+	Metric string
+	Labels map[string]string
+	Points []AggregatePoint
+}
+
+// AggregatePoint holds the results of the aggregations of a window, in the
+// order of AggregateRequest.Aggregations. Only Count applies to the values
+// which aren't numbers and to NaN, the other results of a window without
+// numbers are NaN.
+type AggregatePoint struct {
+	Time   int64
+	Values []float64
+}
+
+// AggregateEngine is implemented by the engines which can aggregate the
+// points of a query without returning them.
+type AggregateEngine interface {
+	Aggregate(ctx context.Context, req AggregateRequest) ([]*AggregateSeries, error)
+}
+
+// Aggregator computes an AggregateRequest from the points of the series
+// added in any order.
+type Aggregator struct {
+	req    AggregateRequest
+	groups map[string]*group
+
+	// lastSeries caches the group of the last series, the engines add the
+	// points grouped by series.
+	lastSeries string
+	lastGroup  *group
+}
+
+type group struct {
+	metric  string
+	labels  map[string]string
+	windows map[int64]*window
+}
+
+type window struct {
+	count   uint64
+	numbers uint64
+
+	sum, min, max float64
+	first, last   float64
+
+	firstTime, lastTime int64
+
+	// mean and m2 are updated with the Welford's algorithm.
+	mean, m2 float64
+}
+
+func NewAggregator(req AggregateRequest) *Aggregator {
+	return &Aggregator{req: req, groups: map[string]*group{}}
+}
+
+// Add adds a point of the series with the key, the points outside the range
+// of the request are ignored.
+func (a *Aggregator) Add(seriesKey string, kv KV) error {
+	if kv.Key < a.req.StartTime || kv.Key >= a.req.EndTime {
+		return nil
+	}
+
+	g := a.lastGroup
+	if g == nil || seriesKey != a.lastSeries {
+		var err error
+		if g, err = a.group(seriesKey); err != nil {
+			return err
+		}
+
+		a.lastSeries, a.lastGroup = seriesKey, g
+	}
+
+	start := a.windowStart(kv.Key)
+	w, ok := g.windows[start]
+	if !ok {
+		w = &window{}
+		g.windows[start] = w
+	}
+
+	w.add(kv)
+	return nil
+}
+
+// Summary is a precomputed aggregate of the points of a series between
+// StartTime and EndTime inclusive, such as the statistics of a block. Numbers
+// counts the values which are numbers and not NaN.
+type Summary struct {
+	StartTime int64
+	EndTime   int64
+
+	Count   uint64
+	Numbers uint64
+
+	Sum   float64
+	Min   float64
+	Max   float64
+	First float64
+	Last  float64
+
+	FirstTime int64
+	LastTime  int64
+}
+
+// CanSummarize reports whether the points between startTime and endTime
+// inclusive can be added at once with AddSummary: they must be in the range
+// of the request and in a single window, and the aggregations must not need
+// the points, like Stddev.
+func (a *Aggregator) CanSummarize(startTime, endTime int64) bool {
+	for _, f := range a.req.Aggregations {
+		if f == Stddev {
+			return false
+		}
+	}
+
+	if startTime < a.req.StartTime || endTime >= a.req.EndTime || startTime > endTime {
+		return false
+	}
+
+	return a.windowStart(startTime) == a.windowStart(endTime)
+}
+
+// AddSummary adds the points of a summary of the series, CanSummarize must
+// hold for its time range and the points must not be added again.
+func (a *Aggregator) AddSummary(seriesKey string, s *Summary) error {
+	g, err := a.group(seriesKey)
+	if err != nil {
+		return err
+	}
+	a.lastSeries, a.lastGroup = seriesKey, g
+
+	start := a.windowStart(s.StartTime)
+	w, ok := g.windows[start]
+	if !ok {
+		w = &window{}
+		g.windows[start] = w
+	}
+
+	w.merge(s)
+	return nil
+}
+
+func (a *Aggregator) group(seriesKey string) (*group, error) {
+	metric, labels, err := ParseSeriesKey(seriesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.req.GroupBy != nil {
+		grouped := map[string]string{}
+		groupMetric := ""
+		for _, name := range a.req.GroupBy {
+			if name == MetricLabel {
+				groupMetric = metric
+			} else if value, ok := labels[name]; ok {
+				grouped[name] = value
+			}
+		}
+
+		metric, labels = groupMetric, grouped
+	}
+
+	key := SeriesKey(metric, labels)
+	g, ok := a.groups[key]
+	if !ok {
+		g = &group{metric: metric, labels: labels, windows: map[int64]*window{}}
+		a.groups[key] = g
+	}
+
+	return g, nil
+}
+
+func (a *Aggregator) windowStart(t int64) int64 {
+	if a.req.Window <= 0 {
+		return a.req.StartTime
+	}
+
+	start := t - t%a.req.Window
+	if t%a.req.Window < 0 {
+		start -= a.req.Window
+	}
+
+	return start
+}
+
+// Result returns the groups sorted by key with their windows in time order.
+func (a *Aggregator) Result() []*AggregateSeries {
+	keys := make([]string, 0, len(a.groups))
+	for key := range a.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]*AggregateSeries, len(keys))
+	for i, key := range keys {
+		g := a.groups[key]
+
+		times := make([]int64, 0, len(g.windows))
+		for t := range g.windows {
+			times = append(times, t)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+		series := &AggregateSeries{Metric: g.metric, Labels: g.labels, Points: make([]AggregatePoint, len(times))}
+		for j, t := range times {
+			w := g.windows[t]
+			values := make([]float64, len(a.req.Aggregations))
+			for k, f := range a.req.Aggregations {
+				values[k] = w.result(f)
+			}
+
+			series.Points[j] = AggregatePoint{Time: t, Values: values}
+		}
+
+		result[i] = series
+	}
+
+	return result
+}
+
+func (w *window) add(kv KV) {
+	w.count++
+
+	v, ok := ToFloat64(kv.Value)
+	if !ok || math.IsNaN(v) {
+		return
+	}
+
+	w.numbers++
+	if w.numbers == 1 {
+		w.min, w.max = v, v
+		w.first, w.firstTime = v, kv.Key
+		w.last, w.lastTime = v, kv.Key
+	} else {
+		w.min = math.Min(w.min, v)
+		w.max = math.Max(w.max, v)
+
+		if kv.Key < w.firstTime {
+			w.first, w.firstTime = v, kv.Key
+		}
+
+		if kv.Key >= w.lastTime {
+			w.last, w.lastTime = v, kv.Key
+		}
+	}
+
+	w.sum += v
+
+	delta := v - w.mean
+	w.mean += delta / float64(w.numbers)
+	w.m2 += delta * (v - w.mean)
+}
+
+// merge adds a summary of points which don't overlap those of the window.
+func (w *window) merge(s *Summary) {
+	w.count += s.Count
+	if s.Numbers == 0 {
+		return
+	}
+
+	if w.numbers == 0 {
+		w.min, w.max = s.Min, s.Max
+		w.first, w.firstTime = s.First, s.FirstTime
+		w.last, w.lastTime = s.Last, s.LastTime
+	} else {
+		w.min = math.Min(w.min, s.Min)
+		w.max = math.Max(w.max, s.Max)
+
+		if s.FirstTime < w.firstTime {
+			w.first, w.firstTime = s.First, s.FirstTime
+		}
+
+		if s.LastTime >= w.lastTime {
+			w.last, w.lastTime = s.Last, s.LastTime
+		}
+	}
+
+	w.numbers += s.Numbers
+	w.sum += s.Sum
+	w.mean = w.sum / float64(w.numbers)
+}
+
+func (w *window) result(f AggregateFunc) float64 {
+	if f == Count {
+		return float64(w.count)
+	}
+
+	if w.numbers == 0 {
+		return math.NaN()
+	}
+
+	switch f {
+	case Sum:
+		return w.sum
+	case Min:
+		return w.min
+	case Max:
+		return w.max
+	case Mean:
+		return w.mean
+	case First:
+		return w.first
+	case Last:
+		return w.last
+	case Stddev:
+		return math.Sqrt(w.m2 / float64(w.numbers))
+	default:
+		return math.NaN()
+	}
+}
+
+// ToFloat64 converts a numeric value to float64, ok is false if the value
+// isn't a number.
+func ToFloat64(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,117 @@
+package pangolin
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestAggregator(t *testing.T) {
+	a := NewAggregator(AggregateRequest{
+		StartTime:    0,
+		EndTime:      20,
+		Window:       10,
+		Aggregations: []AggregateFunc{Count, Sum, Min, Max, Mean, First, Last, Stddev},
+		GroupBy:      []string{"host"},
+	})
+
+	for _, key := range []string{`cpu{core="0",host="a"}`, `cpu{core="1",host="a"}`} {
+		for i := int64(-5); i < 25; i++ {
+			if err := a.Add(key, KV{Key: i, Value: i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	a.Add(`cpu{host="b"}`, KV{Key: 3, Value: "down"})
+
+	expect := []*AggregateSeries{
+		{Labels: map[string]string{"host": "a"}, Points: []AggregatePoint{
+			{Time: 0, Values: []float64{20, 90, 0, 9, 4.5, 0, 9, math.Sqrt(8.25)}},
+			{Time: 10, Values: []float64{20, 290, 10, 19, 14.5, 10, 19, math.Sqrt(8.25)}},
+		}},
+		{Labels: map[string]string{"host": "b"}, Points: []AggregatePoint{
+			{Time: 0, Values: []float64{1, math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN(), math.NaN()}},
+		}},
+	}
+
+	result := a.Result()
+	if len(result) != len(expect) {
+		t.Fatalf("expect %d groups, got %d", len(expect), len(result))
+	}
+
+	for i, series := range result {
+		if !reflect.DeepEqual(series.Labels, expect[i].Labels) || len(series.Points) != len(expect[i].Points) {
+			t.Fatalf("expect %v, got %v", expect[i], series)
+		}
+
+		for j, point := range series.Points {
+			expectPoint := expect[i].Points[j]
+			if point.Time != expectPoint.Time {
+				t.Errorf("expect window %d, got %d", expectPoint.Time, point.Time)
+			}
+
+			for k, v := range point.Values {
+				e := expectPoint.Values[k]
+				if math.IsNaN(e) != math.IsNaN(v) || (!math.IsNaN(e) && math.Abs(e-v) > 1e-9) {
+					t.Errorf("%v %s: expect %v, got %v", series.Labels, AggregateFunc(k), e, v)
+				}
+			}
+		}
+	}
+}
+
+func TestAggregatorWindow(t *testing.T) {
+	a := NewAggregator(AggregateRequest{StartTime: -20, EndTime: 20, Window: 10, Aggregations: []AggregateFunc{Count}})
+	for _, key := range []int64{-11, -10, -1, 0} {
+		a.Add(`cpu{}`, KV{Key: key, Value: key})
+	}
+
+	result := a.Result()
+	if len(result) != 1 || result[0].Metric != "cpu" {
+		t.Fatalf("expect the series cpu, got %v", result)
+	}
+
+	times := []int64{}
+	for _, point := range result[0].Points {
+		times = append(times, point.Time)
+	}
+
+	if expect := []int64{-20, -10, 0}; !reflect.DeepEqual(times, expect) {
+		t.Errorf("expect windows %v, got %v", expect, times)
+	}
+}
+
+func TestAggregatorSummary(t *testing.T) {
+	req := AggregateRequest{StartTime: 0, EndTime: 20, Window: 10, Aggregations: []AggregateFunc{Count, Sum, Min, Max, Mean, First, Last}}
+	points, summarized := NewAggregator(req), NewAggregator(req)
+
+	if summarized.CanSummarize(5, 15) || summarized.CanSummarize(15, 20) {
+		t.Error("expect a range across windows or out of the request not to be summarized")
+	}
+
+	if NewAggregator(AggregateRequest{EndTime: 20, Aggregations: []AggregateFunc{Stddev}}).CanSummarize(0, 5) {
+		t.Error("expect stddev not to be summarized")
+	}
+
+	for i := int64(0); i < 5; i++ {
+		points.Add(`cpu{}`, KV{Key: i, Value: float64(i)})
+	}
+	points.Add(`cpu{}`, KV{Key: 5, Value: math.NaN()})
+	for i := int64(6); i < 10; i++ {
+		points.Add(`cpu{}`, KV{Key: i, Value: float64(i)})
+		summarized.Add(`cpu{}`, KV{Key: i, Value: float64(i)})
+	}
+
+	if !summarized.CanSummarize(0, 5) {
+		t.Fatal("expect a range in a window to be summarized")
+	}
+
+	summary := &Summary{StartTime: 0, EndTime: 5, Count: 6, Numbers: 5, Sum: 10, Min: 0, Max: 4, First: 0, Last: 4, FirstTime: 0, LastTime: 4}
+	if err := summarized.AddSummary(`cpu{}`, summary); err != nil {
+		t.Fatal(err)
+	}
+
+	if expect, result := points.Result(), summarized.Result(); !reflect.DeepEqual(expect, result) {
+		t.Errorf("expect %v, got %v", expect[0].Points, result[0].Points)
+	}
+}
@@ -0,0 +1,235 @@
+package blot
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	db "github.com/dovics/pangolin"
+	"go.etcd.io/bbolt"
+)
+
+// The series buckets are named by the canonical series keys, their keys are
+// the timestamps as 8 bytes big endian with the sign bit flipped, so the byte
+// order of the keys is the order of the timestamps. Version 1 databases stored
+// the timestamps truncated to 4 bytes, version 1 and 2 named the buckets by
+// the tags of the entries.
+const (
+	formatVersion1 = 1
+	formatVersion2 = 2
+	formatVersion3 = 3
+	formatVersion  = formatVersion3
+)
+
+var (
+	metaBucket = []byte("pangolin-meta")
+	versionKey = []byte("version")
+
+	// codecsBucket is the bucket of the meta bucket holding the name of the
+	// codec of every CustomType series bucket.
+	codecsBucket = []byte("codecs")
+)
+
+// seriesCodec returns the codec of the CustomType series bucket.
+func seriesCodec(tx *bbolt.Tx, name string) (*db.Codec, error) {
+	var codec []byte
+	if meta := tx.Bucket(metaBucket); meta != nil {
+		if codecs := meta.Bucket(codecsBucket); codecs != nil {
+			codec = codecs.Get([]byte(name))
+		}
+	}
+
+	if codec == nil {
+		return nil, fmt.Errorf("series %s has no codec", name)
+	}
+
+	c, ok := db.LookupCodec(string(codec))
+	if !ok {
+		return nil, fmt.Errorf("codec %s is not registered", codec)
+	}
+
+	return c, nil
+}
+
+// setSeriesCodec records the codec of the CustomType series bucket, a series
+// holds the values of a single codec.
+func setSeriesCodec(tx *bbolt.Tx, name string, c *db.Codec) error {
+	codecs, err := tx.Bucket(metaBucket).CreateBucketIfNotExists(codecsBucket)
+	if err != nil {
+		return err
+	}
+
+	if codec := codecs.Get([]byte(name)); codec != nil {
+		if string(codec) != c.Name {
+			return fmt.Errorf("series %s holds the values of codec %s, not %s", name, codec, c.Name)
+		}
+
+		return nil
+	}
+
+	return codecs.Put([]byte(name), []byte(c.Name))
+}
+
+// deleteSeriesCodec removes the codec of a deleted CustomType series bucket.
+func deleteSeriesCodec(tx *bbolt.Tx, name string) error {
+	meta := tx.Bucket(metaBucket)
+	if meta == nil {
+		return nil
+	}
+
+	codecs := meta.Bucket(codecsBucket)
+	if codecs == nil {
+		return nil
+	}
+
+	return codecs.Delete([]byte(name))
+}
+
+func encodeKey(key int64) []byte {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(key)^(1<<63))
+	return buffer
+}
+
+func decodeKey(k []byte) int64 {
+	return int64(binary.BigEndian.Uint64(k) ^ (1 << 63))
+}
+
+// migrate upgrades the key layout of the database to the latest version. A
+// database without a version holds version 1 keys if it has any series.
+func migrate(bblotDB *bbolt.DB) error {
+	return bblotDB.Update(func(tx *bbolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+
+		version := uint32(formatVersion1)
+		if v := meta.Get(versionKey); len(v) == 4 {
+			version = binary.BigEndian.Uint32(v)
+		}
+
+		if version > formatVersion {
+			return fmt.Errorf("unknown blot format version %d", version)
+		}
+
+		if version < formatVersion2 {
+			if err := migrateKeys(tx); err != nil {
+				return fmt.Errorf("failed to migrate the keys: %w", err)
+			}
+		}
+
+		if version < formatVersion3 {
+			if err := migrateSeriesKeys(tx); err != nil {
+				return fmt.Errorf("failed to migrate the series keys: %w", err)
+			}
+		}
+
+		buffer := make([]byte, 4)
+		binary.BigEndian.PutUint32(buffer, formatVersion)
+		return meta.Put(versionKey, buffer)
+	})
+}
+
+// migrateKeys rewrites the 4 byte keys of every series bucket. The version 1
+// keys were truncated, they are restored as unsigned 32-bit timestamps.
+func migrateKeys(tx *bbolt.Tx) error {
+	typeBytes := make([]byte, 4)
+	for i := 0; i < int(db.TypeCount); i++ {
+		binary.BigEndian.PutUint32(typeBytes, uint32(i))
+		typeBucket := tx.Bucket(typeBytes)
+		if typeBucket == nil {
+			continue
+		}
+
+		names := [][]byte{}
+		if err := typeBucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				names = append(names, append([]byte{}, k...))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			bucket := typeBucket.Bucket(name)
+
+			keys, values := [][]byte{}, [][]byte{}
+			if err := bucket.ForEach(func(k, v []byte) error {
+				if len(k) == 4 {
+					keys = append(keys, append([]byte{}, k...))
+					values = append(values, append([]byte{}, v...))
+				}
+
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			for j, k := range keys {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+
+				if err := bucket.Put(encodeKey(int64(binary.BigEndian.Uint32(k))), values[j]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateSeriesKeys renames the buckets named by tags to the canonical series
+// keys, merging the buckets of the same series.
+func migrateSeriesKeys(tx *bbolt.Tx) error {
+	typeBytes := make([]byte, 4)
+	for i := 0; i < int(db.TypeCount); i++ {
+		binary.BigEndian.PutUint32(typeBytes, uint32(i))
+		typeBucket := tx.Bucket(typeBytes)
+		if typeBucket == nil {
+			continue
+		}
+
+		names := [][]byte{}
+		if err := typeBucket.ForEach(func(k, v []byte) error {
+			if v == nil {
+				names = append(names, append([]byte{}, k...))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			key, err := db.CanonicalSeriesKey(string(name))
+			if err != nil {
+				return err
+			}
+
+			if key == string(name) {
+				continue
+			}
+
+			target, err := typeBucket.CreateBucketIfNotExists([]byte(key))
+			if err != nil {
+				return err
+			}
+
+			if err := typeBucket.Bucket(name).ForEach(func(k, v []byte) error {
+				return target.Put(k, v)
+			}); err != nil {
+				return err
+			}
+
+			if err := typeBucket.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
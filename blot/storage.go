@@ -1,11 +1,14 @@
 package blot
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"sort"
 
 	db "github.com/dovics/pangolin"
 	"github.com/google/uuid"
@@ -23,16 +26,7 @@ func init() {
 			return nil, errors.New("wrong option type")
 		}
 
-		bblotDB, err := bbolt.Open(option.Path, 0666, nil)
-		if err != nil {
-			return nil, err
-		}
-
-		return &Storage{
-			option:        option,
-			db:            bblotDB,
-			unmarshalFunc: make(map[string]UnmarshalFunc),
-		}, nil
+		return NewStorage(option)
 	})
 }
 
@@ -50,125 +44,421 @@ type Storage struct {
 	unmarshalFunc map[string]UnmarshalFunc
 }
 
+func NewStorage(option *Option) (*Storage, error) {
+	bblotDB, err := bbolt.Open(option.Path, 0666, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrate(bblotDB); err != nil {
+		bblotDB.Close()
+		return nil, err
+	}
+
+	return &Storage{
+		option:        option,
+		db:            bblotDB,
+		unmarshalFunc: make(map[string]UnmarshalFunc),
+	}, nil
+}
+
 type UnmarshalFunc func([]byte) (interface{}, error)
 
+// SetUnmarshalFunc sets the function decoding the values of the series, index
+// is a series key or legacy tags joined by ','.
 func (s *Storage) SetUnmarshalFunc(index string, f UnmarshalFunc) {
+	if key, err := db.CanonicalSeriesKey(index); err == nil {
+		index = key
+	}
+
 	s.unmarshalFunc[index] = f
 }
 
 func (s *Storage) Insert(e *db.Entry) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return put(tx, e)
+	})
+}
+
+// InsertContext inserts the entry unless the context is done.
+func (s *Storage) InsertContext(ctx context.Context, e *db.Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.Insert(e)
+}
+
+// InsertBatch inserts all the entries in a single transaction.
+func (s *Storage) InsertBatch(entries []*db.Entry) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for _, e := range entries {
+			if err := put(tx, e); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// encodeValue encodes the value in JSON, except the bytes which are stored
+// as they are and the custom values which are marshaled by their codec.
+func encodeValue(e *db.Entry) ([]byte, error) {
+	switch e.Type {
+	case db.BytesType:
+		v, ok := e.Value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("wrong value type %T for bytes entry", e.Value)
+		}
+
+		return v, nil
+	case db.CustomType:
+		c, ok := db.CodecOf(e.Value)
+		if !ok {
+			return nil, fmt.Errorf("no codec registered for %T", e.Value)
+		}
+
+		data, err := c.Marshal(e.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal with codec %s: %w", c.Name, err)
+		}
+
+		return data, nil
+	default:
+		return json.Marshal(e.Value)
+	}
+}
+
+func put(tx *bbolt.Tx, e *db.Entry) error {
 	typeBytes := make([]byte, 4)
 	binary.BigEndian.PutUint32(typeBytes, uint32(e.Type))
 	index := e.Index()
-	key := make([]byte, 4)
-	binary.BigEndian.PutUint32(key, uint32(e.Key))
+	key := encodeKey(e.Key)
 
-	value, err := json.Marshal(e.Value)
+	value, err := encodeValue(e)
 	if err != nil {
 		return err
 	}
 
-	if err := s.db.Update(func(tx *bbolt.Tx) error {
-		typeBucket, err := tx.CreateBucketIfNotExists(typeBytes)
-		if err != nil {
+	if e.Type == db.CustomType {
+		c, _ := db.CodecOf(e.Value)
+		if err := setSeriesCodec(tx, index, c); err != nil {
 			return err
 		}
+	}
 
-		bucket, err := typeBucket.CreateBucketIfNotExists([]byte(index))
-		if err != nil {
+	typeBucket, err := tx.CreateBucketIfNotExists(typeBytes)
+	if err != nil {
+		return err
+	}
+
+	bucket, err := typeBucket.CreateBucketIfNotExists([]byte(index))
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, value)
+}
+
+func (s *Storage) GetRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+	return s.GetRangeContext(context.Background(), startTime, endTime, filter)
+}
+
+// GetRangeContext stops scanning the buckets once the context is done. The
+// values of a series without an UnmarshalFunc are decoded by their type.
+func (s *Storage) GetRangeContext(ctx context.Context, startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+	result := []db.KV{}
+	if err := s.scan(startTime, endTime, filter, func(t db.ValueType, name string, c *db.Codec, key int64, v []byte) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
-		if err := bucket.Put(key, value); err != nil {
-			return err
+		value, err := s.decodeValue(t, name, c, v)
+		if err != nil {
+			log.Println("data unmarshal error: ", err)
+			value = append([]byte(nil), v...)
 		}
 
+		result = append(result, db.KV{Key: key, Value: value})
 		return nil
 	}); err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return result, nil
 }
 
-func (s *Storage) GetRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
-	result := []db.KV{}
-
-	rangeBucket := func(name []byte, b *bbolt.Bucket) error {
-		if b == nil {
-			return nil
+// Aggregate computes the aggregations while scanning the buckets of the
+// series. The values of a series without an UnmarshalFunc are decoded by
+// their type.
+func (s *Storage) Aggregate(ctx context.Context, req db.AggregateRequest) ([]*db.AggregateSeries, error) {
+	a := db.NewAggregator(req)
+	if err := s.scan(req.StartTime, req.EndTime, req.Filter, func(t db.ValueType, name string, c *db.Codec, key int64, v []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
 		}
 
-		if filter != nil && !db.ContainTags(string(name), filter.Tags) {
-			return nil
+		value, err := s.decodeValue(t, name, c, v)
+		if err != nil {
+			log.Println("data unmarshal error: ", err)
+			value = v
 		}
 
-		if err := b.ForEach(func(k, v []byte) error {
-			fmt.Println(k, string(v))
-			key := binary.BigEndian.Uint32(k)
-			if key >= uint32(startTime) && key < uint32(endTime) {
-				if f, ok := s.unmarshalFunc[string(name)]; ok {
-					value, err := f(v)
-					if err == nil {
-						result = append(result, db.KV{Key: int64(key), Value: value})
-						return nil
+		return a.Add(name, db.KV{Key: key, Value: value})
+	}); err != nil {
+		return nil, err
+	}
+
+	return a.Result(), nil
+}
+
+// Last returns the last point of the bucket of every series and type matching
+// the filter. The values of a series without an UnmarshalFunc are decoded by their
+// type.
+func (s *Storage) Last(filter *db.QueryFilter) ([]*db.SeriesPoint, error) {
+	type namedPoint struct {
+		name string
+		p    *db.SeriesPoint
+	}
+
+	last := []namedPoint{}
+	if err := s.db.View(func(tx *bbolt.Tx) error {
+		typeBytes := make([]byte, 4)
+		for i := 0; i < int(db.TypeCount); i++ {
+			t := db.ValueType(i)
+			if filter != nil && filter.Type != db.UnknownType && filter.Type != t {
+				continue
+			}
+
+			binary.BigEndian.PutUint32(typeBytes, uint32(t))
+			bucket := tx.Bucket(typeBytes)
+			if bucket == nil {
+				continue
+			}
+
+			if err := bucket.ForEach(func(name, _ []byte) error {
+				b := bucket.Bucket(name)
+				if b == nil || !filter.Match(string(name)) {
+					return nil
+				}
+
+				k, v := b.Cursor().Last()
+				if k == nil {
+					return nil
+				}
+
+				key := decodeKey(k)
+				var c *db.Codec
+				if t == db.CustomType {
+					var err error
+					if c, err = seriesCodec(tx, string(name)); err != nil {
+						log.Println("series codec error: ", err)
 					}
+				}
+
+				value, err := s.decodeValue(t, string(name), c, v)
+				if err != nil {
 					log.Println("data unmarshal error: ", err)
+					value = v
+				}
+
+				metric, labels, err := db.ParseSeriesKey(string(name))
+				if err != nil {
+					return err
 				}
 
-				result = append(result, db.KV{Key: int64(key), Value: v})
+				last = append(last, namedPoint{string(name), &db.SeriesPoint{KV: db.KV{Key: key, Value: value}, Type: t, Metric: metric, Labels: labels}})
+				return nil
+			}); err != nil {
+				return err
 			}
+		}
 
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	// The buckets are walked by type, the points of a series stay ordered by
+	// type.
+	sort.SliceStable(last, func(i, j int) bool { return last[i].name < last[j].name })
+
+	result := make([]*db.SeriesPoint, len(last))
+	for i, np := range last {
+		result[i] = np.p
+	}
+
+	return result, nil
+}
+
+// decodeValue decodes a value of the series, c is the codec of a CustomType
+// series.
+func (s *Storage) decodeValue(t db.ValueType, name string, c *db.Codec, v []byte) (interface{}, error) {
+	if f, ok := s.unmarshalFunc[name]; ok {
+		return f(v)
+	}
+
+	switch t {
+	case db.IntType:
+		var value int64
+		err := json.Unmarshal(v, &value)
+		return value, err
+	case db.FloatType:
+		var value float64
+		err := json.Unmarshal(v, &value)
+		return value, err
+	case db.StringType:
+		var value string
+		err := json.Unmarshal(v, &value)
+		return value, err
+	case db.BoolType:
+		var value bool
+		err := json.Unmarshal(v, &value)
+		return value, err
+	case db.UnsignedType:
+		var value uint64
+		err := json.Unmarshal(v, &value)
+		return value, err
+	case db.BytesType:
+		return append([]byte(nil), v...), nil
+	case db.CustomType:
+		if c == nil {
+			return nil, fmt.Errorf("series %s has no codec", name)
+		}
+
+		return c.Unmarshal(v)
+	default:
+		return append([]byte(nil), v...), nil
+	}
+}
+
+// scan calls f with the points in [startTime, endTime) of the series which
+// match the filter, in the order of the buckets. c is the codec of the
+// CustomType series, nil if it can't be found.
+func (s *Storage) scan(startTime, endTime int64, filter *db.QueryFilter, f func(t db.ValueType, name string, c *db.Codec, key int64, v []byte) error) error {
+	rangeBucket := func(tx *bbolt.Tx, t db.ValueType, name []byte, b *bbolt.Bucket) error {
+		if b == nil {
 			return nil
-		}); err != nil {
-			return err
+		}
+
+		if !filter.Match(string(name)) {
+			return nil
+		}
+
+		var codec *db.Codec
+		if t == db.CustomType {
+			var err error
+			if codec, err = seriesCodec(tx, string(name)); err != nil {
+				log.Println("series codec error: ", err)
+			}
+		}
+
+		end := encodeKey(endTime)
+		c := b.Cursor()
+		for k, v := c.Seek(encodeKey(startTime)); k != nil && bytes.Compare(k, end) < 0; k, v = c.Next() {
+			if err := f(t, string(name), codec, decodeKey(k), v); err != nil {
+				return err
+			}
 		}
 
 		return nil
 	}
 
+	types := []db.ValueType{}
 	if filter != nil && filter.Type != db.UnknownType {
-		typeBytes := make([]byte, 4)
-		binary.BigEndian.PutUint32(typeBytes, uint32(filter.Type))
+		types = append(types, filter.Type)
+	} else {
+		for i := 0; i < int(db.TypeCount); i++ {
+			types = append(types, db.ValueType(i))
+		}
+	}
 
-		if err := s.db.View(func(tx *bbolt.Tx) error {
+	typeBytes := make([]byte, 4)
+	return s.db.View(func(tx *bbolt.Tx) error {
+		for _, t := range types {
+			binary.BigEndian.PutUint32(typeBytes, uint32(t))
 			bucket := tx.Bucket(typeBytes)
-			if bucket != nil {
-				if err := bucket.ForEach(func(k, v []byte) error {
-					return rangeBucket(k, bucket.Bucket(k))
-				}); err != nil {
-					return err
-				}
+			if bucket == nil {
+				continue
 			}
 
-			return nil
-		}); err != nil {
-			return nil, err
+			if err := bucket.ForEach(func(k, v []byte) error {
+				return rangeBucket(tx, t, k, bucket.Bucket(k))
+			}); err != nil {
+				return err
+			}
 		}
 
-		return result, nil
+		return nil
+	})
+}
+
+func (s *Storage) DeleteRange(startTime, endTime int64, filter *db.QueryFilter) error {
+	if err := filter.Validate(); err != nil {
+		return err
 	}
 
-	typeBytes := make([]byte, 4)
-	if err := s.db.View(func(tx *bbolt.Tx) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		typeBytes := make([]byte, 4)
 		for i := 0; i < int(db.TypeCount); i++ {
+			if filter != nil && filter.Type != db.UnknownType && filter.Type != db.ValueType(i) {
+				continue
+			}
+
 			binary.BigEndian.PutUint32(typeBytes, uint32(i))
-			bucket := tx.Bucket(typeBytes)
-			if bucket != nil {
-				if err := bucket.ForEach(func(k, v []byte) error {
-					return rangeBucket(k, bucket.Bucket(k))
-				}); err != nil {
+			typeBucket := tx.Bucket(typeBytes)
+			if typeBucket == nil {
+				continue
+			}
+
+			names := [][]byte{}
+			if err := typeBucket.ForEach(func(k, v []byte) error {
+				if v == nil && filter.Match(string(k)) {
+					names = append(names, append([]byte{}, k...))
+				}
+
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			for _, name := range names {
+				if err := deleteRange(typeBucket, name, startTime, endTime); err != nil {
 					return err
 				}
 			}
 		}
 
 		return nil
-	}); err != nil {
-		return nil, err
+	})
+}
+
+func deleteRange(typeBucket *bbolt.Bucket, name []byte, startTime, endTime int64) error {
+	bucket := typeBucket.Bucket(name)
+
+	keys := [][]byte{}
+	end := encodeKey(endTime)
+	c := bucket.Cursor()
+	for k, _ := c.Seek(encodeKey(startTime)); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
 	}
 
-	return result, nil
+	for _, k := range keys {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+
+	if k, _ := bucket.Cursor().First(); k == nil {
+		if err := typeBucket.DeleteBucket(name); err != nil {
+			return err
+		}
+
+		return deleteSeriesCodec(typeBucket.Tx(), string(name))
+	}
+
+	return nil
 }
 
 func (s *Storage) Close() error {
@@ -1,8 +1,11 @@
 package blot
 
 import (
+	"context"
 	"encoding/json"
+	"os"
 	"reflect"
+	"strconv"
 	"testing"
 
 	db "github.com/dovics/pangolin"
@@ -14,16 +17,7 @@ var testOption *Option = &Option{
 }
 
 func newTestStorage() (*Storage, error) {
-	bblotDB, err := bbolt.Open(testOption.Path, 0666, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Storage{
-		option:        testOption,
-		db:            bblotDB,
-		unmarshalFunc: make(map[string]UnmarshalFunc),
-	}, nil
+	return NewStorage(testOption)
 }
 
 func TestStorage(t *testing.T) {
@@ -31,6 +25,8 @@ func TestStorage(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.Remove(testOption.Path)
+	defer s.Close()
 
 	s.SetUnmarshalFunc("test", func(value []byte) (interface{}, error) {
 		var v int64
@@ -61,3 +57,422 @@ func TestStorage(t *testing.T) {
 		t.Errorf("expect %v, got %v\n", expectResult, result)
 	}
 }
+
+func TestInsertBatch(t *testing.T) {
+	bblotDB, err := bbolt.Open("./test_bblot_batch", 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_bblot_batch")
+
+	s := &Storage{
+		option:        &Option{Path: "./test_bblot_batch"},
+		db:            bblotDB,
+		unmarshalFunc: make(map[string]UnmarshalFunc),
+	}
+	defer s.Close()
+
+	entries := make([]*db.Entry, 0, 100)
+	for i := int64(0); i < 100; i++ {
+		entries = append(entries, &db.Entry{KV: db.KV{Key: i, Value: "v" + strconv.FormatInt(i, 10)}, Type: db.StringType, Tags: []string{"batch"}})
+	}
+
+	if err := s.InsertBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.GetRange(0, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != len(entries) {
+		t.Errorf("expect %d results, got %d", len(entries), len(result))
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	bblotDB, err := bbolt.Open("./test_bblot_delete", 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_bblot_delete")
+
+	s := &Storage{
+		option:        &Option{Path: "./test_bblot_delete"},
+		db:            bblotDB,
+		unmarshalFunc: make(map[string]UnmarshalFunc),
+	}
+	defer s.Close()
+
+	for i := int64(0); i < 100; i++ {
+		if err := s.Insert(&db.Entry{KV: db.KV{Key: i, Value: "a"}, Type: db.StringType, Tags: []string{"a"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Insert(&db.Entry{KV: db.KV{Key: i, Value: "b"}, Type: db.StringType, Tags: []string{"b"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.DeleteRange(10, 90, &db.QueryFilter{Tags: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.GetRange(0, 100, &db.QueryFilter{Tags: []string{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 20 {
+		t.Errorf("expect 20 results, got %d", len(result))
+	}
+
+	result, err = s.GetRange(0, 100, &db.QueryFilter{Tags: []string{"b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 100 {
+		t.Errorf("expect 100 results, got %d", len(result))
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	s, err := NewStorage(&Option{Path: "./test_bblot_timestamps"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_bblot_timestamps")
+	defer s.Close()
+
+	base := int64(1700000000000000000)
+	keys := []int64{-base, -1, 0, 1, base, base + 1<<32}
+	for _, key := range keys {
+		if err := s.Insert(&db.Entry{KV: db.KV{Key: key, Value: "v"}, Type: db.StringType, Tags: []string{"ts"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := s.GetRange(-base, base+1<<32+1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != len(keys) {
+		t.Fatalf("expect %d results, got %d", len(keys), len(result))
+	}
+
+	for i, kv := range result {
+		if kv.Key != keys[i] {
+			t.Errorf("expect key %d, got %d", keys[i], kv.Key)
+		}
+	}
+
+	if result, _ := s.GetRange(-1, 1, nil); len(result) != 2 {
+		t.Errorf("expect 2 results, got %v", result)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	path := "./test_bblot_migrate"
+	defer os.Remove(path)
+
+	bblotDB, err := bbolt.Open(path, 0666, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A version 1 database stores the timestamps as 4 bytes.
+	if err := bblotDB.Update(func(tx *bbolt.Tx) error {
+		typeBucket, err := tx.CreateBucket([]byte{0, 0, 0, byte(db.StringType)})
+		if err != nil {
+			return err
+		}
+
+		bucket, err := typeBucket.CreateBucket([]byte("old"))
+		if err != nil {
+			return err
+		}
+
+		for i := byte(0); i < 10; i++ {
+			if err := bucket.Put([]byte{0, 0, 0, i}, []byte(`"v"`)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	bblotDB.Close()
+
+	s, err := NewStorage(&Option{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The bucket named by the tag is renamed to its series key.
+	result, err := s.GetRange(5, 10, &db.QueryFilter{Tags: []string{"old"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 5 || result[0].Key != 5 {
+		t.Errorf("expect the keys 5 to 9, got %v", result)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	s, err := NewStorage(&Option{Path: "./test_bblot_aggregate"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_bblot_aggregate")
+	defer s.Close()
+
+	for i := int64(0); i < 100; i++ {
+		for _, host := range []string{"a", "b"} {
+			e := &db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": host}}
+			if err := s.Insert(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	result, err := s.Aggregate(context.Background(), db.AggregateRequest{
+		StartTime:    0,
+		EndTime:      100,
+		Filter:       &db.QueryFilter{Matchers: []*db.Matcher{db.MustNewMatcher(db.MatchEqual, "host", "a")}},
+		Window:       50,
+		Aggregations: []db.AggregateFunc{db.Count, db.Sum, db.Max},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []*db.AggregateSeries{{
+		Metric: "cpu",
+		Labels: map[string]string{"host": "a"},
+		Points: []db.AggregatePoint{
+			{Time: 0, Values: []float64{50, 1225, 49}},
+			{Time: 50, Values: []float64{50, 3725, 99}},
+		},
+	}}
+
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf("expect %v, got %v", expect, result)
+	}
+}
+
+func TestLast(t *testing.T) {
+	s, err := NewStorage(&Option{Path: "./test_bblot_last"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_bblot_last")
+	defer s.Close()
+
+	for i := int64(0); i < 10; i++ {
+		if err := s.Insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Insert(&db.Entry{KV: db.KV{Key: 3, Value: 1.5}, Type: db.FloatType, Metric: "cpu", Labels: map[string]string{"host": "b"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every type of a series has its newest point.
+	if err := s.Insert(&db.Entry{KV: db.KV{Key: 5, Value: 2.5}, Type: db.FloatType, Metric: "cpu", Labels: map[string]string{"host": "a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Last(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []*db.SeriesPoint{
+		{KV: db.KV{Key: 9, Value: int64(9)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}},
+		{KV: db.KV{Key: 5, Value: 2.5}, Type: db.FloatType, Metric: "cpu", Labels: map[string]string{"host": "a"}},
+		{KV: db.KV{Key: 3, Value: 1.5}, Type: db.FloatType, Metric: "cpu", Labels: map[string]string{"host": "b"}},
+	}
+
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf("expect %v, got %v", expect, result)
+	}
+}
+
+func TestValueTypes(t *testing.T) {
+	s, err := NewStorage(&Option{Path: "./test_bblot_types"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_bblot_types")
+	defer s.Close()
+
+	entries := []*db.Entry{
+		{KV: db.KV{Key: 1, Value: true}, Type: db.BoolType, Metric: "up"},
+		{KV: db.KV{Key: 1, Value: uint64(1) << 63}, Type: db.UnsignedType, Metric: "total"},
+		{KV: db.KV{Key: 1, Value: []byte{0, 1, 0xff}}, Type: db.BytesType, Metric: "payload"},
+	}
+
+	if err := s.InsertBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Last(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string]interface{}{"up": true, "total": uint64(1) << 63, "payload": []byte{0, 1, 0xff}}
+	if len(result) != len(expect) {
+		t.Fatalf("expect %d series, got %d", len(expect), len(result))
+	}
+
+	for _, p := range result {
+		if !reflect.DeepEqual(p.Value, expect[p.Metric]) {
+			t.Errorf("%s: expect %v, got %v", p.Metric, expect[p.Metric], p.Value)
+		}
+	}
+
+	for _, e := range entries {
+		kvs, err := s.GetRange(0, 2, &db.QueryFilter{Metric: e.Metric, Type: e.Type})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(kvs) != 1 || reflect.TypeOf(kvs[0].Value) != reflect.TypeOf(e.Value) || !reflect.DeepEqual(kvs[0].Value, e.Value) {
+			t.Errorf("%s: expect %T %v, got %v", e.Metric, e.Value, e.Value, kvs)
+		}
+	}
+}
+
+type location struct {
+	Lat, Lng float64
+}
+
+type sensor struct {
+	Name string
+}
+
+func init() {
+	db.RegisterCodec(location{}, db.JSONCodec[location]("blot-location"))
+	db.RegisterCodec(sensor{}, db.JSONCodec[sensor]("blot-sensor"))
+}
+
+func TestCustomType(t *testing.T) {
+	s, err := NewStorage(&Option{Path: "./test_bblot_custom"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_bblot_custom")
+	defer s.Close()
+
+	e := &db.Entry{KV: db.KV{Key: 1, Value: location{Lat: 1.5, Lng: 2}}, Type: db.CustomType, Metric: "position"}
+	if err := s.Insert(e); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.GetRange(0, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 1 || !reflect.DeepEqual(result[0], e.KV) {
+		t.Errorf("expect %v, got %v", e.KV, result)
+	}
+
+	last, err := s.Last(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(last) != 1 || !reflect.DeepEqual(last[0].KV, e.KV) {
+		t.Errorf("expect %v, got %v", e.KV, last)
+	}
+
+	// A series holds the values of a single codec.
+	other := &db.Entry{KV: db.KV{Key: 2, Value: sensor{Name: "a"}}, Type: db.CustomType, Metric: "position"}
+	if err := s.Insert(other); err == nil {
+		t.Error("expect an error for another codec")
+	}
+
+	if err := s.DeleteRange(0, 2, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Insert(other); err != nil {
+		t.Errorf("expect the codec to be removed with the series, got %v", err)
+	}
+}
+
+func TestGetRangeContext(t *testing.T) {
+	s, err := NewStorage(&Option{Path: "./test_bblot_context"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("./test_bblot_context")
+	defer s.Close()
+
+	if err := s.Insert(&db.Entry{KV: db.KV{Key: 1, Value: int64(1)}, Type: db.IntType, Metric: "cpu"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := s.GetRangeContext(ctx, 0, 2, nil); err != context.Canceled {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+
+	if err := s.InsertContext(ctx, &db.Entry{KV: db.KV{Key: 2, Value: int64(2)}, Type: db.IntType, Metric: "cpu"}); err != context.Canceled {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+}
+
+func TestSeries(t *testing.T) {
+	path := "./test_bblot_series"
+	defer os.Remove(path)
+
+	d, err := db.OpenDB(&db.Option{UUID: "2d1a4d35-6b4a-4a2e-9a55-8f0a9f1c8b11", Engine: "blot", EngineOption: &Option{Path: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	checkSeries(t, db.NewSeries[int64](d, "requests", map[string]string{"host": "a"}), []db.Point[int64]{{Time: 1, Value: -3}, {Time: 2, Value: 1 << 60}})
+	checkSeries(t, db.NewSeries[float64](d, "cpu", map[string]string{"host": "a"}), []db.Point[float64]{{Time: 1, Value: 0.5}, {Time: 2, Value: 1.5}})
+	checkSeries(t, db.NewSeries[string](d, "state", nil), []db.Point[string]{{Time: 1, Value: "ok"}, {Time: 2, Value: "down"}})
+	checkSeries(t, db.NewSeries[bool](d, "up", nil), []db.Point[bool]{{Time: 1, Value: true}, {Time: 2, Value: false}})
+	checkSeries(t, db.NewSeries[uint64](d, "total", nil), []db.Point[uint64]{{Time: 1, Value: 1}, {Time: 2, Value: 1 << 63}})
+	checkSeries(t, db.NewSeries[[]byte](d, "payload", nil), []db.Point[[]byte]{{Time: 1, Value: []byte{0, 0xff}}, {Time: 2, Value: []byte("x")}})
+}
+
+func checkSeries[T db.Value](t *testing.T, s *db.Series[T], points []db.Point[T]) {
+	t.Helper()
+	if err := s.InsertBatch(points); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.Range(0, 10)
+	if err != nil {
+		t.Fatalf("%s: %v", s.Key(), err)
+	}
+
+	if !reflect.DeepEqual(points, result) {
+		t.Errorf("%s: expect %v, got %v", s.Key(), points, result)
+	}
+
+	last, ok, err := s.Last()
+	if err != nil || !ok {
+		t.Fatalf("%s: expect the last point, got %v, %v", s.Key(), ok, err)
+	}
+
+	if !reflect.DeepEqual(points[len(points)-1], last) {
+		t.Errorf("%s: expect %v, got %v", s.Key(), points[len(points)-1], last)
+	}
+}
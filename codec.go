@@ -0,0 +1,87 @@
+package pangolin
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// Codec converts the values of a custom type to bytes and back. The name is
+// stored by the engines with the values, it must not change once values have
+// been written.
+type Codec struct {
+	Name      string
+	Marshal   func(value interface{}) ([]byte, error)
+	Unmarshal func(data []byte) (interface{}, error)
+}
+
+var (
+	codecsMu   sync.RWMutex
+	codecs     = make(map[string]*Codec)
+	codecTypes = make(map[reflect.Type]*Codec)
+)
+
+// RegisterCodec registers the codec of the values with the type of prototype,
+// these values are stored as CustomType. The codecs must be registered before
+// a DB holding their values is opened, usually in an init function.
+func RegisterCodec(prototype interface{}, c *Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	if c == nil || c.Marshal == nil || c.Unmarshal == nil {
+		panic("register codec is nil")
+	}
+
+	t := reflect.TypeOf(prototype)
+	if t == nil {
+		panic("register codec of a nil prototype")
+	}
+
+	if _, dup := codecs[c.Name]; dup {
+		panic("register called twice for codec " + c.Name)
+	}
+
+	if _, dup := codecTypes[t]; dup {
+		panic("register called twice for type " + t.String())
+	}
+
+	codecs[c.Name] = c
+	codecTypes[t] = c
+}
+
+// LookupCodec returns the codec registered with the name.
+func LookupCodec(name string) (*Codec, bool) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// CodecOf returns the codec registered for the type of the value.
+func CodecOf(value interface{}) (*Codec, bool) {
+	t := reflect.TypeOf(value)
+	if t == nil {
+		return nil, false
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	c, ok := codecTypes[t]
+	return c, ok
+}
+
+// JSONCodec returns a codec storing the values of T in JSON.
+func JSONCodec[T any](name string) *Codec {
+	return &Codec{
+		Name: name,
+		Marshal: func(value interface{}) ([]byte, error) {
+			return json.Marshal(value)
+		},
+		Unmarshal: func(data []byte) (interface{}, error) {
+			var value T
+			err := json.Unmarshal(data, &value)
+			return value, err
+		},
+	}
+}
@@ -0,0 +1,47 @@
+package pangolin
+
+import (
+	"reflect"
+	"testing"
+)
+
+type position struct {
+	X, Y int
+}
+
+func init() {
+	RegisterCodec(position{}, JSONCodec[position]("position"))
+}
+
+func TestCodec(t *testing.T) {
+	c, ok := LookupCodec("position")
+	if !ok {
+		t.Fatal("expect the codec to be registered")
+	}
+
+	if found, ok := CodecOf(position{X: 1}); !ok || found != c {
+		t.Errorf("expect the codec of the type, got %v", found)
+	}
+
+	if _, ok := CodecOf(&position{}); ok {
+		t.Error("expect no codec for the pointer type")
+	}
+
+	if TypeOf(position{}) != CustomType {
+		t.Errorf("expect custom type, got %d", TypeOf(position{}))
+	}
+
+	data, err := c.Marshal(position{X: 1, Y: -2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := c.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(value, position{X: 1, Y: -2}) {
+		t.Errorf("expect %v, got %v", position{X: 1, Y: -2}, value)
+	}
+}
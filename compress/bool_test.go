@@ -0,0 +1,100 @@
+package compress
+
+import (
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func Test_BooleanEncoder_NoValues(t *testing.T) {
+	enc := NewBooleanEncoder(0)
+	b, err := enc.Bytes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var dec BooleanDecoder
+	dec.SetBytes(b)
+	if dec.Next() {
+		t.Fatalf("unexpected next value: got true, exp false")
+	}
+}
+
+func Test_BooleanEncoder_Multi_Compressed(t *testing.T) {
+	enc := NewBooleanEncoder(10)
+
+	values := make([]bool, 10)
+	for i := range values {
+		values[i] = i%2 == 0
+		enc.Write(values[i])
+	}
+
+	b, err := enc.Bytes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if exp := 4; len(b) != exp {
+		t.Fatalf("unexpected length: got %v, exp %v", len(b), exp)
+	}
+
+	var dec BooleanDecoder
+	dec.SetBytes(b)
+
+	for i, v := range values {
+		if !dec.Next() {
+			t.Fatalf("unexpected next value: got false, exp true")
+		}
+		if v != dec.Read() {
+			t.Fatalf("unexpected value at pos %d: got %v, exp %v", i, dec.Read(), v)
+		}
+	}
+
+	if dec.Next() {
+		t.Fatalf("unexpected next value: got true, exp false")
+	}
+}
+
+func Test_BooleanEncoder_Quick(t *testing.T) {
+	if err := quick.Check(func(values []bool) bool {
+		expected := values
+		if values == nil {
+			expected = []bool{}
+		}
+
+		// Write values to encoder.
+		enc := NewBooleanEncoder(1024)
+		for _, v := range values {
+			enc.Write(v)
+		}
+
+		// Retrieve compressed bytes.
+		buf, err := enc.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Read values out of decoder.
+		got := make([]bool, 0, len(values))
+		var dec BooleanDecoder
+		dec.SetBytes(buf)
+		for dec.Next() {
+			got = append(got, dec.Read().(bool))
+		}
+
+		// Verify that input and output values match.
+		if !reflect.DeepEqual(expected, got) {
+			t.Fatalf("mismatch:\n\nexp=%#v\n\ngot=%#v\n\n", expected, got)
+		}
+
+		return true
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_BooleanEncoder_WrongType(t *testing.T) {
+	if err := NewBooleanEncoder(1).Write("true"); err == nil {
+		t.Fatal("expected an error for a string value")
+	}
+}
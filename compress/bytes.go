@@ -0,0 +1,68 @@
+package compress
+
+// Bytes encoding is the string encoding without the conversion of the values: each
+// value is appended with its variable byte length and the result is compressed with
+// snappy behind a 1 byte header.
+
+import (
+	"errors"
+)
+
+// BytesEncoder encodes multiple byte slices into a byte slice.
+type BytesEncoder struct {
+	s StringEncoder
+}
+
+// NewBytesEncoder returns a new BytesEncoder with an initial buffer ready to hold sz bytes.
+func NewBytesEncoder(sz int) *BytesEncoder {
+	return &BytesEncoder{s: StringEncoder{bytes: make([]byte, 0, sz)}}
+}
+
+// Flush is no-op
+func (e *BytesEncoder) Flush() {}
+
+// Reset sets the encoder back to its initial state.
+func (e *BytesEncoder) Reset() {
+	e.s.Reset()
+}
+
+// Write encodes b to the underlying buffer.
+func (e *BytesEncoder) Write(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("bytesEncoder wrong type")
+	}
+
+	return e.s.Write(string(b))
+}
+
+// Bytes returns a copy of the underlying buffer.
+func (e *BytesEncoder) Bytes() ([]byte, error) {
+	return e.s.Bytes()
+}
+
+// BytesDecoder decodes a byte slice into byte slices.
+type BytesDecoder struct {
+	s StringDecoder
+}
+
+// SetBytes initializes the decoder with bytes to read from.
+// This must be called before calling any other method.
+func (e *BytesDecoder) SetBytes(b []byte) error {
+	return e.s.SetBytes(b)
+}
+
+// Next returns true if there are any values remaining to be decoded.
+func (e *BytesDecoder) Next() bool {
+	return e.s.Next()
+}
+
+// Read returns the next value from the decoder.
+func (e *BytesDecoder) Read() interface{} {
+	return []byte(e.s.Read().(string))
+}
+
+// Error returns the last error encountered by the decoder.
+func (e *BytesDecoder) Error() error {
+	return e.s.Error()
+}
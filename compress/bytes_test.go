@@ -0,0 +1,43 @@
+package compress
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_BytesEncoder(t *testing.T) {
+	enc := NewBytesEncoder(1024)
+	values := [][]byte{{}, {0, 1, 2}, []byte(`"not json"`), {0xff}}
+	for _, v := range values {
+		if err := enc.Write(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := enc.Write("string"); err == nil {
+		t.Fatal("expected an error for a string value")
+	}
+
+	b, err := enc.Bytes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var dec BytesDecoder
+	if err := dec.SetBytes(b); err != nil {
+		t.Fatalf("unexpected error creating bytes decoder: %v", err)
+	}
+
+	got := [][]byte{}
+	for dec.Next() {
+		got = append(got, dec.Read().([]byte))
+	}
+
+	if err := dec.Error(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(values, got) {
+		t.Fatalf("mismatch: exp %v, got %v", values, got)
+	}
+}
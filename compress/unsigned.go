@@ -0,0 +1,178 @@
+package compress
+
+// Unsigned encoding packs the values with simple8b when all of them are less than
+// 1 << 60, they are stored uncompressed otherwise.  Unlike the integer encoding, the
+// values are neither delta nor zig zag encoded.
+//
+// Each encoded byte slice contains a 1 byte header followed by 8 byte packed integers
+// or 8 byte uncompressed integers.  The 4 high bits of the first byte indicate the
+// encoding type for the remaining bytes.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/jwilder/encoding/simple8b"
+)
+
+const (
+	// unsignedUncompressed is an uncompressed format using 8 bytes per point
+	unsignedUncompressed = 0
+	// unsignedCompressedSimple is a bit-packed format using simple8b encoding
+	unsignedCompressedSimple = 1
+)
+
+// UnsignedEncoder encodes uint64s into byte slices.
+type UnsignedEncoder struct {
+	values []uint64
+}
+
+// NewUnsignedEncoder returns a new unsigned encoder with an initial buffer of values sized at sz.
+func NewUnsignedEncoder(sz int) *UnsignedEncoder {
+	return &UnsignedEncoder{
+		values: make([]uint64, 0, sz),
+	}
+}
+
+// Flush is no-op
+func (e *UnsignedEncoder) Flush() {}
+
+// Reset sets the encoder back to its initial state.
+func (e *UnsignedEncoder) Reset() {
+	e.values = e.values[:0]
+}
+
+// Write encodes v to the underlying buffers.
+func (e *UnsignedEncoder) Write(value interface{}) error {
+	var v uint64
+	switch f := value.(type) {
+	case uint:
+		v = uint64(f)
+	case uint8:
+		v = uint64(f)
+	case uint16:
+		v = uint64(f)
+	case uint32:
+		v = uint64(f)
+	case uint64:
+		v = f
+	default:
+		return errors.New("unsignedEncoder wrong type")
+	}
+
+	e.values = append(e.values, v)
+	return nil
+}
+
+// Bytes returns a copy of the underlying buffer.
+func (e *UnsignedEncoder) Bytes() ([]byte, error) {
+	if len(e.values) == 0 {
+		return nil, nil
+	}
+
+	for _, v := range e.values {
+		// Value is too large to encode using packed format
+		if v > simple8b.MaxValue {
+			return e.encodeUncompressed(), nil
+		}
+	}
+
+	encoded, err := simple8b.EncodeAll(e.values)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 1+len(encoded)*8)
+	// 4 high bits of first byte store the encoding type for the block
+	b[0] = byte(unsignedCompressedSimple) << 4
+
+	for i, v := range encoded {
+		binary.BigEndian.PutUint64(b[1+i*8:], v)
+	}
+	return b, nil
+}
+
+func (e *UnsignedEncoder) encodeUncompressed() []byte {
+	b := make([]byte, 1+len(e.values)*8)
+	// 4 high bits of first byte store the encoding type for the block
+	b[0] = byte(unsignedUncompressed) << 4
+
+	for i, v := range e.values {
+		binary.BigEndian.PutUint64(b[1+i*8:], v)
+	}
+	return b
+}
+
+// UnsignedDecoder decodes a byte slice into uint64s.
+type UnsignedDecoder struct {
+	// 240 is the maximum number of values that can be encoded into a single uint64 using simple8b
+	values   [240]uint64
+	bytes    []byte
+	i        int
+	n        int
+	encoding byte
+	err      error
+}
+
+// SetBytes sets the underlying byte slice of the decoder.
+func (d *UnsignedDecoder) SetBytes(b []byte) error {
+	if len(b) > 0 {
+		d.encoding = b[0] >> 4
+		d.bytes = b[1:]
+	} else {
+		d.encoding = 0
+		d.bytes = nil
+	}
+
+	if len(d.bytes)%8 != 0 {
+		d.err = fmt.Errorf("UnsignedDecoder: not enough data to decode value")
+		return d.err
+	}
+
+	d.i = 0
+	d.n = 0
+	d.err = nil
+	return nil
+}
+
+// Next returns true if there are any values remaining to be decoded.
+func (d *UnsignedDecoder) Next() bool {
+	if d.err != nil {
+		return false
+	}
+
+	d.i++
+	for d.i >= d.n && len(d.bytes) > 0 {
+		v := binary.BigEndian.Uint64(d.bytes)
+		d.bytes = d.bytes[8:]
+		d.i = 0
+
+		switch d.encoding {
+		case unsignedUncompressed:
+			d.values[0], d.n = v, 1
+		case unsignedCompressedSimple:
+			n, err := simple8b.Decode(&d.values, v)
+			if err != nil {
+				d.err = fmt.Errorf("failed to decode value %v: %v", v, err)
+				return false
+			}
+			d.n = n
+		default:
+			d.err = fmt.Errorf("unknown encoding %v", d.encoding)
+			return false
+		}
+	}
+
+	return d.i < d.n
+}
+
+// Read returns the next value from the decoder.
+func (d *UnsignedDecoder) Read() interface{} {
+	return d.values[d.i]
+}
+
+// Error returns the last error encountered by the decoder.
+func (d *UnsignedDecoder) Error() error {
+	return d.err
+}
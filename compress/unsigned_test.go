@@ -0,0 +1,136 @@
+package compress
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func Test_UnsignedEncoder_NoValues(t *testing.T) {
+	enc := NewUnsignedEncoder(0)
+	b, err := enc.Bytes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var dec UnsignedDecoder
+	dec.SetBytes(b)
+	if dec.Next() {
+		t.Fatalf("unexpected next value: got true, exp false")
+	}
+}
+
+func Test_UnsignedEncoder_Packed(t *testing.T) {
+	enc := NewUnsignedEncoder(1024)
+	values := make([]uint64, 1000)
+	for i := range values {
+		values[i] = uint64(i % 16)
+		enc.Write(values[i])
+	}
+
+	b, err := enc.Bytes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := b[0] >> 4; got != unsignedCompressedSimple {
+		t.Fatalf("encoding type mismatch: exp simple, got %v", got)
+	}
+
+	// 4 bits per value packs 15 values in every 8 bytes.
+	if exp := 1 + (len(values)+14)/15*8; len(b) > exp {
+		t.Fatalf("unexpected length: got %v, exp at most %v", len(b), exp)
+	}
+
+	var dec UnsignedDecoder
+	dec.SetBytes(b)
+	for i, v := range values {
+		if !dec.Next() {
+			t.Fatalf("unexpected next value: got false, exp true")
+		}
+		if v != dec.Read() {
+			t.Fatalf("unexpected value at pos %d: got %v, exp %v", i, dec.Read(), v)
+		}
+	}
+
+	if dec.Next() {
+		t.Fatalf("unexpected next value: got true, exp false")
+	}
+}
+
+func Test_UnsignedEncoder_Uncompressed(t *testing.T) {
+	enc := NewUnsignedEncoder(2)
+	values := []uint64{1, math.MaxUint64}
+	for _, v := range values {
+		enc.Write(v)
+	}
+
+	b, err := enc.Bytes()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := b[0] >> 4; got != unsignedUncompressed {
+		t.Fatalf("encoding type mismatch: exp uncompressed, got %v", got)
+	}
+
+	var dec UnsignedDecoder
+	dec.SetBytes(b)
+	got := []uint64{}
+	for dec.Next() {
+		got = append(got, dec.Read().(uint64))
+	}
+
+	if !reflect.DeepEqual(values, got) {
+		t.Fatalf("mismatch: exp %v, got %v", values, got)
+	}
+}
+
+func Test_UnsignedEncoder_Quick(t *testing.T) {
+	if err := quick.Check(func(values []uint64) bool {
+		if values == nil {
+			values = []uint64{}
+		}
+
+		enc := NewUnsignedEncoder(1024)
+		for _, v := range values {
+			enc.Write(v)
+		}
+
+		buf, err := enc.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]uint64, 0, len(values))
+		var dec UnsignedDecoder
+		dec.SetBytes(buf)
+		for dec.Next() {
+			got = append(got, dec.Read().(uint64))
+		}
+
+		if err := dec.Error(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(values, got) {
+			t.Fatalf("mismatch:\n\nexp=%#v\n\ngot=%#v\n\n", values, got)
+		}
+
+		return true
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_UnsignedDecoder_Corrupt(t *testing.T) {
+	var dec UnsignedDecoder
+	if err := dec.SetBytes([]byte("\x10abc")); err == nil {
+		t.Fatal("expected an error for a truncated block")
+	}
+
+	if dec.Next() {
+		t.Fatalf("unexpected next value: got true, exp false")
+	}
+}
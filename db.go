@@ -1,6 +1,7 @@
 package pangolin
 
 import (
+	"context"
 	"errors"
 	"reflect"
 
@@ -52,32 +53,201 @@ func OpenDB(option *Option) (*DB, error) {
 }
 
 func (db *DB) Insert(time int64, value interface{}) error {
-	var t ValueType
+	return db.InsertContext(context.Background(), time, value)
+}
+
+func (db *DB) InsertContext(ctx context.Context, time int64, value interface{}) error {
+	return db.insert(ctx, &Entry{KV: KV{Key: time, Value: value}, Type: TypeOf(value)})
+}
+
+// TypeOf returns the type a value is stored as, the values of the other
+// kinds are stored as strings unless their type has a registered codec.
+func TypeOf(value interface{}) ValueType {
+	if _, ok := value.([]byte); ok {
+		return BytesType
+	}
+
+	if _, ok := CodecOf(value); ok {
+		return CustomType
+	}
+
 	switch reflect.TypeOf(value).Kind() {
-	case reflect.Int, reflect.Int64:
-		t = IntType
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return IntType
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return UnsignedType
 	case reflect.Float32, reflect.Float64:
-		t = FloatType
+		return FloatType
+	case reflect.Bool:
+		return BoolType
 	default:
-		t = StringType
+		return StringType
 	}
-
-	return db.engine.Insert(&Entry{KV: KV{Key: time, Value: value}, Type: t})
 }
 
 func (db *DB) InsertEntry(e *Entry) error {
+	return db.InsertEntryContext(context.Background(), e)
+}
+
+func (db *DB) InsertEntryContext(ctx context.Context, e *Entry) error {
 	if e.Value == nil {
 		return errors.New("value can't be nil")
 	}
 
+	if err := e.Validate(); err != nil {
+		return err
+	}
+
+	return db.insert(ctx, e)
+}
+
+// insert inserts the entry through the context variant of the engine if it
+// has one, the other engines are only called if the context isn't done.
+func (db *DB) insert(ctx context.Context, e *Entry) error {
+	if engine, ok := db.engine.(ContextEngine); ok {
+		return engine.InsertContext(ctx, e)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	return db.engine.Insert(e)
 }
 
+func (db *DB) InsertBatch(entries []*Entry) error {
+	return db.InsertBatchContext(context.Background(), entries)
+}
+
+// InsertBatchContext inserts the entries at once if the engine implements
+// BatchEngine, otherwise one by one until the context is done.
+func (db *DB) InsertBatchContext(ctx context.Context, entries []*Entry) error {
+	for _, e := range entries {
+		if e == nil || e.Value == nil {
+			return errors.New("value can't be nil")
+		}
+
+		if err := e.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if engine, ok := db.engine.(BatchEngine); ok {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		return engine.InsertBatch(entries)
+	}
+
+	for _, e := range entries {
+		if err := db.insert(ctx, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteRange removes the points in [startTime, endTime) of the series which
+// match the filter.
+func (db *DB) DeleteRange(startTime, endTime int64, filter *QueryFilter) error {
+	engine, ok := db.engine.(DeleteEngine)
+	if !ok {
+		return errors.New("engine doesn't support delete")
+	}
+
+	filter, err := filter.compile()
+	if err != nil {
+		return err
+	}
+
+	return engine.DeleteRange(startTime, endTime, filter)
+}
+
 func (db *DB) GetRange(startTime, endTime int64, filter *QueryFilter) ([]KV, error) {
+	return db.GetRangeContext(context.Background(), startTime, endTime, filter)
+}
+
+// GetRangeContext is GetRange stopping once the context is done, the engines
+// which don't implement ContextEngine are only called if it isn't done.
+func (db *DB) GetRangeContext(ctx context.Context, startTime, endTime int64, filter *QueryFilter) ([]KV, error) {
+	filter, err := filter.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	if engine, ok := db.engine.(ContextEngine); ok {
+		return engine.GetRangeContext(ctx, startTime, endTime, filter)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	return db.engine.GetRange(startTime, endTime, filter)
 }
 
+// Query streams the points in [req.StartTime, req.EndTime) which match the
+// filter. Engines that do not implement QueryEngine are adapted by
+// materializing the result of GetRange.
+func (db *DB) Query(ctx context.Context, req QueryRequest) (Iterator, error) {
+	filter, err := req.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	req.Filter = filter
+
+	if engine, ok := db.engine.(QueryEngine); ok {
+		return engine.Query(ctx, req)
+	}
+
+	result, err := db.GetRangeContext(ctx, req.StartTime, req.EndTime, req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSliceIterator(ctx, result), nil
+}
+
+// Aggregate computes the aggregations of the request inside the engine.
+func (db *DB) Aggregate(ctx context.Context, req AggregateRequest) ([]*AggregateSeries, error) {
+	engine, ok := db.engine.(AggregateEngine)
+	if !ok {
+		return nil, errors.New("engine doesn't support aggregation")
+	}
+
+	filter, err := req.Filter.compile()
+	if err != nil {
+		return nil, err
+	}
+	req.Filter = filter
+
+	return engine.Aggregate(ctx, req)
+}
+
+// Last returns the newest point of every series and type which matches the
+// filter, ordered by series key and type.
+func (db *DB) Last(filter *QueryFilter) ([]*SeriesPoint, error) {
+	engine, ok := db.engine.(LastEngine)
+	if !ok {
+		return nil, errors.New("engine doesn't support last")
+	}
+
+	filter, err := filter.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.Last(filter)
+}
+
 func (db *DB) Get(key int64, filter *QueryFilter) (interface{}, error) {
+	filter, err := filter.compile()
+	if err != nil {
+		return nil, err
+	}
+
 	result, err := db.engine.GetRange(key, key+1, filter)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,62 @@
+package pangolin
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestContext(t *testing.T) {
+	engine := &memEngine{series: map[string][]KV{}}
+	db := &DB{engine: engine}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := db.InsertContext(ctx, 1, int64(1)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	if err := db.InsertContext(ctx, 2, int64(2)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+
+	entries := []*Entry{{KV: KV{Key: 3, Value: int64(3)}, Type: IntType}}
+	if err := db.InsertBatchContext(ctx, entries); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+
+	if _, err := db.GetRangeContext(ctx, 0, 10, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+
+	result, err := db.GetRange(0, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 1 || result[0].Key != 1 {
+		t.Errorf("expect only the point inserted before the cancel, got %v", result)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	db := &DB{engine: &memEngine{series: map[string][]KV{}}}
+
+	if err := db.InsertEntry(&Entry{KV: KV{Key: 1, Value: int64(1)}, Type: IntType, Metric: "cpu{"}); err == nil {
+		t.Error("expect error for a wrong metric")
+	}
+
+	entries := []*Entry{{KV: KV{Key: 1, Value: int64(1)}, Type: IntType, Labels: map[string]string{"a=b": "c"}}}
+	if err := db.InsertBatch(entries); err == nil {
+		t.Error("expect error for a wrong label name")
+	}
+
+	filter := &QueryFilter{Matchers: []*Matcher{{Type: MatchRegexp, Name: "host", Value: "("}}}
+	if _, err := db.GetRange(0, 10, filter); err == nil {
+		t.Error("expect error for a wrong matcher")
+	}
+
+	if _, err := db.Query(context.Background(), QueryRequest{EndTime: 10, Filter: filter}); err == nil {
+		t.Error("expect error for a wrong matcher")
+	}
+}
@@ -1,6 +1,7 @@
 package pangolin
 
 import (
+	"context"
 	"sync"
 
 	"github.com/google/uuid"
@@ -27,8 +28,40 @@ func Register(name string, f NewEngineFunc) {
 	engines[name] = f
 }
 
+// Engine is the storage behind a DB.
+//
+// GetRange returns the points in [startTime, endTime) which match the filter.
+// The points are grouped by series, ordered by value type and then by index,
+// and are in timestamp order within a series. A series holds at most one
+// point per timestamp, when a timestamp is written more than once the newest
+// write wins.
 type Engine interface {
 	Insert(*Entry) error
 	GetRange(startTime, endTime int64, filter *QueryFilter) ([]KV, error)
 	Close() error
 }
+
+// ContextEngine is implemented by the engines which stop the work of a call
+// once its context is done, the files opened by the call are closed before it
+// returns.
+type ContextEngine interface {
+	InsertContext(ctx context.Context, e *Entry) error
+	GetRangeContext(ctx context.Context, startTime, endTime int64, filter *QueryFilter) ([]KV, error)
+}
+
+// BatchEngine is implemented by the engines which can insert many entries at
+// once more efficiently than one by one.
+type BatchEngine interface {
+	InsertBatch([]*Entry) error
+}
+
+// DeleteEngine is implemented by the engines which can delete points.
+type DeleteEngine interface {
+	DeleteRange(startTime, endTime int64, filter *QueryFilter) error
+}
+
+// LastEngine is implemented by the engines which can find the newest point of
+// the series without a time range.
+type LastEngine interface {
+	Last(filter *QueryFilter) ([]*SeriesPoint, error)
+}
@@ -2,16 +2,30 @@ package pangolin
 
 import (
 	"encoding/json"
-	"sort"
-	"strings"
+	"fmt"
 )
 
+// Entry is a point of the series identified by the metric and the labels.
 type Entry struct {
 	KV
-	Type ValueType
+	Type   ValueType
+	Metric string
+	Labels map[string]string
+
+	// Deprecated: Tags are converted to labels, a tag name=value is the
+	// label name with value and any other tag a label with an empty value.
 	Tags []string
 }
 
+// SeriesPoint is a point of the series identified by the metric and the
+// labels.
+type SeriesPoint struct {
+	KV
+	Type   ValueType
+	Metric string
+	Labels map[string]string
+}
+
 type ValueType int
 
 type KV struct {
@@ -24,59 +38,206 @@ const (
 	IntType
 	FloatType
 	StringType
+	BoolType
+	UnsignedType
+	BytesType
+	// CustomType is the type of the values with a registered codec, see
+	// RegisterCodec.
+	CustomType
 
 	TypeCount
 )
 
 func (e *Entry) Size() uint64 {
 	switch e.Type {
-	case IntType, FloatType:
+	case IntType, FloatType, UnsignedType:
 		return 8
+	case BoolType:
+		return 1
 	case StringType:
 		return uint64(len(e.Value.(string)) * 8)
+	case BytesType:
+		return uint64(len(e.Value.([]byte)) * 8)
+	case CustomType:
+		if c, ok := CodecOf(e.Value); ok {
+			data, _ := c.Marshal(e.Value)
+			return uint64(len(data) * 8)
+		}
+		fallthrough
 	default:
 		data, _ := json.Marshal(e.Value)
 		return uint64(len(data) * 8)
 	}
 }
 
-func (e *Entry) Index() string {
-	indexBuilder := &strings.Builder{}
-	sort.Strings(e.Tags)
-	for i, tag := range e.Tags {
-		indexBuilder.WriteString(tag)
-		if i != len(e.Tags)-1 {
-			indexBuilder.WriteRune(',')
+// Validate checks that the metric and the label names of the entry can be
+// parsed back from its series key.
+func (e *Entry) Validate() error {
+	if err := validateName(e.Metric, true); err != nil {
+		return fmt.Errorf("invalid metric %q: %w", e.Metric, err)
+	}
+
+	for name := range e.Labels {
+		if err := validateName(name, false); err != nil {
+			return fmt.Errorf("invalid label %q: %w", name, err)
 		}
 	}
 
-	return indexBuilder.String()
+	for name := range tagLabels(e.Tags) {
+		if err := validateName(name, false); err != nil {
+			return fmt.Errorf("invalid tag %q: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Index returns the canonical series key of the entry.
+func (e *Entry) Index() string {
+	if len(e.Tags) == 0 {
+		return SeriesKey(e.Metric, e.Labels)
+	}
+
+	labels := tagLabels(e.Tags)
+	for name, value := range e.Labels {
+		labels[name] = value
+	}
+
+	return SeriesKey(e.Metric, labels)
 }
 
+// QueryFilter selects the series of the type, the metric and matching every
+// matcher. The zero values of the fields match any series.
 type QueryFilter struct {
-	Type ValueType
+	Type     ValueType
+	Metric   string
+	Matchers []*Matcher
+
+	// Series only selects the series with the key, see SeriesKey, unlike the
+	// matchers which also select the series with more labels.
+	Series string
+
+	// Deprecated: every tag is an equality matcher on the label the tag is
+	// converted to, see Entry.Tags.
 	Tags []string
 }
 
-func (f *QueryFilter) Index() string {
-	indexBuilder := &strings.Builder{}
-	sort.Strings(f.Tags)
-	for i, tag := range f.Tags {
-		indexBuilder.WriteString(tag)
-		if i != len(f.Tags)-1 {
-			indexBuilder.WriteRune(',')
+// Validate checks the matchers and the series of the filter, an invalid
+// filter matches no series.
+func (f *QueryFilter) Validate() error {
+	if f == nil {
+		return nil
+	}
+
+	for _, m := range f.Matchers {
+		if _, err := m.compile(); err != nil {
+			return err
 		}
 	}
 
-	return indexBuilder.String()
+	if f.Series != "" {
+		if _, err := CanonicalSeriesKey(f.Series); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-func ContainTags(index string, tags []string) bool {
-	for _, tag := range tags {
-		if !strings.Contains(index, tag) {
+// compile returns a copy of the filter whose matchers are compiled once and
+// whose series is canonical, the engines match every series with it.
+func (f *QueryFilter) compile() (*QueryFilter, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+
+	c := *f
+	c.Matchers = make([]*Matcher, len(f.Matchers))
+	for i, m := range f.Matchers {
+		compiled, err := NewMatcher(m.Type, m.Name, m.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Matchers[i] = compiled
+	}
+
+	if f.Series != "" {
+		c.Series, _ = CanonicalSeriesKey(f.Series)
+	}
+
+	return &c, nil
+}
+
+// LabelMatchers returns the matchers of the filter, including the ones of the
+// metric and the tags.
+// The labels of Series are equality matchers.
+func (f *QueryFilter) LabelMatchers() []*Matcher {
+	matchers := f.labelMatchers()
+	if f.Series == "" {
+		return matchers
+	}
+
+	matchers = append([]*Matcher{}, matchers...)
+	metric, labels, _ := ParseSeriesKey(f.Series)
+	if metric != "" {
+		matchers = append(matchers, &Matcher{Type: MatchEqual, Name: MetricLabel, Value: metric})
+	}
+
+	for name, value := range labels {
+		matchers = append(matchers, &Matcher{Type: MatchEqual, Name: name, Value: value})
+	}
+
+	return matchers
+}
+
+// labelMatchers returns the matchers of the filter and the ones of the metric
+// and the tags.
+func (f *QueryFilter) labelMatchers() []*Matcher {
+	if f.Metric == "" && len(f.Tags) == 0 {
+		return f.Matchers
+	}
+
+	matchers := append([]*Matcher{}, f.Matchers...)
+	if f.Metric != "" {
+		matchers = append(matchers, &Matcher{Type: MatchEqual, Name: MetricLabel, Value: f.Metric})
+	}
+
+	for name, value := range tagLabels(f.Tags) {
+		matchers = append(matchers, &Matcher{Type: MatchEqual, Name: name, Value: value})
+	}
+
+	return matchers
+}
+
+// Match reports whether the series of the key matches the filter, the type
+// is not checked. A nil filter matches every series.
+func (f *QueryFilter) Match(key string) bool {
+	if f == nil {
+		return true
+	}
+
+	// The series of a compiled filter is canonical.
+	if f.Series != "" && f.Series != key {
+		series, err := CanonicalSeriesKey(f.Series)
+		if err != nil || series != key {
 			return false
 		}
 	}
 
-	return true
+	matchers := f.labelMatchers()
+	if len(matchers) == 0 {
+		return true
+	}
+
+	metric, labels, err := ParseSeriesKey(key)
+	if err != nil {
+		return false
+	}
+
+	return MatchSeries(matchers, metric, labels)
 }
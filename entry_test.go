@@ -0,0 +1,52 @@
+package pangolin
+
+import "testing"
+
+func TestTypeOf(t *testing.T) {
+	cases := []struct {
+		value  interface{}
+		expect ValueType
+	}{
+		{1, IntType},
+		{int32(1), IntType},
+		{uint(1), UnsignedType},
+		{uint64(1), UnsignedType},
+		{1.5, FloatType},
+		{float32(1.5), FloatType},
+		{true, BoolType},
+		{[]byte("raw"), BytesType},
+		{"text", StringType},
+		{map[string]int{}, StringType},
+	}
+
+	for _, c := range cases {
+		if result := TypeOf(c.value); result != c.expect {
+			t.Errorf("%T: expect type %d, got %d", c.value, c.expect, result)
+		}
+	}
+}
+
+func TestEntryValidate(t *testing.T) {
+	cases := []struct {
+		entry *Entry
+		valid bool
+	}{
+		{&Entry{}, true},
+		{&Entry{Metric: "cpu", Labels: map[string]string{"host": "a{b=c,d}"}}, true},
+		{&Entry{Tags: []string{"host=a,b"}}, true},
+		{&Entry{Metric: "cpu{"}, false},
+		{&Entry{Metric: "cpu="}, false},
+		{&Entry{Metric: "cpu,mem"}, false},
+		{&Entry{Labels: map[string]string{"host=": "a"}}, false},
+		{&Entry{Labels: map[string]string{"host,dc": "a"}}, false},
+		{&Entry{Labels: map[string]string{"{host": "a"}}, false},
+		{&Entry{Labels: map[string]string{"": "a"}}, false},
+		{&Entry{Tags: []string{"{host"}}, false},
+	}
+
+	for _, c := range cases {
+		if err := c.entry.Validate(); (err == nil) != c.valid {
+			t.Errorf("%+v: expect valid %v, got %v", c.entry, c.valid, err)
+		}
+	}
+}
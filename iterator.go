@@ -0,0 +1,78 @@
+package pangolin
+
+import "context"
+
+type QueryRequest struct {
+	StartTime int64
+	EndTime   int64
+	Filter    *QueryFilter
+}
+
+// Iterator streams the result of a query. Next must be called before the
+// first At, Close must always be called to release the resources held by
+// the iterator.
+type Iterator interface {
+	Next() bool
+	At() KV
+	Err() error
+	Close() error
+}
+
+// QueryEngine is implemented by the engines which can stream the result of
+// a query instead of materializing it with GetRange.
+type QueryEngine interface {
+	Query(ctx context.Context, req QueryRequest) (Iterator, error)
+}
+
+type sliceIterator struct {
+	ctx    context.Context
+	result []KV
+	i      int
+	err    error
+}
+
+// NewSliceIterator returns an Iterator over an already materialized result.
+func NewSliceIterator(ctx context.Context, result []KV) Iterator {
+	return &sliceIterator{ctx: ctx, result: result, i: -1}
+}
+
+func (it *sliceIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+
+	it.i++
+	return it.i < len(it.result)
+}
+
+func (it *sliceIterator) At() KV {
+	return it.result[it.i]
+}
+
+func (it *sliceIterator) Err() error {
+	return it.err
+}
+
+func (it *sliceIterator) Close() error {
+	it.result = nil
+	return nil
+}
+
+// Collect drains the iterator into a slice and closes it.
+func Collect(it Iterator) ([]KV, error) {
+	result := []KV{}
+	for it.Next() {
+		result = append(result, it.At())
+	}
+
+	if err := it.Err(); err != nil {
+		it.Close()
+		return nil, err
+	}
+
+	return result, it.Close()
+}
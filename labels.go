@@ -0,0 +1,263 @@
+package pangolin
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricLabel is the label name a Matcher uses to match the metric name.
+const MetricLabel = "__name__"
+
+// SeriesKey returns the canonical key of the series, the metric followed by
+// the labels sorted by name, e.g. cpu{host="a",region="eu"}.
+func SeriesKey(metric string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	b := &strings.Builder{}
+	b.WriteString(metric)
+	b.WriteRune('{')
+	for i, name := range names {
+		if i != 0 {
+			b.WriteRune(',')
+		}
+
+		b.WriteString(name)
+		b.WriteRune('=')
+		b.WriteString(strconv.Quote(labels[name]))
+	}
+	b.WriteRune('}')
+
+	return b.String()
+}
+
+// ParseSeriesKey parses a key returned by SeriesKey. Keys written before the
+// labels were added are tags joined by ',' and are parsed like Entry.Tags.
+func ParseSeriesKey(key string) (string, map[string]string, error) {
+	open := strings.IndexByte(key, '{')
+	if open < 0 || !strings.HasSuffix(key, "}") {
+		if key == "" {
+			return "", map[string]string{}, nil
+		}
+
+		return "", tagLabels(strings.Split(key, ",")), nil
+	}
+
+	metric, rest := key[:open], key[open+1:len(key)-1]
+	labels := map[string]string{}
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return "", nil, fmt.Errorf("wrong series key %s", key)
+		}
+		name := rest[:eq]
+
+		quoted, err := strconv.QuotedPrefix(rest[eq+1:])
+		if err != nil {
+			return "", nil, fmt.Errorf("wrong series key %s: %w", key, err)
+		}
+
+		value, err := strconv.Unquote(quoted)
+		if err != nil {
+			return "", nil, fmt.Errorf("wrong series key %s: %w", key, err)
+		}
+
+		labels[name] = value
+		rest = rest[eq+1+len(quoted):]
+		if rest != "" {
+			if rest[0] != ',' {
+				return "", nil, fmt.Errorf("wrong series key %s", key)
+			}
+			rest = rest[1:]
+		}
+	}
+
+	return metric, labels, nil
+}
+
+var errInvalidName = errors.New("names can't hold '{', '=' or ','")
+
+// validateName checks that a metric or label name can be parsed back from a
+// series key, only the metric may be empty.
+func validateName(name string, metric bool) error {
+	if name == "" && !metric {
+		return errors.New("label names can't be empty")
+	}
+
+	if strings.ContainsAny(name, "{=,") {
+		return errInvalidName
+	}
+
+	return nil
+}
+
+// CanonicalSeriesKey rewrites a key, possibly made of legacy tags, in the
+// canonical form of SeriesKey.
+func CanonicalSeriesKey(key string) (string, error) {
+	metric, labels, err := ParseSeriesKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	return SeriesKey(metric, labels), nil
+}
+
+// tagLabels converts legacy tags to labels, a tag name=value becomes the
+// label name with value and any other tag a label with an empty value.
+func tagLabels(tags []string) map[string]string {
+	labels := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if i := strings.IndexByte(tag, '='); i >= 0 {
+			labels[tag[:i]] = tag[i+1:]
+		} else {
+			labels[tag] = ""
+		}
+	}
+
+	return labels
+}
+
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	default:
+		return "unknown"
+	}
+}
+
+var errUnknownMatchType = errors.New("unknown match type")
+
+// Matcher matches the value of a label. Unlike an empty value, a missing
+// label never matches MatchEqual and MatchRegexp and always matches
+// MatchNotEqual and MatchNotRegexp. The regular expression of a matcher built
+// by NewMatcher is compiled once, the one of a matcher built as a struct
+// literal or modified since on every match. An invalid matcher, see
+// QueryFilter.Validate, matches no value.
+type Matcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+
+	re *regexp.Regexp
+}
+
+func NewMatcher(t MatchType, name, value string) (*Matcher, error) {
+	m := &Matcher{Type: t, Name: name, Value: value}
+	re, err := m.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	m.re = re
+	return m, nil
+}
+
+// compile checks the matcher and compiles its regular expression, nil for
+// the equality matchers.
+func (m *Matcher) compile() (*regexp.Regexp, error) {
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+		return nil, nil
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile matcher %s: %w", m, err)
+		}
+
+		return re, nil
+	default:
+		return nil, errUnknownMatchType
+	}
+}
+
+// regexp returns the regular expression of the matcher, nil if it is invalid.
+func (m *Matcher) regexp() *regexp.Regexp {
+	if m.re != nil && strings.TrimSuffix(strings.TrimPrefix(m.re.String(), "^(?:"), ")$") == m.Value {
+		return m.re
+	}
+
+	re, err := m.compile()
+	if err != nil {
+		return nil
+	}
+
+	return re
+}
+
+// MustNewMatcher is like NewMatcher but panics if the matcher is invalid.
+func MustNewMatcher(t MatchType, name, value string) *Matcher {
+	m, err := NewMatcher(t, name, value)
+	if err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+func (m *Matcher) String() string {
+	return m.Name + m.Type.String() + strconv.Quote(m.Value)
+}
+
+// Matches reports whether the label value, ok is false for a missing label,
+// matches.
+func (m *Matcher) Matches(value string, ok bool) bool {
+	switch m.Type {
+	case MatchEqual:
+		return ok && value == m.Value
+	case MatchNotEqual:
+		return !ok || value != m.Value
+	case MatchRegexp:
+		re := m.regexp()
+		return ok && re != nil && re.MatchString(value)
+	case MatchNotRegexp:
+		re := m.regexp()
+		return re != nil && (!ok || !re.MatchString(value))
+	default:
+		return false
+	}
+}
+
+// MatchSeries reports whether every matcher matches the series.
+func MatchSeries(matchers []*Matcher, metric string, labels map[string]string) bool {
+	for _, m := range matchers {
+		var (
+			value string
+			ok    bool
+		)
+
+		if m.Name == MetricLabel {
+			value, ok = metric, metric != ""
+		} else {
+			value, ok = labels[m.Name]
+		}
+
+		if !m.Matches(value, ok) {
+			return false
+		}
+	}
+
+	return true
+}
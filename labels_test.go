@@ -0,0 +1,126 @@
+package pangolin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSeriesKey(t *testing.T) {
+	key := SeriesKey("cpu", map[string]string{"region": "eu", "host": `a"b`})
+	if key != `cpu{host="a\"b",region="eu"}` {
+		t.Errorf("wrong series key %s", key)
+	}
+
+	metric, labels, err := ParseSeriesKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if metric != "cpu" || !reflect.DeepEqual(labels, map[string]string{"region": "eu", "host": `a"b`}) {
+		t.Errorf("wrong parse result %s %v", metric, labels)
+	}
+
+	legacy, err := CanonicalSeriesKey("host=a,test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if legacy != `{host="a",test=""}` {
+		t.Errorf("wrong legacy series key %s", legacy)
+	}
+
+	entry := &Entry{Tags: []string{"test", "host=a"}}
+	if entry.Index() != legacy {
+		t.Errorf("expect %s, got %s", legacy, entry.Index())
+	}
+}
+
+func TestQueryFilter(t *testing.T) {
+	key := SeriesKey("cpu", map[string]string{"host": "a", "region": "eu"})
+
+	cases := []struct {
+		filter *QueryFilter
+		match  bool
+	}{
+		{nil, true},
+		{&QueryFilter{}, true},
+		{&QueryFilter{Metric: "cpu"}, true},
+		{&QueryFilter{Metric: "mem"}, false},
+		{&QueryFilter{Tags: []string{"host=a"}}, true},
+		{&QueryFilter{Tags: []string{"host=ab"}}, false},
+		{&QueryFilter{Matchers: []*Matcher{MustNewMatcher(MatchEqual, "host", "a")}}, true},
+		{&QueryFilter{Matchers: []*Matcher{MustNewMatcher(MatchEqual, "host", "")}}, false},
+		{&QueryFilter{Matchers: []*Matcher{MustNewMatcher(MatchNotEqual, "host", "a")}}, false},
+		{&QueryFilter{Matchers: []*Matcher{MustNewMatcher(MatchNotEqual, "dc", "a")}}, true},
+		{&QueryFilter{Matchers: []*Matcher{MustNewMatcher(MatchRegexp, "region", "e.")}}, true},
+		{&QueryFilter{Matchers: []*Matcher{MustNewMatcher(MatchRegexp, "region", "e")}}, false},
+		{&QueryFilter{Matchers: []*Matcher{MustNewMatcher(MatchNotRegexp, "region", "us|ap")}}, true},
+		{&QueryFilter{Matchers: []*Matcher{MustNewMatcher(MatchRegexp, MetricLabel, "cp.")}}, true},
+		{&QueryFilter{Series: `cpu{region="eu",host="a"}`}, true},
+		{&QueryFilter{Series: `cpu{host="a"}`}, false},
+		{&QueryFilter{Series: `cpu{host="a"`}, false},
+	}
+
+	for _, c := range cases {
+		if c.filter.Match(key) != c.match {
+			t.Errorf("filter %v: expect %v", c.filter, c.match)
+		}
+	}
+
+	if _, err := NewMatcher(MatchRegexp, "host", "("); err == nil {
+		t.Error("expect error for a wrong regular expression")
+	}
+
+	// A matcher built as a struct literal is checked when the filter is
+	// validated and matches no series if it is invalid.
+	for _, matchType := range []MatchType{MatchRegexp, MatchNotRegexp} {
+		filter := &QueryFilter{Matchers: []*Matcher{{Type: matchType, Name: "host", Value: "("}}}
+		if err := filter.Validate(); err == nil {
+			t.Errorf("%s: expect error for a wrong regular expression", matchType)
+		}
+
+		if filter.Match(key) {
+			t.Errorf("%s: expect an invalid filter to match no series", matchType)
+		}
+	}
+
+	if err := (&QueryFilter{Series: `cpu{host=a}`}).Validate(); err == nil {
+		t.Error("expect error for a wrong series key")
+	}
+
+	valid := &QueryFilter{Matchers: []*Matcher{{Type: MatchRegexp, Name: "region", Value: "e."}}}
+	if err := valid.Validate(); err != nil || !valid.Match(key) {
+		t.Errorf("expect a valid filter matching the series, got %v", err)
+	}
+
+	// The compiled filter is a copy, the matchers of the filter are left as
+	// they are.
+	compiled, err := valid.compile()
+	if err != nil || compiled.Matchers[0].re == nil || valid.Matchers[0].re != nil || !compiled.Match(key) {
+		t.Errorf("expect a compiled copy matching the series, got %v", err)
+	}
+}
+
+func TestMatcherModified(t *testing.T) {
+	m := MustNewMatcher(MatchRegexp, "region", "e.")
+	if !m.Matches("eu", true) {
+		t.Error("expect eu to match")
+	}
+
+	// A copy is matched like the matcher, a modified matcher with its new
+	// value.
+	c := *m
+	if !c.Matches("eu", true) {
+		t.Error("expect the copy to match eu")
+	}
+
+	m.Value = "us"
+	if m.Matches("eu", true) || !m.Matches("us", true) {
+		t.Errorf("expect %s to match us only", m)
+	}
+
+	m.Value = "("
+	if m.Matches("(", true) {
+		t.Errorf("expect the invalid %s to match no value", m)
+	}
+}
@@ -0,0 +1,143 @@
+package lsmt
+
+import (
+	"context"
+
+	db "github.com/dovics/pangolin"
+	"github.com/dovics/pangolin/utils/rbtree"
+)
+
+// Aggregate streams the points of the query into an aggregator, so only the
+// results of the windows are held in memory. The blocks of the disk files
+// which the aggregator can take at once are answered from their statistics
+// without being read.
+func (s *Storage) Aggregate(ctx context.Context, req db.AggregateRequest) ([]*db.AggregateSeries, error) {
+	sources := s.sources(ctx, db.QueryRequest{StartTime: req.StartTime, EndTime: req.EndTime, Filter: req.Filter})
+	it := newIterator(ctx, sources)
+	defer it.Close()
+
+	a := db.NewAggregator(req)
+	if err := summarize(a, sources); err != nil {
+		return nil, err
+	}
+
+	for it.Next() {
+		if err := a.Add(it.series(), it.At()); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+
+	return a.Result(), nil
+}
+
+type seriesID struct {
+	index string
+	t     db.ValueType
+}
+
+type timeRange struct {
+	pos      int
+	min, max int64
+}
+
+// summarize adds the statistics of the blocks of the file sources to the
+// aggregator and removes the blocks from the sources. A block is summarized
+// only if no other source holds points of its series in its time range and
+// no tombstone of a newer source hides a part of it, so the merge of the
+// sources would have returned all its points.
+func summarize(a *db.Aggregator, sources []source) error {
+	ranges := map[seriesID][]timeRange{}
+	for pos, src := range sources {
+		switch src := src.(type) {
+		case *memtableSource:
+			src.m.mutex.RLock()
+			for i, b := range src.blocks {
+				min, max := b.data.Min(), b.data.Max()
+				if min == nil || max == nil {
+					continue
+				}
+
+				id := seriesID{src.indexes[i], b.valueType}
+				ranges[id] = append(ranges[id], timeRange{pos, min.(rbtree.TimestampItem).Time, max.(rbtree.TimestampItem).Time})
+			}
+			src.m.mutex.RUnlock()
+		case *fileSource:
+			if src.data == nil {
+				if err := src.open(); err != nil {
+					return err
+				}
+			}
+
+			for _, i := range src.indexes {
+				id := seriesID{i.index, i.t}
+				ranges[id] = append(ranges[id], timeRange{pos, i.min, i.max})
+			}
+		}
+	}
+
+	var newer []*tombstone
+	for pos, src := range sources {
+		fs, ok := src.(*fileSource)
+		if !ok {
+			newer = append(newer, src.tombstones()...)
+			continue
+		}
+
+		indexes := fs.indexes[:0]
+		for _, i := range fs.indexes {
+			if !summarizable(a, i, pos, ranges[seriesID{i.index, i.t}], newer) {
+				indexes = append(indexes, i)
+				continue
+			}
+
+			if err := a.AddSummary(i.index, i.summary()); err != nil {
+				return err
+			}
+		}
+		fs.indexes = indexes
+
+		newer = append(newer, fs.deleted...)
+	}
+
+	return nil
+}
+
+func summarizable(a *db.Aggregator, i *index, pos int, ranges []timeRange, newer []*tombstone) bool {
+	if i.stats == nil || !a.CanSummarize(i.min, i.max) {
+		return false
+	}
+
+	for _, r := range ranges {
+		if r.pos != pos && r.max >= i.min && r.min <= i.max {
+			return false
+		}
+	}
+
+	for _, t := range newer {
+		if t.match(i.index, i.t) && t.end > i.min && t.start <= i.max {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (i *index) summary() *db.Summary {
+	return &db.Summary{
+		StartTime: i.min,
+		EndTime:   i.max,
+		Count:     uint64(i.count),
+		Numbers:   uint64(i.count - i.stats.nan),
+		Sum:       i.stats.sum,
+		Min:       i.stats.min,
+		Max:       i.stats.max,
+		First:     i.stats.first,
+		Last:      i.stats.last,
+		FirstTime: i.stats.firstTime,
+		LastTime:  i.stats.lastTime,
+	}
+}
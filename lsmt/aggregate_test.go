@@ -0,0 +1,140 @@
+package lsmt
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestAggregate(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	x, _, err := openSeriesIndex(testOption.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	s := &Storage{mem: NewMemtable(), disk: dt, series: x}
+
+	// The newer points of the memtable win over those of the disk.
+	old := NewMemtable()
+	for i := int64(0); i < 20; i++ {
+		old.insert(&db.Entry{KV: db.KV{Key: i, Value: int64(-1)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}})
+		s.mem.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}})
+		s.mem.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "b"}})
+	}
+	dt.flush(old)
+
+	result, err := s.Aggregate(context.Background(), db.AggregateRequest{
+		StartTime:    0,
+		EndTime:      20,
+		Window:       10,
+		Aggregations: []db.AggregateFunc{db.Count, db.Sum},
+		GroupBy:      []string{db.MetricLabel},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []*db.AggregateSeries{{
+		Metric: "cpu",
+		Labels: map[string]string{},
+		Points: []db.AggregatePoint{
+			{Time: 0, Values: []float64{20, 90}},
+			{Time: 10, Values: []float64{20, 290}},
+		},
+	}}
+
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf("expect %v, got %v", expect, result)
+	}
+}
+
+func TestAggregatePushdown(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	x, _, err := openSeriesIndex(testOption.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	s := &Storage{mem: NewMemtable(), disk: dt, series: x}
+
+	mt := NewMemtable()
+	for i := int64(0); i < 10; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}})
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "b"}})
+	}
+	dt.flush(mt)
+
+	// The block of b is partly deleted by a newer file, it has to be read.
+	mt = NewMemtable()
+	mt.deleteRange(newTombstone(5, 7, &db.QueryFilter{Matchers: []*db.Matcher{db.MustNewMatcher(db.MatchEqual, "host", "b")}}))
+	dt.flush(mt)
+
+	s.mem.insert(&db.Entry{KV: db.KV{Key: 15, Value: int64(15)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}})
+
+	req := db.AggregateRequest{
+		StartTime:    0,
+		EndTime:      20,
+		Window:       10,
+		Aggregations: []db.AggregateFunc{db.Count, db.Sum, db.Min, db.Max, db.Mean, db.First, db.Last},
+	}
+
+	sources := s.sources(context.Background(), db.QueryRequest{StartTime: req.StartTime, EndTime: req.EndTime})
+	if err := summarize(db.NewAggregator(req), sources); err != nil {
+		t.Fatal(err)
+	}
+
+	read := []string{}
+	for _, src := range sources {
+		if fs, ok := src.(*fileSource); ok {
+			for _, i := range fs.indexes {
+				read = append(read, i.index)
+			}
+		}
+		src.Close()
+	}
+
+	if expect := []string{`cpu{host="b"}`}; !reflect.DeepEqual(read, expect) {
+		t.Errorf("expect to read the blocks %v, got %v", expect, read)
+	}
+
+	result, err := s.Aggregate(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []*db.AggregateSeries{
+		{Metric: "cpu", Labels: map[string]string{"host": "a"}, Points: []db.AggregatePoint{
+			{Time: 0, Values: []float64{10, 45, 0, 9, 4.5, 0, 9}},
+			{Time: 10, Values: []float64{1, 15, 15, 15, 15, 15, 15}},
+		}},
+		{Metric: "cpu", Labels: map[string]string{"host": "b"}, Points: []db.AggregatePoint{
+			{Time: 0, Values: []float64{8, 34, 0, 9, 4.25, 0, 9}},
+		}},
+	}
+
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf("expect %v, got %v", expect, result)
+	}
+}
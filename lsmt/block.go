@@ -2,7 +2,6 @@ package lsmt
 
 import (
 	"encoding/binary"
-	"errors"
 	"io"
 
 	db "github.com/dovics/pangolin"
@@ -17,9 +16,25 @@ type block struct {
 	count     int
 }
 
+// set inserts the point, a point with the same timestamp is overwritten.
 func (b *block) set(key int64, value interface{}) {
-	b.count++
-	b.data.Insert(rbtree.TimestampItem{Time: key, Value: value})
+	item := rbtree.TimestampItem{Time: key, Value: value}
+	if b.data.Get(item) != nil {
+		b.data.Delete(item)
+	} else {
+		b.count++
+	}
+
+	b.data.Insert(item)
+}
+
+// deleteRange removes the points in [startTime, endTime).
+func (b *block) deleteRange(startTime, endTime int64) {
+	items := b.data.GetRange(rbtree.TimestampItem{Time: startTime}, rbtree.TimestampItem{Time: endTime})
+	for _, item := range items {
+		b.data.Delete(item)
+		b.count--
+	}
 }
 
 // func (b *block) get(key int64) interface{} {
@@ -55,12 +70,14 @@ func (b *block) writeBlock(w io.Writer) (int, error) {
 	valueEncoder := NewEncoder(b.valueType, b.count)
 
 	iter := rbtree.NewTreeIter(b.data)
-	for item := iter.Next().(rbtree.TimestampItem); iter.HasNext(); item = iter.Next().(rbtree.TimestampItem) {
+	for iter.HasNext() {
+		item := iter.Next().(rbtree.TimestampItem)
 		timeEncoder.Write(item.Time)
 		if err := valueEncoder.Write(item.Value); err != nil {
 			return 0, err
 		}
 	}
+	valueEncoder.Flush()
 
 	timeData, err := timeEncoder.Bytes()
 	if err != nil {
@@ -97,18 +114,14 @@ func (b *block) writeBlock(w io.Writer) (int, error) {
 
 func readBlock(reader io.Reader) (*block, error) {
 	buffer := make([]byte, 4)
-	if n, err := reader.Read(buffer); err != nil {
+	if _, err := io.ReadFull(reader, buffer); err != nil {
 		return nil, err
-	} else if n != len(buffer) {
-		return nil, errors.New("no enough length")
 	}
 
 	valueType := binary.BigEndian.Uint32(buffer)
 
-	if n, err := reader.Read(buffer); err != nil {
+	if _, err := io.ReadFull(reader, buffer); err != nil {
 		return nil, err
-	} else if n != len(buffer) {
-		return nil, errors.New("no enough length")
 	}
 
 	timeLength := binary.BigEndian.Uint32(buffer)
@@ -116,43 +129,41 @@ func readBlock(reader io.Reader) (*block, error) {
 	timeDecoder := &compress.TimeDecoder{}
 
 	timeBuffer := make([]byte, timeLength)
-	if n, err := reader.Read(timeBuffer); err != nil {
+	if _, err := io.ReadFull(reader, timeBuffer); err != nil {
 		return nil, err
-	} else if n != len(timeBuffer) {
-		return nil, errors.New("no enough length")
 	}
 
 	timeDecoder.Init(timeBuffer)
 
-	if n, err := reader.Read(buffer); err != nil {
+	if _, err := io.ReadFull(reader, buffer); err != nil {
 		return nil, err
-	} else if n != len(buffer) {
-		return nil, errors.New("no enough length")
 	}
 
 	valueLength := binary.BigEndian.Uint32(buffer)
 
 	valueBuffer := make([]byte, valueLength)
-	if n, err := reader.Read(valueBuffer); err != nil {
+	if _, err := io.ReadFull(reader, valueBuffer); err != nil {
 		return nil, err
-	} else if n != len(valueBuffer) {
-		return nil, errors.New("no enough length")
 	}
 
 	decoder := NewDecoder(db.ValueType(valueType))
-	decoder.SetBytes(valueBuffer)
-	timeDecoder.Read()
-	decoder.Read()
+	if err := decoder.SetBytes(valueBuffer); err != nil {
+		return nil, err
+	}
 
 	tree := rbtree.New()
 	count := 0
-	for {
+	for timeDecoder.Next() && decoder.Next() {
 		tree.Insert(rbtree.TimestampItem{Time: timeDecoder.Read(), Value: decoder.Read()})
 		count++
+	}
 
-		if !decoder.Next() || !timeDecoder.Next() {
-			break
-		}
+	if err := timeDecoder.Error(); err != nil {
+		return nil, err
+	}
+
+	if err := decoder.Error(); err != nil {
+		return nil, err
 	}
 
 	return &block{
@@ -160,5 +171,4 @@ func readBlock(reader io.Reader) (*block, error) {
 		db.ValueType(valueType),
 		count,
 	}, nil
-
 }
@@ -2,6 +2,7 @@ package lsmt
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 
 	db "github.com/dovics/pangolin"
@@ -32,3 +33,32 @@ func TestBlock(t *testing.T) {
 		t.Error("wrong count")
 	}
 }
+
+func TestBlockTypes(t *testing.T) {
+	values := map[db.ValueType]func(i int64) interface{}{
+		db.BoolType:     func(i int64) interface{} { return i%3 == 0 },
+		db.UnsignedType: func(i int64) interface{} { return uint64(i) << 40 },
+		db.BytesType:    func(i int64) interface{} { return []byte{byte(i), 0xff} },
+	}
+
+	for valueType, value := range values {
+		b := &block{data: rbtree.New(), valueType: valueType}
+		for i := int64(0); i < 10; i++ {
+			b.set(i, value(i))
+		}
+
+		buffer := new(bytes.Buffer)
+		if _, err := b.writeBlock(buffer); err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := readBlock(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(result.getRange(0, 10), b.getRange(0, 10)) {
+			t.Errorf("type %d: expect %v, got %v", valueType, b.getRange(0, 10), result.getRange(0, 10))
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package lsmt
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// remoteCacheDir is the directory of the work dir holding the blocks read
+// from the remote tier.
+const remoteCacheDir = "remote-cache"
+
+var (
+	defaultRemoteCacheSize       int64 = 256 * 1024 * 1024
+	defaultRemoteMemoryCacheSize int64 = 64 * 1024 * 1024
+)
+
+// tableFile is the handle a SSTable is read through, the local file or the
+// object of the file on the remote tier.
+type tableFile interface {
+	io.ReaderAt
+	io.ReadSeeker
+	io.Closer
+}
+
+// blockCache reads the ranges of the objects of the remote tier, so a file
+// evicted from the local disk is read without downloading it. The footer, the
+// header and the blocks read are kept under a memory quota, the least
+// recently used are dropped once it is exceeded. They are also kept in the
+// disk tier if it is set, so a block dropped from memory is read again from
+// the local disk.
+type blockCache struct {
+	mutex sync.Mutex
+	store ObjectStore
+	quota int64
+	used  int64
+
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+
+	disk *diskBlockCache
+}
+
+type blockKey struct {
+	name   string
+	offset int64
+	length int
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data []byte
+}
+
+func newBlockCache(store ObjectStore, quota int64) *blockCache {
+	if quota == 0 {
+		quota = defaultRemoteMemoryCacheSize
+	}
+
+	return &blockCache{store: store, quota: quota, lru: list.New(), blocks: map[blockKey]*list.Element{}}
+}
+
+// open returns a handle reading the object of size bytes under ctx.
+func (c *blockCache) open(ctx context.Context, name string, size int64) tableFile {
+	return &remoteObject{SectionReader: io.NewSectionReader(&objectReader{ctx: ctx, cache: c, name: name}, 0, size)}
+}
+
+// readAt fills p with the bytes of the object from offset, it returns io.EOF
+// with the bytes read if the object ends first.
+func (c *blockCache) readAt(ctx context.Context, name string, p []byte, offset int64) (int, error) {
+	key := blockKey{name: name, offset: offset, length: len(p)}
+
+	c.mutex.Lock()
+	if e, ok := c.blocks[key]; ok {
+		c.lru.MoveToFront(e)
+		n := copy(p, e.Value.(*cachedBlock).data)
+		c.mutex.Unlock()
+		return n, nil
+	}
+	c.mutex.Unlock()
+
+	if data, ok := c.disk.get(key); ok {
+		c.put(key, data)
+		return copy(p, data), nil
+	}
+
+	object, err := c.store.GetRange(ctx, name, offset, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer object.Close()
+
+	n, err := io.ReadFull(object, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return n, io.EOF
+	} else if err != nil {
+		return n, err
+	}
+
+	data := append([]byte(nil), p...)
+	c.put(key, data)
+	c.disk.put(key, data)
+	return n, nil
+}
+
+func (c *blockCache) put(key blockKey, data []byte) {
+	if int64(len(data)) > c.quota {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.blocks[key]; ok {
+		return
+	}
+
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, data: data})
+	c.used += int64(len(data))
+
+	for c.used > c.quota {
+		e := c.lru.Back()
+		b := e.Value.(*cachedBlock)
+		c.lru.Remove(e)
+		delete(c.blocks, b.key)
+		c.used -= int64(len(b.data))
+	}
+}
+
+// drop removes the cached ranges of the object name, which is replaced.
+func (c *blockCache) drop(name string) {
+	c.mutex.Lock()
+	for key, e := range c.blocks {
+		if key.name == name {
+			c.lru.Remove(e)
+			delete(c.blocks, key)
+			c.used -= int64(len(e.Value.(*cachedBlock).data))
+		}
+	}
+	c.mutex.Unlock()
+
+	c.disk.drop(name)
+}
+
+// diskBlockCache keeps the blocks read from the remote tier as the files of
+// dir under a disk quota, the least recently used are removed once it is
+// exceeded. The cache is emptied when it is opened. A nil cache holds
+// nothing.
+type diskBlockCache struct {
+	mutex sync.Mutex
+	dir   string
+	quota int64
+	used  int64
+	seq   uint64
+
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+}
+
+type diskBlock struct {
+	key  blockKey
+	path string
+	size int64
+}
+
+func newDiskBlockCache(dir string, quota int64) (*diskBlockCache, error) {
+	if quota == 0 {
+		quota = defaultRemoteCacheSize
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create the cache directory %s: %w", dir, err)
+	}
+
+	return &diskBlockCache{dir: dir, quota: quota, lru: list.New(), blocks: map[blockKey]*list.Element{}}, nil
+}
+
+// get reads the cached block, a block removed while it is read is missing.
+func (c *diskBlockCache) get(key blockKey) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.mutex.Lock()
+	e, ok := c.blocks[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.mutex.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+
+	b := e.Value.(*diskBlock)
+	data, err := os.ReadFile(b.path)
+	if err != nil || int64(len(data)) != b.size {
+		return nil, false
+	}
+
+	return data, true
+}
+
+// put writes the block through a temporary file, so a reader never sees a
+// partial block. A block which can't be written isn't cached.
+func (c *diskBlockCache) put(key blockKey, data []byte) {
+	if c == nil || int64(len(data)) > c.quota {
+		return
+	}
+
+	c.mutex.Lock()
+	if _, ok := c.blocks[key]; ok {
+		c.mutex.Unlock()
+		return
+	}
+	c.seq++
+	p := path.Join(c.dir, fmt.Sprintf("%d", c.seq))
+	c.mutex.Unlock()
+
+	if err := os.WriteFile(p+tmpFileSuffix, data, 0600); err != nil {
+		os.Remove(p + tmpFileSuffix)
+		return
+	}
+
+	if err := os.Rename(p+tmpFileSuffix, p); err != nil {
+		os.Remove(p + tmpFileSuffix)
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.blocks[key]; ok {
+		os.Remove(p)
+		return
+	}
+
+	c.blocks[key] = c.lru.PushFront(&diskBlock{key: key, path: p, size: int64(len(data))})
+	c.used += int64(len(data))
+
+	for c.used > c.quota {
+		e := c.lru.Back()
+		b := e.Value.(*diskBlock)
+		c.lru.Remove(e)
+		delete(c.blocks, b.key)
+		c.used -= b.size
+		os.Remove(b.path)
+	}
+}
+
+func (c *diskBlockCache) drop(name string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, e := range c.blocks {
+		if key.name == name {
+			b := e.Value.(*diskBlock)
+			c.lru.Remove(e)
+			delete(c.blocks, key)
+			c.used -= b.size
+			os.Remove(b.path)
+		}
+	}
+}
+
+// objectReader reads an object through the cache under the context of the
+// reader which opened it.
+type objectReader struct {
+	ctx   context.Context
+	cache *blockCache
+	name  string
+}
+
+func (r *objectReader) ReadAt(p []byte, offset int64) (int, error) {
+	return r.cache.readAt(r.ctx, r.name, p, offset)
+}
+
+type remoteObject struct {
+	*io.SectionReader
+}
+
+func (r *remoteObject) Close() error {
+	return nil
+}
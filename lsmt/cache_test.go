@@ -0,0 +1,316 @@
+package lsmt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	db "github.com/dovics/pangolin"
+)
+
+// countingStore counts the reads of an object store.
+type countingStore struct {
+	ObjectStore
+	gets   int
+	ranges int
+	read   int64
+}
+
+func (c *countingStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	c.gets++
+	return c.ObjectStore.Get(ctx, name)
+}
+
+func (c *countingStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	c.ranges++
+	c.read += length
+	return c.ObjectStore.GetRange(ctx, name, offset, length)
+}
+
+func TestRemoteCache(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	store := &countingStore{ObjectStore: NewMemoryStore()}
+	rt := NewRemoteTable(store, testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+	dt.remote = newBlockCache(store, 0)
+
+	// Every file holds a block for each of the series.
+	expect := []db.KV{}
+	for i := int64(0); i < 3; i++ {
+		mt := NewMemtable()
+		for s := 0; s < 20; s++ {
+			for j := i * 10; j < i*10+10; j++ {
+				mt.insert(&db.Entry{KV: db.KV{Key: j, Value: j}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": fmt.Sprint(s)}})
+				if s == 0 {
+					expect = append(expect, db.KV{Key: j, Value: j})
+				}
+			}
+		}
+		dt.flush(mt)
+
+		for _, file := range dt.files {
+			if file.seq == dt.seq {
+				if err := rt.upload(context.Background(), file.path); err != nil {
+					t.Fatal(err)
+				}
+				dt.uploaded(file.path)
+			}
+		}
+	}
+
+	var size int64
+	remote := 0
+	for _, file := range dt.files {
+		if file.remote {
+			remote++
+			size += file.size
+			if _, err := os.Stat(file.path); !os.IsNotExist(err) {
+				t.Errorf("expect the local copy of %s to be removed, got %v", file.path, err)
+			}
+		}
+	}
+
+	if remote == 0 {
+		t.Fatal("expect files to be evicted from the local disk")
+	}
+
+	filter := &db.QueryFilter{Matchers: []*db.Matcher{db.MustNewMatcher(db.MatchEqual, "host", "0")}}
+	result, err := dt.getRange(0, 30, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expect) {
+		t.Errorf("expect %v, got %v", expect, result)
+	}
+
+	// Only the footer, the header and the blocks of the series are read.
+	if store.gets != 0 || store.read >= size {
+		t.Errorf("expect ranged reads of less than %d bytes, got %d gets and %d bytes", size, store.gets, store.read)
+	}
+
+	// The ranges read are cached.
+	ranges := store.ranges
+	if _, err := dt.getRange(0, 30, filter); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.ranges != ranges {
+		t.Errorf("expect the ranges to be cached, got %d more reads", store.ranges-ranges)
+	}
+
+	// A corrupt block is rejected.
+	dt.remote = newBlockCache(store, 0)
+	for _, file := range dt.files {
+		if !file.remote {
+			continue
+		}
+
+		object, err := store.Get(context.Background(), path.Base(file.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := io.ReadAll(object)
+		object.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The blocks are at the start of the file.
+		data[0] ^= 0xff
+		if err := store.Put(context.Background(), path.Base(file.path), bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := dt.getRange(0, 30, nil); err == nil {
+		t.Error("expect an error for a corrupt block")
+	}
+}
+
+func TestBlockCacheQuota(t *testing.T) {
+	store := NewMemoryStore()
+	data := bytes.Repeat([]byte("pangolin"), 16)
+	if err := store.Put(context.Background(), "object", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newBlockCache(store, 32)
+	for offset := int64(0); offset < int64(len(data)); offset += 16 {
+		buffer := make([]byte, 16)
+		if _, err := c.readAt(context.Background(), "object", buffer, offset); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buffer, data[offset:offset+16]) {
+			t.Errorf("expect %q at %d, got %q", data[offset:offset+16], offset, buffer)
+		}
+
+		if c.used > c.quota {
+			t.Errorf("expect the cache under its quota, got %d bytes", c.used)
+		}
+	}
+
+	// A read past the end returns the bytes of the object with io.EOF.
+	buffer := make([]byte, 16)
+	if n, err := c.readAt(context.Background(), "object", buffer, int64(len(data))-8); n != 8 || err != io.EOF {
+		t.Errorf("expect 8 bytes and io.EOF, got %d and %v", n, err)
+	}
+}
+
+// blockingStore blocks the ranged reads until it is released.
+type blockingStore struct {
+	ObjectStore
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	select {
+	case b.entered <- struct{}{}:
+	default:
+	}
+
+	select {
+	case <-b.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return b.ObjectStore.GetRange(ctx, name, offset, length)
+}
+
+func TestSlowRemoteRead(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	store := &blockingStore{ObjectStore: NewMemoryStore(), entered: make(chan struct{}, 1), release: make(chan struct{})}
+	rt := NewRemoteTable(store, testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+	dt.remote = newBlockCache(store, 0)
+
+	mt := NewMemtable()
+	mt.insert(&db.Entry{KV: db.KV{Key: 0, Value: int64(0)}, Type: db.IntType, Metric: "cpu"})
+	dt.flush(mt)
+
+	file := dt.files[0]
+	if err := rt.upload(context.Background(), file.path); err != nil {
+		t.Fatal(err)
+	}
+	dt.uploaded(file.path)
+	if err := file.Clean(); err != nil || !file.remote {
+		t.Fatalf("expect the file on the remote tier, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := file.loadIndexes(context.Background())
+		done <- err
+	}()
+	<-store.entered
+
+	// The table isn't locked while the file is read.
+	dt.flush(mt)
+	if dt.Len() != 2 {
+		t.Errorf("expect 2 files, got %d", dt.Len())
+	}
+
+	// A reader waiting for the file gives up with its context.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, err := file.loadIndexes(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expect %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	close(store.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	indexes, _, err := file.loadIndexes(context.Background())
+	if err != nil || len(indexes[db.IntType]) != 1 {
+		t.Errorf("expect the index of the series, got %v, %v", indexes, err)
+	}
+}
+
+func TestBlockCacheDisk(t *testing.T) {
+	dir := path.Join(os.TempDir(), "pangolin-remote-cache")
+	defer os.RemoveAll(dir)
+
+	store := &countingStore{ObjectStore: NewMemoryStore()}
+	data := bytes.Repeat([]byte("pangolin"), 16)
+	if err := store.Put(context.Background(), "object", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The memory tier holds a single block, the disk tier four.
+	c := newBlockCache(store, 16)
+	disk, err := newDiskBlockCache(dir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.disk = disk
+
+	read := func(offset int64) {
+		buffer := make([]byte, 16)
+		if _, err := c.readAt(context.Background(), "object", buffer, offset); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buffer, data[offset:offset+16]) {
+			t.Errorf("expect %q at %d, got %q", data[offset:offset+16], offset, buffer)
+		}
+	}
+
+	for offset := int64(0); offset < int64(len(data)); offset += 16 {
+		read(offset)
+	}
+
+	if disk.used > disk.quota || len(disk.blocks) != 4 {
+		t.Errorf("expect 4 blocks under the disk quota, got %d blocks of %d bytes", len(disk.blocks), disk.used)
+	}
+
+	// The blocks dropped from memory are read from the disk.
+	ranges := store.ranges
+	for offset := int64(len(data)) - 64; offset < int64(len(data)); offset += 16 {
+		read(offset)
+	}
+
+	if store.ranges != ranges {
+		t.Errorf("expect the blocks to be read from the disk, got %d remote reads", store.ranges-ranges)
+	}
+
+	read(0)
+	if store.ranges != ranges+1 {
+		t.Errorf("expect the evicted block to be read from the remote tier, got %d remote reads", store.ranges-ranges)
+	}
+
+	// The cache is emptied when it is opened.
+	if _, err := newDiskBlockCache(dir, 64); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expect an empty cache directory, got %d entries, %v", len(entries), err)
+	}
+}
@@ -0,0 +1,508 @@
+package lsmt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The catalog is a set of objects of the remote tier describing the uploaded
+// files, it is read into memory at open so the remote files are pruned
+// without listing the bucket or reading their indexes. Every update is
+// written as a delta object named after its sequence, so an upload costs a
+// small object and never replaces a concurrent update. Once catalogMaxDeltas
+// deltas are written, the live set is written to the base object with the
+// sequence of the last delta it includes, and the older deltas are deleted.
+// Both are sequences of framed records.
+//
+// record: | version | kind | add / remove / base |
+//
+// add:    | name | id | minKey | maxKey | size | checksum | series | metric count | metric | ... |
+// remove: | name |
+// base:   | seq |
+
+const (
+	catalogName    = "CATALOG"
+	catalogVersion = 1
+
+	catalogAddFile    = 0
+	catalogRemoveFile = 1
+	catalogBase       = 2
+)
+
+var (
+	catalogMaxDeltas = 64
+
+	errCatalogCorrupt = errors.New("catalog record is corrupt")
+)
+
+// catalogEntry describes an uploaded file, series is the number of series it
+// holds and metrics their sorted metric names. A listed entry is rebuilt from
+// the listing of the remote tier and doesn't know what the file holds.
+type catalogEntry struct {
+	name     string
+	id       uint64
+	minKey   int64
+	maxKey   int64
+	size     int64
+	checksum uint32
+
+	series  int
+	metrics []string
+	listed  bool
+}
+
+// mayContain reports whether the file may hold a series of the metrics.
+func (e *catalogEntry) mayContain(metrics map[string]bool) bool {
+	if e.listed {
+		return true
+	}
+
+	for _, metric := range e.metrics {
+		if metrics[metric] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteCatalog holds the catalog in memory. seq is the sequence of the last
+// delta and deltas the number written since the base. An unloaded catalog is
+// loaded before its first update.
+type remoteCatalog struct {
+	mutex   sync.RWMutex
+	store   ObjectStore
+	entries map[string]*catalogEntry
+	seq     uint64
+	deltas  int
+	loaded  bool
+}
+
+func newRemoteCatalog(store ObjectStore) *remoteCatalog {
+	return &remoteCatalog{store: store, entries: map[string]*catalogEntry{}}
+}
+
+func catalogDeltaName(seq uint64) string {
+	return fmt.Sprintf("%s.%020d", catalogName, seq)
+}
+
+// load reads the catalog of the store, it is empty until the first upload. A
+// catalog which can't be read is rebuilt from the listing of the store and
+// replaced by the next update, its entries are catalogued again as the files
+// are queued for upload.
+func (c *remoteCatalog) load(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.loadLocked(ctx)
+}
+
+func (c *remoteCatalog) loadLocked(ctx context.Context) error {
+	entries, seq, deltas, err := readCatalog(ctx, c.store)
+	if err != nil {
+		log.Println("catalog read error: ", err)
+		if entries, seq, err = listCatalog(ctx, c.store); err != nil {
+			return err
+		}
+		deltas = catalogMaxDeltas
+	}
+
+	c.entries, c.seq, c.deltas, c.loaded = entries, seq, deltas, true
+	return nil
+}
+
+// readCatalog reads the base and the deltas written after it.
+func readCatalog(ctx context.Context, store ObjectStore) (map[string]*catalogEntry, uint64, int, error) {
+	entries := map[string]*catalogEntry{}
+	base, err := readCatalogObject(ctx, store, catalogName, entries)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	objects, err := store.List(ctx, catalogName+".")
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to list the catalog: %w", err)
+	}
+
+	seqs := []uint64{}
+	for _, object := range objects {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(object.Name, catalogName+"."), 10, 64)
+		if err == nil && seq > base {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	seq := base
+	for _, s := range seqs {
+		if _, err := readCatalogObject(ctx, store, catalogDeltaName(s), entries); err != nil {
+			return nil, 0, 0, err
+		}
+		seq = s
+	}
+
+	return entries, seq, len(seqs), nil
+}
+
+// readCatalogObject applies the records of the object to entries, it returns
+// the sequence of a base. A missing object is empty.
+func readCatalogObject(ctx context.Context, store ObjectStore, name string, entries map[string]*catalogEntry) (uint64, error) {
+	object, err := store.Get(ctx, name)
+	if errors.Is(err, ErrObjectNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to read the catalog %s: %w", name, err)
+	}
+	defer object.Close()
+
+	var seq uint64
+	if _, err := readFramed(object, func(payload []byte) error {
+		return decodeCatalogRecord(payload, entries, &seq)
+	}); err != nil {
+		// The objects are written at once, so a torn record is corruption.
+		return 0, fmt.Errorf("failed to read the catalog %s: %w", name, err)
+	}
+
+	return seq, nil
+}
+
+// listCatalog rebuilds the catalog from the objects of the store named like
+// files, the sequence is past every delta so none is replaced.
+func listCatalog(ctx context.Context, store ObjectStore) (map[string]*catalogEntry, uint64, error) {
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list the remote tier: %w", err)
+	}
+
+	entries := map[string]*catalogEntry{}
+	var seq uint64
+	for _, object := range objects {
+		if strings.HasPrefix(object.Name, catalogName+".") {
+			if s, err := strconv.ParseUint(strings.TrimPrefix(object.Name, catalogName+"."), 10, 64); err == nil && s > seq {
+				seq = s
+			}
+			continue
+		}
+
+		minKey, maxKey, id, err := parseFileName(object.Name)
+		if err != nil {
+			continue
+		}
+
+		entries[object.Name] = &catalogEntry{
+			name:   object.Name,
+			id:     id,
+			minKey: minKey,
+			maxKey: maxKey,
+			size:   object.Size,
+			listed: true,
+		}
+	}
+
+	return entries, seq, nil
+}
+
+func (c *remoteCatalog) get(name string) (*catalogEntry, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	entry, ok := c.entries[name]
+	return entry, ok
+}
+
+// names returns the names of the catalogued files.
+func (c *remoteCatalog) names() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	names := make([]string, 0, len(c.entries))
+	for name := range c.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// add records the entries once the delta holding them is written.
+func (c *remoteCatalog) add(ctx context.Context, entries ...*catalogEntry) error {
+	var (
+		dst []byte
+		err error
+	)
+	for _, entry := range entries {
+		if dst, err = appendCatalogEntry(dst, entry); err != nil {
+			return err
+		}
+	}
+
+	return c.update(ctx, dst, func(m map[string]*catalogEntry) {
+		for _, entry := range entries {
+			m[entry.name] = entry
+		}
+	})
+}
+
+// remove drops the entries of the files once the delta removing them is
+// written, it isn't written if none of them is catalogued.
+func (c *remoteCatalog) remove(ctx context.Context, names ...string) error {
+	c.mutex.RLock()
+	found := !c.loaded
+	for _, name := range names {
+		if _, ok := c.entries[name]; ok {
+			found = true
+		}
+	}
+	c.mutex.RUnlock()
+
+	if !found {
+		return nil
+	}
+
+	var (
+		dst []byte
+		err error
+	)
+	for _, name := range names {
+		if dst, err = appendCatalogRemove(dst, name); err != nil {
+			return err
+		}
+	}
+
+	return c.update(ctx, dst, func(m map[string]*catalogEntry) {
+		for _, name := range names {
+			delete(m, name)
+		}
+	})
+}
+
+// update writes the records of a delta and applies them with f once it is
+// written. The lock is held while writing so the deltas are applied in the
+// order of their sequences. A failed delta leaves a gap in the sequences.
+func (c *remoteCatalog) update(ctx context.Context, records []byte, f func(map[string]*catalogEntry)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.loaded {
+		if err := c.loadLocked(ctx); err != nil {
+			return err
+		}
+	}
+
+	c.seq++
+	if err := c.store.Put(ctx, catalogDeltaName(c.seq), bytes.NewReader(records), int64(len(records))); err != nil {
+		return fmt.Errorf("failed to write the catalog: %w", err)
+	}
+
+	f(c.entries)
+	c.deltas++
+
+	if c.deltas >= catalogMaxDeltas {
+		if err := c.writeBaseLocked(ctx); err != nil {
+			log.Println("catalog write error: ", err)
+		}
+	}
+
+	return nil
+}
+
+// writeBaseLocked writes the catalog to the base and deletes the deltas it
+// includes, a delta left by a failed delete is skipped on load. The listed
+// entries aren't written, the files are catalogued again before they are
+// needed.
+func (c *remoteCatalog) writeBaseLocked(ctx context.Context) error {
+	names := make([]string, 0, len(c.entries))
+	for name, entry := range c.entries {
+		if !entry.listed {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	dst, err := appendCatalogBase(nil, c.seq)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if dst, err = appendCatalogEntry(dst, c.entries[name]); err != nil {
+			return err
+		}
+	}
+
+	if err := c.store.Put(ctx, catalogName, bytes.NewReader(dst), int64(len(dst))); err != nil {
+		return fmt.Errorf("failed to write the catalog: %w", err)
+	}
+	c.deltas = 0
+
+	objects, err := c.store.List(ctx, catalogName+".")
+	if err != nil {
+		return fmt.Errorf("failed to list the catalog: %w", err)
+	}
+
+	for _, object := range objects {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(object.Name, catalogName+"."), 10, 64)
+		if err != nil || seq > c.seq {
+			continue
+		}
+
+		if err := c.store.Delete(ctx, object.Name); err != nil {
+			return fmt.Errorf("failed to delete the catalog %s: %w", object.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func appendCatalogEntry(dst []byte, entry *catalogEntry) ([]byte, error) {
+	return appendFramed(dst, func(dst []byte) ([]byte, error) {
+		dst = append(dst, catalogVersion, catalogAddFile)
+		dst = appendString(dst, entry.name)
+		dst = appendUvarint(dst, entry.id)
+		dst = appendInt64(dst, entry.minKey)
+		dst = appendInt64(dst, entry.maxKey)
+		dst = appendUvarint(dst, uint64(entry.size))
+		dst = append(dst, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(dst[len(dst)-4:], entry.checksum)
+
+		dst = appendUvarint(dst, uint64(entry.series))
+		dst = appendUvarint(dst, uint64(len(entry.metrics)))
+		for _, metric := range entry.metrics {
+			dst = appendString(dst, metric)
+		}
+
+		return dst, nil
+	})
+}
+
+func appendCatalogRemove(dst []byte, name string) ([]byte, error) {
+	return appendFramed(dst, func(dst []byte) ([]byte, error) {
+		dst = append(dst, catalogVersion, catalogRemoveFile)
+		return appendString(dst, name), nil
+	})
+}
+
+func appendCatalogBase(dst []byte, seq uint64) ([]byte, error) {
+	return appendFramed(dst, func(dst []byte) ([]byte, error) {
+		dst = append(dst, catalogVersion, catalogBase)
+		return appendUvarint(dst, seq), nil
+	})
+}
+
+// decodeCatalogRecord applies the record to entries, the sequence of a base
+// record is stored in seq.
+func decodeCatalogRecord(payload []byte, entries map[string]*catalogEntry, seq *uint64) error {
+	if len(payload) < 2 || payload[0] != catalogVersion {
+		return errCatalogCorrupt
+	}
+	buf := payload[2:]
+
+	switch payload[1] {
+	case catalogAddFile:
+		entry, err := decodeCatalogEntry(buf)
+		if err != nil {
+			return err
+		}
+
+		entries[entry.name] = entry
+	case catalogRemoveFile:
+		name, rest, err := readString(buf)
+		if err != nil || len(rest) != 0 {
+			return errCatalogCorrupt
+		}
+
+		delete(entries, name)
+	case catalogBase:
+		s, n := binary.Uvarint(buf)
+		if n <= 0 || n != len(buf) {
+			return errCatalogCorrupt
+		}
+
+		*seq = s
+	default:
+		return errCatalogCorrupt
+	}
+
+	return nil
+}
+
+func decodeCatalogEntry(buf []byte) (*catalogEntry, error) {
+	entry := &catalogEntry{}
+	name, buf, err := readString(buf)
+	if err != nil {
+		return nil, errCatalogCorrupt
+	}
+	entry.name = name
+
+	var n int
+	if entry.id, n = binary.Uvarint(buf); n <= 0 {
+		return nil, errCatalogCorrupt
+	}
+	buf = buf[n:]
+
+	if len(buf) < 16 {
+		return nil, errCatalogCorrupt
+	}
+	entry.minKey = int64(binary.BigEndian.Uint64(buf))
+	entry.maxKey = int64(binary.BigEndian.Uint64(buf[8:]))
+	buf = buf[16:]
+
+	size, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errCatalogCorrupt
+	}
+	entry.size = int64(size)
+	buf = buf[n:]
+
+	if len(buf) < 4 {
+		return nil, errCatalogCorrupt
+	}
+	entry.checksum = binary.BigEndian.Uint32(buf)
+	buf = buf[4:]
+
+	series, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errCatalogCorrupt
+	}
+	entry.series = int(series)
+	buf = buf[n:]
+
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || count > uint64(len(buf)) {
+		return nil, errCatalogCorrupt
+	}
+	buf = buf[n:]
+
+	entry.metrics = make([]string, count)
+	for i := range entry.metrics {
+		if entry.metrics[i], buf, err = readString(buf); err != nil {
+			return nil, errCatalogCorrupt
+		}
+	}
+
+	if len(buf) != 0 {
+		return nil, errCatalogCorrupt
+	}
+
+	return entry, nil
+}
+
+// seriesMetric returns the metric of a series key, like db.ParseSeriesKey
+// without parsing the labels. Keys written before the labels were added have
+// no metric.
+func seriesMetric(key string) string {
+	open := strings.IndexByte(key, '{')
+	if open < 0 || !strings.HasSuffix(key, "}") {
+		return ""
+	}
+
+	return key[:open]
+}
@@ -0,0 +1,176 @@
+package lsmt
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestRemoteCatalog(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore()
+
+	c := newRemoteCatalog(store)
+	if err := c.load(ctx); err != nil {
+		t.Fatalf("expect an empty catalog without the object, got %v", err)
+	}
+
+	entries := []*catalogEntry{
+		{name: "0-10-1", id: 1, minKey: 0, maxKey: 10, size: 100, checksum: 1, series: 2, metrics: []string{"cpu", "mem"}},
+		{name: "-5-20-2", id: 2, minKey: -5, maxKey: 20, size: 200, checksum: 2, series: 1, metrics: []string{""}},
+		{name: "30-40-3", id: 3, minKey: 30, maxKey: 40, size: 300, checksum: 3, metrics: []string{}},
+	}
+	if err := c.add(ctx, entries...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.remove(ctx, "30-40-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newRemoteCatalog(store)
+	if err := loaded.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded.entries) != 2 {
+		t.Errorf("expect 2 entries, got %d", len(loaded.entries))
+	}
+
+	for _, entry := range entries[:2] {
+		if got, ok := loaded.get(entry.name); !ok || !reflect.DeepEqual(got, entry) {
+			t.Errorf("expect %+v, got %+v", entry, got)
+		}
+	}
+
+	// Every update is a delta until they are written to the base.
+	objects, err := store.List(ctx, catalogName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(objects) != 2 {
+		t.Errorf("expect 2 deltas, got %v", objects)
+	}
+
+	defer func(n int) { catalogMaxDeltas = n }(catalogMaxDeltas)
+	catalogMaxDeltas = 3
+
+	entry := &catalogEntry{name: "40-50-4", id: 4, minKey: 40, maxKey: 50, metrics: []string{"cpu"}}
+	if err := loaded.add(ctx, entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if objects, _ = store.List(ctx, catalogName); len(objects) != 1 || objects[0].Name != catalogName {
+		t.Errorf("expect only the base, got %v", objects)
+	}
+
+	if err := loaded.remove(ctx, entry.name); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := newRemoteCatalog(store)
+	if err := reloaded.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(reloaded.entries, loaded.entries) || reloaded.seq != loaded.seq {
+		t.Errorf("expect %v at %d, got %v at %d", loaded.entries, loaded.seq, reloaded.entries, reloaded.seq)
+	}
+
+	// A corrupt catalog is rebuilt from the listing of the store.
+	for _, entry := range entries[:2] {
+		if err := store.Put(ctx, entry.name, bytes.NewReader(nil), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data := []byte("corrupt")
+	if err := store.Put(ctx, catalogDeltaName(reloaded.seq), bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := newRemoteCatalog(store)
+	if err := listed.load(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := listed.names(); !reflect.DeepEqual(names, []string{"-5-20-2", "0-10-1"}) {
+		t.Errorf("expect the files of the store, got %v", names)
+	}
+
+	if entry, _ := listed.get("0-10-1"); !entry.listed || !entry.mayContain(nil) {
+		t.Errorf("expect a listed entry, got %+v", entry)
+	}
+
+	if err := listed.add(ctx, entries[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := newRemoteCatalog(store).load(ctx); err != nil {
+		t.Errorf("expect the catalog to be replaced, got %v", err)
+	}
+}
+
+func TestRemoteCatalogPruning(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	store := NewMemoryStore()
+	rt := NewRemoteTable(store, testOption.WorkDir)
+	dt.remote = newBlockCache(store, 0)
+	dt.catalog = rt.catalog
+
+	for i, metric := range []string{"cpu", "mem"} {
+		mt := NewMemtable()
+		mt.insert(&db.Entry{KV: db.KV{Key: int64(i), Value: int64(i)}, Type: db.IntType, Metric: metric})
+		dt.flush(mt)
+	}
+
+	// The files are missing from the catalog until they are uploaded.
+	if pending := dt.pendingUploads(); len(pending) != 2 {
+		t.Fatalf("expect 2 pending uploads, got %v", pending)
+	}
+
+	q := newUploadQueue(rt, dt, &Option{})
+	for _, p := range dt.pendingUploads() {
+		q.push(p)
+		q.upload(context.Background(), q.next())
+	}
+
+	if pending := dt.pendingUploads(); len(pending) != 0 {
+		t.Fatalf("expect no pending uploads, got %v", pending)
+	}
+
+	entry, ok := rt.catalog.get("1-1-2")
+	if !ok || entry.series != 1 || !reflect.DeepEqual(entry.metrics, []string{"mem"}) {
+		t.Fatalf("expect the mem series in the catalog, got %+v", entry)
+	}
+
+	for _, file := range dt.files {
+		if err := file.Clean(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the remote file holding the metric is read.
+	sources := dt.newSeriesSources(context.Background(), 0, 10, nil, []string{db.SeriesKey("mem", nil)})
+	for _, source := range sources {
+		source.Close()
+	}
+
+	if len(sources) != 1 || sources[0].(*fileSource).file.path != path.Join(testOption.WorkDir, "1-1-2") {
+		t.Errorf("expect only the mem file to be read, got %d sources", len(sources))
+	}
+}
@@ -0,0 +1,137 @@
+package lsmt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	db "github.com/dovics/pangolin"
+	"github.com/dovics/pangolin/compress"
+)
+
+// codecEncoder encodes the values of the custom types with their registered
+// codecs. The first value written is the names of the codecs of the block
+// separated by '\x00', every value then follows as the index of its codec in
+// the names, a uvarint, and the marshaled value.
+type codecEncoder struct {
+	names  []string
+	ids    map[*db.Codec]uint64
+	values [][]byte
+	bytes  *compress.BytesEncoder
+}
+
+func newCodecEncoder(size int) *codecEncoder {
+	return &codecEncoder{ids: map[*db.Codec]uint64{}, bytes: compress.NewBytesEncoder(size)}
+}
+
+func (e *codecEncoder) Write(value interface{}) error {
+	c, ok := db.CodecOf(value)
+	if !ok {
+		return fmt.Errorf("no codec registered for %T", value)
+	}
+
+	id, ok := e.ids[c]
+	if !ok {
+		id = uint64(len(e.names))
+		e.ids[c] = id
+		e.names = append(e.names, c.Name)
+	}
+
+	data, err := c.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal with codec %s: %w", c.Name, err)
+	}
+
+	buffer := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(data))
+	buffer = append(buffer[:binary.PutUvarint(buffer, id)], data...)
+	e.values = append(e.values, buffer)
+	return nil
+}
+
+func (e *codecEncoder) Bytes() ([]byte, error) {
+	e.bytes.Reset()
+	if err := e.bytes.Write([]byte(strings.Join(e.names, "\x00"))); err != nil {
+		return nil, err
+	}
+
+	for _, v := range e.values {
+		if err := e.bytes.Write(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.bytes.Bytes()
+}
+
+func (e *codecEncoder) Flush() {}
+
+func (e *codecEncoder) Reset() {
+	e.names, e.values = nil, nil
+	e.ids = map[*db.Codec]uint64{}
+	e.bytes.Reset()
+}
+
+// codecDecoder decodes the values written by a codecEncoder, their codecs
+// must be registered.
+type codecDecoder struct {
+	codecs []*db.Codec
+	bytes  compress.BytesDecoder
+	value  interface{}
+	err    error
+}
+
+func (d *codecDecoder) SetBytes(b []byte) error {
+	d.codecs, d.value, d.err = nil, nil, nil
+	if err := d.bytes.SetBytes(b); err != nil {
+		return err
+	}
+
+	if !d.bytes.Next() {
+		return d.bytes.Error()
+	}
+
+	for _, name := range strings.Split(string(d.bytes.Read().([]byte)), "\x00") {
+		c, ok := db.LookupCodec(name)
+		if !ok {
+			return fmt.Errorf("codec %s is not registered", name)
+		}
+
+		d.codecs = append(d.codecs, c)
+	}
+
+	return nil
+}
+
+func (d *codecDecoder) Next() bool {
+	if d.err != nil || !d.bytes.Next() {
+		return false
+	}
+
+	data := d.bytes.Read().([]byte)
+	id, n := binary.Uvarint(data)
+	if n <= 0 || id >= uint64(len(d.codecs)) {
+		d.err = errors.New("invalid codec of a custom value")
+		return false
+	}
+
+	c := d.codecs[id]
+	if d.value, d.err = c.Unmarshal(data[n:]); d.err != nil {
+		d.err = fmt.Errorf("failed to unmarshal with codec %s: %w", c.Name, d.err)
+		return false
+	}
+
+	return true
+}
+
+func (d *codecDecoder) Read() interface{} {
+	return d.value
+}
+
+func (d *codecDecoder) Error() error {
+	if d.err != nil {
+		return d.err
+	}
+
+	return d.bytes.Error()
+}
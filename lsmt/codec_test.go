@@ -0,0 +1,73 @@
+package lsmt
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+	"github.com/dovics/pangolin/utils/rbtree"
+)
+
+type location struct {
+	Lat, Lng float64
+}
+
+type reading struct {
+	Sensor string
+	Value  int
+}
+
+func init() {
+	db.RegisterCodec(location{}, db.JSONCodec[location]("lsmt-location"))
+	db.RegisterCodec(&reading{}, db.JSONCodec[*reading]("lsmt-reading"))
+}
+
+func TestCodecBlock(t *testing.T) {
+	b := &block{data: rbtree.New(), valueType: db.CustomType}
+	for i := int64(0); i < 10; i++ {
+		if i%3 == 0 {
+			b.set(i, &reading{Sensor: "a", Value: int(i)})
+			continue
+		}
+
+		b.set(i, location{Lat: float64(i), Lng: -float64(i)})
+	}
+
+	buffer := new(bytes.Buffer)
+	if _, err := b.writeBlock(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := readBlock(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result.getRange(0, 10), b.getRange(0, 10)) {
+		t.Errorf("expect %v, got %v", b.getRange(0, 10), result.getRange(0, 10))
+	}
+
+	unregistered := &block{data: rbtree.New(), valueType: db.CustomType}
+	unregistered.set(0, struct{}{})
+	if _, err := unregistered.writeBlock(new(bytes.Buffer)); err == nil {
+		t.Error("expect an error for a value without codec")
+	}
+}
+
+func TestCodecWAL(t *testing.T) {
+	e := &db.Entry{KV: db.KV{Key: 1, Value: location{Lat: 1.5, Lng: 2}}, Type: db.CustomType, Metric: "position"}
+	record, err := appendRecord(nil, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, _, err := decodeRecord(record[walRecordHeaderSize:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result.KV, e.KV) || result.Type != e.Type {
+		t.Errorf("expect %v, got %v", e.KV, result.KV)
+	}
+}
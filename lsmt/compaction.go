@@ -0,0 +1,552 @@
+package lsmt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/dovics/pangolin/utils/rbtree"
+)
+
+// tmpFileSuffix marks the files a compaction is still writing, they are
+// removed when the disktable is opened.
+const tmpFileSuffix = ".tmp"
+
+var (
+	defaultCompactionMinFiles int   = 4
+	defaultCompactionFileSize int64 = 16 * 1024 * 1024
+)
+
+// pickCompaction returns the newest files of the table as long as they are
+// smaller than fileSize, if there are at least minFiles of them. Only the
+// newest files are picked so the outputs can take new sequences without
+// becoming newer than a file they don't include, the returned sequence is the
+// one of the points and the one before it the one of the tombstones. A flush
+// which named its file but hasn't added it yet holds a lower sequence than the
+// output would take, so nothing is picked until it is done. The files are referenced until the
+// compaction closes their sources. The tombstones can be dropped when every
+// file the table ever held is compacted.
+func (d *disktable) pickCompaction(minFiles int, fileSize int64) ([]*diskFile, uint64, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if minFiles < 2 {
+		minFiles = 2
+	}
+
+	if len(d.flushing) > 0 {
+		return nil, 0, false
+	}
+
+	files := append([]*diskFile(nil), d.files...)
+	sortNewest(files)
+
+	inputs := []*diskFile{}
+	for _, file := range files {
+		if file.remote {
+			break
+		}
+
+		info, err := os.Stat(file.path)
+		if err != nil || info.Size() >= fileSize {
+			break
+		}
+
+		inputs = append(inputs, file)
+	}
+
+	if len(inputs) < minFiles {
+		return nil, 0, false
+	}
+
+	for _, file := range inputs {
+		file.refs++
+	}
+
+	d.seq += 2
+	return inputs, d.seq, len(inputs) == len(d.files)
+}
+
+// compact merges the small files picked by pickCompaction into files
+// partitioned by option.CompactionWindow and swaps them in. The points hidden
+// by a tombstone are dropped. It returns the replaced files and the outputs.
+func (d *disktable) compact(ctx context.Context, option *Option) ([]*diskFile, []string, error) {
+	minFiles, fileSize := option.CompactionMinFiles, option.CompactionFileSize
+	if minFiles == 0 {
+		minFiles = defaultCompactionMinFiles
+	}
+
+	if fileSize == 0 {
+		fileSize = defaultCompactionFileSize
+	}
+
+	inputs, seq, dropTombstones := d.pickCompaction(minFiles, fileSize)
+	if len(inputs) == 0 {
+		return nil, nil, nil
+	}
+
+	c := &compaction{
+		workDir: d.workDir,
+		seq:     seq,
+		window:  option.CompactionWindow,
+		limiter: newRateLimiter(option.CompactionRateLimit),
+		outputs: map[int64]*compactionOutput{},
+	}
+
+	sources := make([]source, len(inputs))
+	for i, file := range inputs {
+		sources[i] = newFileSource(ctx, file, math.MinInt64, math.MaxInt64, nil)
+	}
+
+	it := newIterator(ctx, sources)
+	err := c.merge(ctx, it)
+
+	tombstones := []*tombstone{}
+	for _, cur := range it.cursors {
+		tombstones = append(tombstones, cur.tombstones...)
+	}
+
+	if closeErr := it.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	if !dropTombstones && err == nil {
+		err = c.writeTombstones(ctx, tombstones)
+	}
+
+	var outputs []string
+	if err == nil {
+		outputs, err = c.finish()
+	}
+
+	if err != nil {
+		c.abort()
+		return nil, nil, fmt.Errorf("failed to compact: %w", err)
+	}
+
+	if err := d.replace(inputs, outputs); err != nil {
+		for _, p := range outputs {
+			os.Remove(p)
+		}
+
+		return nil, nil, fmt.Errorf("failed to replace compacted files: %w", err)
+	}
+
+	return inputs, outputs, nil
+}
+
+// upgrade rewrites the files older than version 3 in the latest version,
+// their index entries truncate the timestamps to 32 bits and pickCompaction
+// may never pick them. A file keeps its name and sequence, so it keeps its
+// place among the other files, and a remote file is uploaded again. It is
+// called at open, before the table is read. A file which can't be rewritten
+// stays readable and is tried again on the next open.
+func (d *disktable) upgrade(ctx context.Context) {
+	d.mutex.Lock()
+	files := append([]*diskFile(nil), d.files...)
+	d.mutex.Unlock()
+
+	for _, file := range files {
+		if err := d.upgradeFile(ctx, file); err != nil {
+			log.Printf("upgrade file %s error: %v\n", file.path, err)
+		}
+	}
+}
+
+func (d *disktable) upgradeFile(ctx context.Context, file *diskFile) error {
+	f, err := file.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	version, err := readTableVersion(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil || version >= tableVersion3 {
+		return err
+	}
+
+	tmp := file.path + tmpFileSuffix
+	if err := d.rewriteFile(ctx, file, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to rewrite: %w", err)
+	}
+
+	if err := d.swapFile(file, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace: %w", err)
+	}
+
+	return nil
+}
+
+// rewriteFile writes the points and the tombstones of the file in the latest
+// version to p. The tombstones stay in the file of the points, they only hide
+// the points of the older files.
+func (d *disktable) rewriteFile(ctx context.Context, file *diskFile, p string) error {
+	c := &compaction{
+		workDir: d.workDir,
+		seq:     file.seq,
+		limiter: newRateLimiter(0),
+		outputs: map[int64]*compactionOutput{},
+	}
+
+	it := newIterator(ctx, []source{file.newSource(ctx, math.MinInt64, math.MaxInt64, nil)})
+	err := c.merge(ctx, it)
+
+	tombstones := []*tombstone{}
+	for _, cur := range it.cursors {
+		tombstones = append(tombstones, cur.tombstones...)
+	}
+
+	if closeErr := it.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	// A file without points nor tombstones is still rewritten.
+	var o *compactionOutput
+	if err == nil {
+		o, err = c.output(ctx, 0)
+	}
+
+	if err == nil {
+		err = o.writeTombstones(tombstones)
+	}
+
+	if err == nil {
+		err = o.tw.finish()
+	}
+
+	if err == nil {
+		err = o.file.Sync()
+	}
+
+	if err == nil {
+		err = o.file.Close()
+		o.file = nil
+	}
+
+	if err == nil {
+		err = os.Rename(o.path, p)
+	}
+
+	if err != nil {
+		c.abort()
+	}
+
+	return err
+}
+
+type compactionOutput struct {
+	window int64
+	seq    uint64
+	path   string
+	file   *os.File
+	tw     *tableWriter
+
+	minKey int64
+	maxKey int64
+}
+
+// writeTombstones writes the tombstones and extends the key range of the
+// output to the points they delete.
+func (o *compactionOutput) writeTombstones(tombstones []*tombstone) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	for _, t := range tombstones {
+		if t.end > t.start {
+			o.extend(t.start, t.end-1)
+		}
+	}
+
+	return o.tw.writeTombstones(tombstones)
+}
+
+func (o *compactionOutput) extend(start, end int64) {
+	if start < o.minKey {
+		o.minKey = start
+	}
+
+	if end > o.maxKey {
+		o.maxKey = end
+	}
+}
+
+// compaction writes an output per window with the sequence seq. The
+// tombstones are written to an output of their own with the sequence before,
+// see writeTombstones.
+type compaction struct {
+	workDir string
+	seq     uint64
+	window  int64
+	limiter *rateLimiter
+
+	outputs    map[int64]*compactionOutput
+	tombstones *compactionOutput
+}
+
+func (c *compaction) windowOf(key int64) int64 {
+	if c.window <= 0 {
+		return 0
+	}
+
+	w := key / c.window
+	if key < 0 && key%c.window != 0 {
+		w--
+	}
+
+	return w
+}
+
+func (c *compaction) output(ctx context.Context, window int64) (*compactionOutput, error) {
+	if o, ok := c.outputs[window]; ok {
+		return o, nil
+	}
+
+	o, err := c.newOutput(ctx, c.seq, fmt.Sprintf("%d-%d%s", c.seq, window, tmpFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	o.window = window
+	c.outputs[window] = o
+	return o, nil
+}
+
+func (c *compaction) newOutput(ctx context.Context, seq uint64, name string) (*compactionOutput, error) {
+	p := path.Join(c.workDir, name)
+	file, err := os.Create(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compactionOutput{
+		seq:    seq,
+		path:   p,
+		file:   file,
+		tw:     newTableWriter(&limitedWriter{ctx: ctx, w: file, l: c.limiter}),
+		minKey: math.MaxInt64,
+		maxKey: math.MinInt64,
+	}, nil
+}
+
+// merge writes a block for every series and window. The iterator returns the
+// points of a series in timestamp order, so a block is complete once the
+// series or the window changes.
+func (c *compaction) merge(ctx context.Context, it *iterator) error {
+	var (
+		b      *block
+		index  string
+		window int64
+	)
+
+	flush := func() error {
+		if b == nil {
+			return nil
+		}
+
+		o, err := c.output(ctx, window)
+		if err != nil {
+			return err
+		}
+
+		o.extend(b.data.Min().(rbtree.TimestampItem).Time, b.data.Max().(rbtree.TimestampItem).Time)
+		return o.tw.writeBlock(index, b)
+	}
+
+	for it.Next() {
+		kv := it.At()
+		w := c.windowOf(kv.Key)
+		if b == nil || it.index != index || it.t != b.valueType || w != window {
+			if err := flush(); err != nil {
+				return err
+			}
+
+			b = &block{data: rbtree.New(), valueType: it.t}
+			index, window = it.index, w
+		}
+
+		b.set(kv.Key, kv.Value)
+	}
+
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// writeTombstones keeps the tombstones of the inputs, they still hide the
+// points of the older files. They are written to an output which is older than
+// the outputs of the points, the points kept by the merge are newer than the
+// tombstones and a tombstone would hide them in any newer file.
+func (c *compaction) writeTombstones(ctx context.Context, tombstones []*tombstone) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	seq := c.seq - 1
+	o, err := c.newOutput(ctx, seq, fmt.Sprintf("%d-tombstones%s", seq, tmpFileSuffix))
+	if err != nil {
+		return err
+	}
+
+	c.tombstones = o
+	return o.writeTombstones(tombstones)
+}
+
+// finish completes the outputs and renames them to their final names.
+func (c *compaction) finish() ([]string, error) {
+	outputs := make([]*compactionOutput, 0, len(c.outputs))
+	for _, o := range c.outputs {
+		outputs = append(outputs, o)
+	}
+
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].window < outputs[j].window })
+	if c.tombstones != nil {
+		outputs = append(outputs, c.tombstones)
+	}
+
+	for _, o := range outputs {
+		if err := o.tw.finish(); err != nil {
+			return nil, err
+		}
+
+		if err := o.file.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	paths := make([]string, 0, len(outputs))
+	for _, o := range outputs {
+		if err := o.file.Close(); err != nil {
+			return paths, err
+		}
+		o.file = nil
+
+		p := path.Join(c.workDir, fmt.Sprintf("%d-%d-%d", o.minKey, o.maxKey, o.seq))
+		if err := os.Rename(o.path, p); err != nil {
+			return paths, err
+		}
+
+		o.path = p
+		paths = append(paths, p)
+	}
+
+	return paths, nil
+}
+
+func (c *compaction) abort() {
+	outputs := make([]*compactionOutput, 0, len(c.outputs)+1)
+	for _, o := range c.outputs {
+		outputs = append(outputs, o)
+	}
+
+	if c.tombstones != nil {
+		outputs = append(outputs, c.tombstones)
+	}
+
+	for _, o := range outputs {
+		if o.file != nil {
+			o.file.Close()
+		}
+
+		os.Remove(o.path)
+	}
+}
+
+// rateLimiter spreads the writes so they don't exceed bytesPerSecond, zero
+// means unlimited.
+type rateLimiter struct {
+	bytesPerSecond int64
+	start          time.Time
+	written        int64
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, start: time.Now()}
+}
+
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if l.bytesPerSecond <= 0 {
+		return nil
+	}
+
+	l.written += int64(n)
+	expect := time.Duration(float64(l.written) / float64(l.bytesPerSecond) * float64(time.Second))
+	delay := expect - time.Since(l.start)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type limitedWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *rateLimiter
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.l.wait(w.ctx, n)
+}
+
+func (s *Storage) compactLoop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.option.CompactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.compact()
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Storage) compact() {
+	inputs, outputs, err := s.disk.compact(s.ctx, s.option)
+	if err != nil {
+		log.Println("compaction error: ", err)
+		return
+	}
+
+	// Without a remote tier the files are only kept on the local disk.
+	if s.remote == nil {
+		return
+	}
+
+	for _, p := range outputs {
+		s.uploads.push(p)
+	}
+
+	for _, file := range inputs {
+		s.uploads.pushRemove(file.path)
+	}
+}
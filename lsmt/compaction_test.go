@@ -0,0 +1,425 @@
+package lsmt
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func (dt *disktable) flush(mt *memtable) {
+	filePath := path.Join(dt.workDir, dt.nextFileName(mt.minKey, mt.maxKey))
+	file, err := os.Create(filePath)
+	if err != nil {
+		panic(err)
+	}
+
+	defer file.Close()
+	if err := mt.write(file); err != nil {
+		panic(err)
+	}
+
+	if err := dt.AddFile(filePath); err != nil {
+		panic(err)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	for i := int64(0); i < 4; i++ {
+		mt := NewMemtable()
+		for j := i * 50; j < i*50+100; j++ {
+			mt.insert(&db.Entry{KV: db.KV{Key: j, Value: j * i}, Type: db.IntType, Tags: []string{"test"}})
+		}
+
+		if i == 3 {
+			mt.deleteRange(newTombstone(0, 20, nil))
+		}
+
+		dt.flush(mt)
+	}
+
+	expectResult, err := dt.getRange(0, 300, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader holding an input keeps it on the disk until it is closed.
+	held := dt.newSources(0, 300, nil)
+	heldPath := held[0].(*fileSource).file.path
+
+	option := &Option{CompactionMinFiles: 2, CompactionFileSize: 1 << 20, CompactionWindow: 100}
+	inputs, outputs, err := dt.compact(context.Background(), option)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inputs) != 4 || len(outputs) != 3 {
+		t.Fatalf("expect 4 inputs and 3 outputs, got %d and %d", len(inputs), len(outputs))
+	}
+
+	if dt.Len() != 3 {
+		t.Errorf("expect 3 files, got %d", dt.Len())
+	}
+
+	result, err := dt.getRange(0, 300, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expectResult, result) {
+		t.Errorf("expect %v, got %v\n", expectResult, result)
+	}
+
+	if _, err := os.Stat(heldPath); err != nil {
+		t.Errorf("expect %s to be kept while read, got %v", heldPath, err)
+	}
+
+	for _, s := range held {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, file := range inputs {
+		if _, err := os.Stat(file.path); !os.IsNotExist(err) {
+			t.Errorf("expect %s to be removed, got %v", file.path, err)
+		}
+	}
+
+	for _, file := range dt.files {
+		indexes, tombstones, err := file.loadIndexes(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(tombstones) != 0 {
+			t.Errorf("expect the tombstones to be dropped, got %v", tombstones)
+		}
+
+		for _, i := range indexes[db.IntType] {
+			if i.max-i.min >= 100 {
+				t.Errorf("expect blocks within a window, got [%d, %d]", i.min, i.max)
+			}
+		}
+	}
+}
+
+func TestCompactionKeepTombstones(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	// The large file is older than the small ones and isn't compacted, the
+	// tombstone must keep hiding its points.
+	mt := NewMemtable()
+	for i := int64(0); i < 1000; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i * i % 7919}, Type: db.IntType, Tags: []string{"test"}})
+	}
+	dt.flush(mt)
+
+	for i := int64(0); i < 2; i++ {
+		mt := NewMemtable()
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"test"}})
+		if i == 1 {
+			mt.deleteRange(newTombstone(100, 200, nil))
+		}
+
+		dt.flush(mt)
+	}
+
+	expectResult, err := dt.getRange(0, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	option := &Option{CompactionMinFiles: 2, CompactionFileSize: 1024}
+	inputs, _, err := dt.compact(context.Background(), option)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inputs) != 2 {
+		t.Fatalf("expect 2 inputs, got %d", len(inputs))
+	}
+
+	result, err := dt.getRange(0, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expectResult, result) {
+		t.Errorf("expect %d points, got %d", len(expectResult), len(result))
+	}
+}
+
+func TestCompactionWindowTombstones(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func(mt *memtable, metric string, key, value int64) {
+		mt.insert(&db.Entry{KV: db.KV{Key: key, Value: value}, Type: db.IntType, Metric: metric})
+	}
+
+	// The large file isn't compacted, so the tombstone is kept.
+	mt := NewMemtable()
+	for i := int64(0); i < 1000; i++ {
+		insert(mt, "y", i, i*i%7919)
+	}
+	dt.flush(mt)
+
+	mt = NewMemtable()
+	for i := int64(0); i < 200; i++ {
+		insert(mt, "x", i, i)
+	}
+	dt.flush(mt)
+
+	// x is deleted, then written again in the second window.
+	mt = NewMemtable()
+	insert(mt, "z", 0, 0)
+	mt.deleteRange(newTombstone(0, 200, &db.QueryFilter{Metric: "x"}))
+	dt.flush(mt)
+
+	mt = NewMemtable()
+	insert(mt, "x", 150, 1500)
+	dt.flush(mt)
+
+	filter := &db.QueryFilter{Metric: "x"}
+	expect := []db.KV{{Key: 150, Value: int64(1500)}}
+	if result, err := dt.getRange(0, 1000, filter); err != nil || !reflect.DeepEqual(expect, result) {
+		t.Fatalf("expect %v, got %v, %v", expect, result, err)
+	}
+
+	option := &Option{CompactionMinFiles: 2, CompactionFileSize: 1024, CompactionWindow: 100}
+	inputs, outputs, err := dt.compact(context.Background(), option)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inputs) != 3 || len(outputs) != 3 {
+		t.Fatalf("expect 3 inputs and 3 outputs, got %d and %d", len(inputs), len(outputs))
+	}
+
+	// The points kept by the merge are newer than the tombstones, also once
+	// the files are reopened.
+	for i := 0; i < 2; i++ {
+		result, err := dt.getRange(0, 1000, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(expect, result) {
+			t.Errorf("expect %v, got %v", expect, result)
+		}
+
+		if result, err := dt.getRange(0, 1000, &db.QueryFilter{Metric: "y"}); err != nil || len(result) != 1000 {
+			t.Errorf("expect the points of y, got %d, %v", len(result), err)
+		}
+
+		dt.Close()
+		if dt, err = NewDiskTable(testOption.WorkDir, testOption.DiskfileCount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dt.Close()
+}
+
+func TestCompactionConcurrentFlush(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	generation := func(gen int64) *memtable {
+		mt := NewMemtable()
+		for i := int64(0); i < 10; i++ {
+			mt.insert(&db.Entry{KV: db.KV{Key: i, Value: gen}, Type: db.IntType, Tags: []string{"test"}})
+		}
+		return mt
+	}
+
+	for gen := int64(0); gen < 4; gen++ {
+		dt.flush(generation(gen))
+	}
+
+	// A flush which named its file holds a lower sequence than the output of
+	// a compaction, which waits for it.
+	mt := generation(4)
+	filePath := path.Join(dt.workDir, dt.nextFileName(mt.minKey, mt.maxKey))
+
+	option := &Option{CompactionMinFiles: 2, CompactionFileSize: 1 << 20}
+	if inputs, _, err := dt.compact(context.Background(), option); err != nil || len(inputs) != 0 {
+		t.Fatalf("expect no compaction during a flush, got %d inputs, %v", len(inputs), err)
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mt.write(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if err := dt.AddFile(filePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// The flushes and the compactions race, the newest generation must win.
+	const last = 40
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for gen := int64(5); gen <= last; gen++ {
+			dt.flush(generation(gen))
+		}
+	}()
+
+	compacted := 0
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		inputs, _, err := dt.compact(context.Background(), option)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compacted += len(inputs)
+	}
+
+	if compacted == 0 {
+		t.Error("expect the files to be compacted")
+	}
+
+	result, err := dt.getRange(0, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 10 {
+		t.Fatalf("expect 10 points, got %d", len(result))
+	}
+
+	for _, kv := range result {
+		if kv.Value != int64(last) {
+			t.Errorf("expect the value of the newest flush at %d, got %v", kv.Key, kv.Value)
+		}
+	}
+}
+
+func TestUpgradeLegacyTable(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	mt := NewMemtable()
+	for i := int64(0); i < 100; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"test"}})
+	}
+	expect, err := mt.getRange(0, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A version 1 file ends with the 32-bit header offset.
+	v1 := new(bytes.Buffer)
+	b := mt.blocks[db.IntType][`{test=""}`]
+	length, err := b.writeBlock(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &index{index: "test", t: db.IntType, count: uint32(b.count), max: 99, length: uint32(length)}
+	if err := writeHeader(v1, []*index{i}, tableVersion1); err != nil {
+		t.Fatal(err)
+	}
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, uint32(length))
+	v1.Write(trailer)
+
+	p := path.Join(testOption.WorkDir, "0-99-1")
+	if err := os.WriteFile(p, v1.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.upgrade(context.Background())
+
+	check := func(dt *disktable) {
+		file, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+
+		if version, err := readTableVersion(file); err != nil || version != tableVersion {
+			t.Errorf("expect version %d, got %d, %v", tableVersion, version, err)
+		}
+
+		result, err := dt.getRange(0, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(result, expect) {
+			t.Errorf("expect %v, got %v", expect, result)
+		}
+	}
+
+	check(dt)
+	if len(dt.files) != 1 || dt.files[0].seq != 1 {
+		t.Fatalf("expect the file to keep its sequence, got %d files", len(dt.files))
+	}
+	dt.Close()
+
+	// A rewrite logged in the manifest but not renamed is completed on open.
+	upgraded, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p+tmpFileSuffix, upgraded, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(p, v1.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dt, err = NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	check(dt)
+}
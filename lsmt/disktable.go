@@ -1,10 +1,17 @@
 package lsmt
 
 import (
+	"bytes"
 	"container/heap"
+	"context"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
 	"path"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,6 +22,10 @@ import (
 
 var defaultFileCount int = 10
 
+// orphanDir is the directory of the work dir holding the SSTables the
+// manifest doesn't know about or which are truncated.
+const orphanDir = "orphaned"
+
 func (s *Storage) ReadDiskTableMeta() {
 	path.Join(s.option.WorkDir)
 }
@@ -23,13 +34,35 @@ type disktable struct {
 	mutex   sync.Mutex
 	size    int
 	workDir string
+	seq     uint64
+
+	// remote reads the files evicted from the local disk, it is nil without a
+	// remote tier.
+	remote *blockCache
+	// catalog describes the files on the remote tier, the evicted files which
+	// hold none of the queried metrics are skipped without reading them.
+	catalog *remoteCatalog
 
 	filesIndexMap map[string]int
 	files         []*diskFile
 
-	cache lru.Cache
+	// flushing holds the sequences returned by nextFileName whose file isn't
+	// added yet, no compaction starts while a flush holds a lower sequence.
+	flushing map[uint64]bool
+
+	// rebuilt is set when the manifest was missing at open, the files only
+	// on the remote tier are then unknown to the table.
+	rebuilt bool
+
+	cache    lru.Cache
+	manifest *manifest
 }
 
+// NewDiskTable loads the SSTables recorded in the manifest of workDir. The
+// files the manifest doesn't know about are usually left over by an
+// interrupted flush or compaction, they are moved to the orphanDir of workDir
+// rather than removed in case they hold data. Other files are ignored.
+// Without a manifest, the table is rebuilt from the file names in workDir.
 func NewDiskTable(workDir string, fileCount int) (*disktable, error) {
 	if fileCount == 0 {
 		fileCount = defaultFileCount
@@ -40,11 +73,19 @@ func NewDiskTable(workDir string, fileCount int) (*disktable, error) {
 		return nil, err
 	}
 
+	m, ok, err := openManifest(workDir)
+	if err != nil {
+		return nil, err
+	}
+
 	dt := &disktable{
 		workDir:       workDir,
 		size:          fileCount,
 		cache:         lru.NewLRUCache(fileCount),
 		filesIndexMap: make(map[string]int, len(entrys)),
+		flushing:      map[uint64]bool{},
+		rebuilt:       !ok,
+		manifest:      m,
 	}
 
 	dt.files = make([]*diskFile, 0, len(entrys))
@@ -52,41 +93,146 @@ func NewDiskTable(workDir string, fileCount int) (*disktable, error) {
 
 	for _, entry := range entrys {
 		fileName := entry.Name()
-		minKey, maxKey, err := parseFileName(fileName)
-		if err != nil {
-			return nil, err
+		if fileName == manifestName || fileName == seriesIndexName || entry.IsDir() {
+			continue
+		}
+
+		p := path.Join(workDir, fileName)
+		if strings.HasSuffix(fileName, tmpFileSuffix) {
+			// A rewrite logged in the manifest before its output replaced the
+			// file is completed, the other temporary files are removed.
+			name := strings.TrimSuffix(fileName, tmpFileSuffix)
+			if meta, live := m.files[name]; ok && live {
+				size, checksum, err := fileChecksum(p)
+				if err != nil {
+					return nil, err
+				}
+
+				if size == meta.size && checksum == meta.checksum {
+					if err := os.Rename(p, path.Join(workDir, name)); err != nil {
+						return nil, err
+					}
+					continue
+				}
+			}
+
+			if err := os.Remove(p); err != nil {
+				return nil, err
+			}
+			continue
 		}
 
-		file := &diskFile{
-			t:      dt,
-			path:   path.Join(workDir, fileName),
-			minKey: minKey,
-			maxKey: maxKey,
+		if _, _, _, err := parseFileName(fileName); err != nil {
+			log.Printf("ignore file %s: %v\n", p, err)
+			continue
+		}
+
+		if !ok {
+			meta, err := newFileMeta(p, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			m.files[fileName] = meta
+			continue
+		}
+
+		if _, live := m.files[fileName]; !live {
+			dst, err := quarantine(workDir, fileName)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("move file %s unknown to the manifest to %s\n", p, dst)
+		}
+	}
+
+	metas := make([]*fileMeta, 0, len(m.files))
+	remote := map[string]bool{}
+	for name, meta := range m.files {
+		info, err := os.Stat(path.Join(workDir, name))
+		if os.IsNotExist(err) && meta.uploaded {
+			// The local copy was evicted, the file is read from the remote tier.
+			remote[name] = true
+		} else if os.IsNotExist(err) {
+			log.Printf("LOST DATA: file %s of the manifest is missing, its points [%d, %d] are dropped\n", name, meta.minKey, meta.maxKey)
+			delete(m.files, name)
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if info.Size() != meta.size {
+			dst, err := quarantine(workDir, name)
+			if err != nil {
+				return nil, err
+			}
+
+			log.Printf("LOST DATA: file %s of the manifest holds %d of its %d bytes, its points [%d, %d] are dropped and the file is moved to %s\n",
+				name, info.Size(), meta.size, meta.minKey, meta.maxKey, dst)
+			delete(m.files, name)
+			continue
 		}
 
-		heap.Push(dt, file)
+		metas = append(metas, meta)
+	}
 
-		if err := dt.cache.Put(file.path, file); err != nil {
+	// The newest files are loaded last, so they stay in the LRU cache.
+	sort.Slice(metas, func(i, j int) bool { return metas[i].id < metas[j].id })
+	for _, meta := range metas {
+		if err := dt.addFileLocked(path.Join(workDir, meta.name), meta); err != nil {
 			return nil, err
 		}
+
+		if remote[meta.name] {
+			dt.files[dt.filesIndexMap[path.Join(workDir, meta.name)]].remote = true
+		}
+	}
+
+	if err := m.rewrite(); err != nil {
+		return nil, err
 	}
 
 	return dt, nil
 }
 
+// quarantine moves the file name of workDir to its orphanDir and returns its
+// new path, a file of the same name already there is kept.
+func quarantine(workDir, name string) (string, error) {
+	dir := path.Join(workDir, orphanDir)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+
+	dst := path.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(dst); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		dst = path.Join(dir, fmt.Sprintf("%s.%d", name, i))
+	}
+
+	if err := os.Rename(path.Join(workDir, name), dst); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
+
 func (d *disktable) Close() error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
 	for _, file := range d.files {
 		if file.data != nil {
-			if err := file.Clean(); err != nil {
+			if err := file.data.Close(); err != nil {
 				return err
 			}
+			file.data = nil
 		}
 	}
 
-	return nil
+	return d.manifest.Close()
 }
 
 type diskFile struct {
@@ -94,9 +240,44 @@ type diskFile struct {
 	path   string
 	minKey int64
 	maxKey int64
+	seq    uint64
+	level  int
+	size   int64
+
+	// checksum of the whole file, verified when it is first opened.
+	checksum uint32
+	verified bool
+
+	// loading is held while the indexes are read, so a single caller reads
+	// them.
+	loading chan struct{}
+
+	// refs counts the sources reading the file. An obsolete file has been
+	// replaced by a compaction and is removed once the last source closes.
+	refs     int
+	obsolete bool
+
+	// uploaded is set once the file is on the remote tier, its local copy is
+	// then removed when it is evicted from the LRU cache and remote is set.
+	uploaded bool
+	remote   bool
+
+	version    uint32
+	data       tableFile
+	indexes    [db.TypeCount]map[string]*index
+	tombstones []*tombstone
+}
 
-	data    io.ReadSeekCloser
-	indexes [db.TypeCount]map[string]*index
+// sortNewest sorts the files from the newest, the outputs of a compaction
+// share their sequence and are sorted by their min key.
+func sortNewest(files []*diskFile) {
+	sort.SliceStable(files, func(i, j int) bool {
+		if files[i].seq != files[j].seq {
+			return files[i].seq > files[j].seq
+		}
+
+		return files[i].minKey < files[j].minKey
+	})
 }
 
 func (d *disktable) Len() int           { return len(d.files) }
@@ -120,20 +301,45 @@ func (d *disktable) Pop() interface{} {
 	return x
 }
 
+// AddFile records the flushed or downloaded file at p in the manifest and
+// loads it.
 func (d *disktable) AddFile(p string) error {
+	meta, err := newFileMeta(p, 0)
+	if err != nil {
+		return err
+	}
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	minKey, maxKey, err := parseFileName(path.Base(p))
-	if err != nil {
+	if _, ok := d.filesIndexMap[p]; ok {
+		return nil
+	}
+
+	if err := d.manifest.log(&versionEdit{added: []*fileMeta{meta}}); err != nil {
 		return err
 	}
 
+	delete(d.flushing, meta.id)
+	return d.addFileLocked(p, meta)
+}
+
+func (d *disktable) addFileLocked(p string, meta *fileMeta) error {
 	file := &diskFile{
-		t:      d,
-		path:   p,
-		minKey: minKey,
-		maxKey: maxKey,
+		t:        d,
+		loading:  make(chan struct{}, 1),
+		path:     p,
+		minKey:   meta.minKey,
+		maxKey:   meta.maxKey,
+		seq:      meta.id,
+		level:    meta.level,
+		size:     meta.size,
+		checksum: meta.checksum,
+		uploaded: meta.uploaded,
+	}
+
+	if meta.id > d.seq {
+		d.seq = meta.id
 	}
 
 	heap.Push(d, file)
@@ -144,125 +350,609 @@ func (d *disktable) AddFile(p string) error {
 	return nil
 }
 
-func (d *disktable) getRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+// nextFileName returns the name of a new file holding [minKey, maxKey]. The
+// sequence in the name orders the files from the oldest to the newest, it is
+// held until the file is added by AddFile or given up by abortFile.
+func (d *disktable) nextFileName(minKey, maxKey int64) string {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	result := []db.KV{}
+	d.seq++
+	d.flushing[d.seq] = true
+	return fmt.Sprintf("%d-%d-%d", minKey, maxKey, d.seq)
+}
 
+// abortFile gives up the sequence of a file named by nextFileName which won't
+// be added.
+func (d *disktable) abortFile(name string) {
+	_, _, seq, err := parseFileName(name)
+	if err != nil {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	delete(d.flushing, seq)
+}
+
+// newSources returns a source for every file which may hold points in
+// [startTime, endTime], ordered from the newest file to the oldest.
+func (d *disktable) newSources(startTime, endTime int64, filter *db.QueryFilter) []source {
+	return d.newSeriesSources(context.Background(), startTime, endTime, filter, nil)
+}
+
+// newSeriesSources is like newSources but the sources only read the given
+// series, every series is read if series is nil. The files evicted from the
+// local disk are downloaded under ctx.
+func (d *disktable) newSeriesSources(ctx context.Context, startTime, endTime int64, filter *db.QueryFilter, series []string) []source {
+	var metrics map[string]bool
+	if series != nil && d.catalog != nil {
+		metrics = map[string]bool{}
+		for _, key := range series {
+			metrics[seriesMetric(key)] = true
+		}
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	files := []*diskFile{}
 	for _, file := range d.files {
 		if file.minKey > endTime || file.maxKey < startTime {
 			continue
 		}
 
-		fileResult, err := file.getRange(startTime, endTime, filter)
-		if err != nil {
-			return nil, err
+		if file.remote && metrics != nil {
+			if entry, ok := d.catalog.get(path.Base(file.path)); ok && !entry.mayContain(metrics) {
+				continue
+			}
 		}
 
-		result = append(result, fileResult...)
+		files = append(files, file)
 	}
 
-	return result, nil
+	sortNewest(files)
+
+	sources := make([]source, len(files))
+	for i, file := range files {
+		file.refs++
+		source := newFileSource(ctx, file, startTime, endTime, filter)
+		source.series = series
+		sources[i] = source
+	}
+
+	return sources
 }
 
-func (d *diskFile) getRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
-	d.t.cache.Visit(d.path)
-	if d.data == nil {
-		file, err := os.Open(d.path)
-		if err != nil {
-			return nil, err
+func (d *disktable) getRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+	return d.getRangeContext(context.Background(), startTime, endTime, filter)
+}
+
+func (d *disktable) getRangeContext(ctx context.Context, startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+	return db.Collect(newIterator(ctx, d.newSeriesSources(ctx, startTime, endTime, filter, nil)))
+}
+
+// uploaded records in the manifest that the file at p is on the remote tier,
+// its local copy may then be removed. It returns false if the file has been
+// replaced by a compaction.
+func (d *disktable) uploaded(p string) (bool, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	i, ok := d.filesIndexMap[p]
+	if !ok {
+		return false, nil
+	}
+
+	if d.files[i].uploaded {
+		return true, nil
+	}
+
+	if err := d.manifest.log(&versionEdit{uploaded: []string{path.Base(p)}}); err != nil {
+		return true, err
+	}
+
+	d.files[i].uploaded = true
+	return true, nil
+}
+
+// contains reports whether the file at p is live.
+func (d *disktable) contains(p string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	_, ok := d.filesIndexMap[p]
+	return ok
+}
+
+// isUploaded reports whether the file at p is on the remote tier.
+func (d *disktable) isUploaded(p string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	i, ok := d.filesIndexMap[p]
+	return ok && d.files[i].uploaded
+}
+
+// pendingUploads returns the paths of the files not uploaded to the remote
+// tier or not fully described by its catalog, from the oldest.
+func (d *disktable) pendingUploads() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	files := []*diskFile{}
+	for _, file := range d.files {
+		if !file.uploaded {
+			files = append(files, file)
+			continue
 		}
 
-		d.data = file
-		if err := d.readIndex(); err != nil {
-			return nil, err
+		if d.catalog != nil {
+			if entry, ok := d.catalog.get(path.Base(file.path)); !ok || entry.listed {
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].seq < files[j].seq })
+
+	paths := make([]string, len(files))
+	for i, file := range files {
+		paths[i] = file.path
+	}
+
+	return paths
+}
+
+// obsoleteUploads returns the paths of the catalogued files which aren't live,
+// their objects are left by a removal interrupted by a restart. It returns
+// nothing if the table was rebuilt without its manifest, which doesn't know
+// the files only on the remote tier.
+func (d *disktable) obsoleteUploads() []string {
+	if d.catalog == nil || d.rebuilt {
+		return nil
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	paths := []string{}
+	for _, name := range d.catalog.names() {
+		p := path.Join(d.workDir, name)
+		if _, ok := d.filesIndexMap[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+
+	return paths
+}
+
+// catalogEntry describes the file at p for the catalog of the remote tier, its
+// indexes are read under ctx. It returns nil if the file has been replaced by
+// a compaction.
+func (d *disktable) catalogEntry(ctx context.Context, p string) (*catalogEntry, error) {
+	d.mutex.Lock()
+	i, ok := d.filesIndexMap[p]
+	if !ok {
+		d.mutex.Unlock()
+		return nil, nil
+	}
+	file := d.files[i]
+	file.refs++
+	d.mutex.Unlock()
+
+	indexes, _, err := file.loadIndexes(ctx)
+	if releaseErr := file.release(); err == nil {
+		err = releaseErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &catalogEntry{
+		name:     path.Base(p),
+		id:       file.seq,
+		minKey:   file.minKey,
+		maxKey:   file.maxKey,
+		size:     file.size,
+		checksum: file.checksum,
+	}
+
+	series, metrics := map[string]bool{}, map[string]bool{}
+	for _, indexMap := range indexes {
+		for key := range indexMap {
+			series[key] = true
+			metrics[seriesMetric(key)] = true
 		}
 	}
 
-	check := func(i *index) ([]db.KV, error) {
-		if filter != nil && !db.ContainTags(i.index, filter.Tags) {
-			return nil, nil
+	entry.series = len(series)
+	for metric := range metrics {
+		entry.metrics = append(entry.metrics, metric)
+	}
+	sort.Strings(entry.metrics)
+
+	return entry, nil
+}
+
+// replace swaps the inputs of a compaction for its outputs at once, so a
+// query sees either all the inputs or all the outputs. The inputs are removed
+// from the disk once no source reads them anymore.
+func (d *disktable) replace(inputs []*diskFile, outputs []string) error {
+	edit := &versionEdit{}
+	for _, p := range outputs {
+		meta, err := newFileMeta(p, 1)
+		if err != nil {
+			return err
 		}
 
-		if i.max < uint32(startTime) || i.min > uint32(endTime) {
-			return nil, nil
+		edit.added = append(edit.added, meta)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, file := range inputs {
+		i, ok := d.filesIndexMap[file.path]
+		if !ok || d.files[i] != file {
+			return fmt.Errorf("file %s is not loaded", file.path)
 		}
+	}
 
-		if _, err := d.data.Seek(int64(i.offset), io.SeekStart); err != nil {
-			return nil, err
+	for _, file := range inputs {
+		edit.removed = append(edit.removed, path.Base(file.path))
+	}
+
+	if err := d.manifest.log(edit); err != nil {
+		return err
+	}
+
+	for _, file := range inputs {
+		heap.Remove(d, d.filesIndexMap[file.path])
+		d.cache.Remove(file.path)
+
+		file.obsolete = true
+		if err := file.removeIfUnused(); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range outputs {
+		if err := d.addFileLocked(p, edit.added[i]); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+// swapFile replaces the file with its rewrite at tmp, which keeps its name
+// and sequence. The rewrite is logged in the manifest before it is renamed
+// over the file, NewDiskTable completes it if the rename is interrupted. The
+// file must not be read meanwhile.
+func (d *disktable) swapFile(file *diskFile, tmp string) error {
+	size, checksum, err := fileChecksum(tmp)
+	if err != nil {
+		return err
+	}
+
+	name := path.Base(file.path)
+	meta := &fileMeta{
+		name:     name,
+		id:       file.seq,
+		level:    file.level,
+		minKey:   file.minKey,
+		maxKey:   file.maxKey,
+		size:     size,
+		checksum: checksum,
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	i, ok := d.filesIndexMap[file.path]
+	if !ok || d.files[i] != file {
+		return fmt.Errorf("file %s is not loaded", file.path)
+	}
+
+	if err := d.manifest.log(&versionEdit{removed: []string{name}, added: []*fileMeta{meta}}); err != nil {
+		return err
+	}
+
+	heap.Remove(d, i)
+	d.cache.Remove(file.path)
 
-		b, err := readBlock(d.data)
+	file.obsolete = true
+	if file.data != nil {
+		file.data.Close()
+		file.data = nil
+	}
+
+	// The object of a remote file is replaced once the rewrite is uploaded.
+	if file.remote && d.remote != nil {
+		d.remote.drop(name)
+	}
+
+	if err := os.Rename(tmp, file.path); err != nil {
+		return err
+	}
+
+	return d.addFileLocked(file.path, meta)
+}
+
+// file returns the loaded file at path p, or nil if it isn't loaded.
+func (d *disktable) file(p string) *diskFile {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	i, ok := d.filesIndexMap[p]
+	if !ok {
+		return nil
+	}
+
+	return d.files[i]
+}
+
+func (d *diskFile) getRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+	return d.getRangeContext(context.Background(), startTime, endTime, filter)
+}
+
+func (d *diskFile) getRangeContext(ctx context.Context, startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+	return db.Collect(newIterator(ctx, []source{d.newSource(ctx, startTime, endTime, filter)}))
+}
+
+// open returns a handle reading the file. The files evicted from the local
+// disk are read from the remote tier under ctx, a range at a time.
+func (d *diskFile) open(ctx context.Context) (tableFile, error) {
+	d.t.mutex.Lock()
+	defer d.t.mutex.Unlock()
+
+	return d.openLocked(ctx)
+}
+
+func (d *diskFile) openLocked(ctx context.Context) (tableFile, error) {
+	if !d.remote {
+		file, err := os.Open(d.path)
 		if err != nil {
 			return nil, err
 		}
 
-		return b.getRange(startTime, endTime), nil
+		return file, nil
 	}
 
-	result := []db.KV{}
-	if filter != nil && filter.Type != db.UnknownType {
-		for _, index := range d.indexes[filter.Type] {
-			r, err := check(index)
-			if err != nil {
-				return nil, err
-			}
+	if d.t.remote == nil {
+		return nil, fmt.Errorf("file %s is only on the remote tier", d.path)
+	}
 
-			result = append(result, r...)
+	return d.t.remote.open(ctx, path.Base(d.path), d.size), nil
+}
+
+// loadIndexes returns the block indexes and the tombstones of the file on
+// first use, they are kept until the file is evicted from the LRU cache. The
+// file is read without holding the table mutex, which is only taken to
+// publish the result, and a single caller reads it at a time.
+func (d *diskFile) loadIndexes(ctx context.Context) ([db.TypeCount]map[string]*index, []*tombstone, error) {
+	select {
+	case d.loading <- struct{}{}:
+	case <-ctx.Done():
+		return d.indexesOf(), nil, ctx.Err()
+	}
+	defer func() { <-d.loading }()
+
+	d.t.mutex.Lock()
+	if d.data != nil {
+		defer d.t.mutex.Unlock()
+
+		// The lookup keeps the file recently used.
+		d.t.cache.Get(d.path)
+		return d.indexes, d.tombstones, nil
+	}
+
+	remote, verified := d.remote, d.verified
+	file, err := d.openLocked(ctx)
+	d.t.mutex.Unlock()
+	if err != nil {
+		return d.indexesOf(), nil, err
+	}
+
+	// The header and the blocks of a remote file are verified by their own
+	// checksums as they are read, unless the file predates them.
+	version, indexes, tombstones, err := readIndex(file)
+	if err == nil && !verified && (!remote || version < tableVersion2) {
+		err = verifyChecksum(file, d.checksum, d.path)
+	}
+
+	if err != nil {
+		file.Close()
+		return d.indexesOf(), nil, err
+	}
+
+	d.t.mutex.Lock()
+	defer d.t.mutex.Unlock()
+
+	d.version, d.indexes, d.tombstones, d.verified = version, indexes, tombstones, true
+
+	// A file replaced while it was read isn't kept open.
+	if d.obsolete {
+		return indexes, tombstones, file.Close()
+	}
+
+	d.data = file
+	if d.t.cache.Get(d.path) == nil {
+		if err := d.t.cache.Put(d.path, d); err != nil {
+			return indexes, tombstones, err
 		}
+	}
+
+	return indexes, tombstones, nil
+}
+
+func (d *diskFile) indexesOf() [db.TypeCount]map[string]*index {
+	d.t.mutex.Lock()
+	defer d.t.mutex.Unlock()
+
+	return d.indexes
+}
 
-		return result, nil
+// verifyChecksum checks the file at p against the checksum recorded in the
+// manifest.
+func verifyChecksum(file tableFile, checksum uint32, p string) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, file); err != nil {
+		return err
 	}
 
-	for _, indexes := range d.indexes {
-		for _, index := range indexes {
-			r, err := check(index)
+	if h.Sum32() != checksum {
+		return fmt.Errorf("file %s checksum mismatch", p)
+	}
+
+	return nil
+}
+
+// readIndex reads the block indexes and the tombstones of the file.
+func readIndex(file tableFile) (uint32, [db.TypeCount]map[string]*index, []*tombstone, error) {
+	var indexes [db.TypeCount]map[string]*index
+	version, header, err := findHeader(file)
+	if err != nil {
+		return 0, indexes, nil, err
+	}
+
+	indexes, tombstoneIndex, err := readHeader(bytes.NewReader(header), version)
+	if err != nil {
+		return 0, indexes, nil, err
+	}
+
+	if version < tableVersion4 {
+		if indexes, err = canonicalIndexes(indexes); err != nil {
+			return 0, indexes, nil, err
+		}
+	}
+
+	if tombstoneIndex == nil {
+		return version, indexes, nil, nil
+	}
+
+	buffer, err := readBlockData(file, tombstoneIndex, version)
+	if err != nil {
+		return 0, indexes, nil, err
+	}
+
+	format := tombstoneSeries
+	switch {
+	case version < tableVersion4:
+		format = tombstoneTags
+	case version < tableVersion6:
+		format = tombstoneMatchers
+	}
+
+	tombstones, err := decodeTombstones(buffer, format)
+	return version, indexes, tombstones, err
+}
+
+// canonicalIndexes rekeys the blocks of a file indexed by tags by their
+// canonical series keys, so they merge with the same series of newer files.
+func canonicalIndexes(indexes [db.TypeCount]map[string]*index) ([db.TypeCount]map[string]*index, error) {
+	result := [db.TypeCount]map[string]*index{}
+	for t, indexMap := range indexes {
+		result[t] = make(map[string]*index, len(indexMap))
+		for _, i := range indexMap {
+			key, err := db.CanonicalSeriesKey(i.index)
 			if err != nil {
-				return nil, err
+				return result, err
 			}
 
-			result = append(result, r...)
+			i.index = key
+			result[t][key] = i
 		}
 	}
 
 	return result, nil
 }
 
-func (d *diskFile) readIndex() (err error) {
-	if err := findHeader(d.data); err != nil {
-		return err
+// Clean closes the file when it is evicted from the LRU cache, its indexes
+// are read again on next use. A file which has been uploaded and isn't read
+// is also removed from the local disk, it is then read from the remote tier.
+func (d *diskFile) Clean() error {
+	if d.data != nil {
+		if err := d.data.Close(); err != nil {
+			return err
+		}
+		d.data = nil
 	}
 
-	if d.indexes, err = readHeader(d.data); err != nil {
+	if !d.uploaded || d.remote || d.obsolete || d.refs > 0 || d.t.remote == nil {
+		return nil
+	}
+
+	if err := os.Remove(d.path); err != nil {
 		return err
 	}
 
+	d.remote = true
 	return nil
 }
 
-func (d *diskFile) Clean() error {
-	heap.Remove(d.t, d.t.filesIndexMap[d.path])
+// release drops the reference of a source, removing the file if it is
+// obsolete and was the last reader.
+func (d *diskFile) release() error {
+	d.t.mutex.Lock()
+	defer d.t.mutex.Unlock()
+
+	d.refs--
+	return d.removeIfUnused()
+}
+
+func (d *diskFile) removeIfUnused() error {
+	if !d.obsolete || d.refs > 0 {
+		return nil
+	}
+
 	if d.data != nil {
 		if err := d.data.Close(); err != nil {
 			return err
 		}
+		d.data = nil
 	}
 
-	return nil
+	if d.remote {
+		return nil
+	}
+
+	return os.Remove(d.path)
 }
 
-func parseFileName(filename string) (int64, int64, error) {
-	keyScope := strings.Split(filename, "-")
-	start, err := strconv.ParseInt(keyScope[0], 10, 64)
+// fileNamePattern matches min-max-seq, the keys may be negative.
+var fileNamePattern = regexp.MustCompile(`^(-?\d+)-(-?\d+)(?:-(\d+))?$`)
+
+// parseFileName parses the key range and the sequence from a file name of the
+// form min-max-seq. Files written before the sequence was added have no seq
+// part and are older than every other file.
+func parseFileName(filename string) (int64, int64, uint64, error) {
+	keyScope := fileNamePattern.FindStringSubmatch(filename)
+	if keyScope == nil {
+		return 0, 0, 0, fmt.Errorf("wrong file name %s", filename)
+	}
+
+	start, err := strconv.ParseInt(keyScope[1], 10, 64)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
 	}
 
-	end, err := strconv.ParseInt(keyScope[1], 10, 64)
+	end, err := strconv.ParseInt(keyScope[2], 10, 64)
 	if err != nil {
-		return 0, 0, err
+		return 0, 0, 0, err
+	}
+
+	var seq uint64
+	if keyScope[3] != "" {
+		if seq, err = strconv.ParseUint(keyScope[3], 10, 64); err != nil {
+			return 0, 0, 0, err
+		}
 	}
 
-	return start, end, nil
+	return start, end, seq, nil
 }
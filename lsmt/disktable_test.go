@@ -34,6 +34,15 @@ func (dt *disktable) prepare(start, end int64) {
 
 }
 
+func touch(filePath string) {
+	file, err := os.Create(filePath)
+	if err != nil {
+		panic(err)
+	}
+
+	file.Close()
+}
+
 func TestDiskTable(t *testing.T) {
 	os.Mkdir(testOption.WorkDir, 0750)
 	defer os.RemoveAll(testOption.WorkDir)
@@ -87,6 +96,7 @@ func TestAddFile(t *testing.T) {
 		}
 	}()
 
+	touch("test_lsm/0-239")
 	if err := dt.AddFile("test_lsm/0-239"); err != nil {
 		t.Fatal(err)
 	}
@@ -115,19 +125,79 @@ func TestLRUCache(t *testing.T) {
 	}()
 
 	for i := 0; i < 100; i++ {
-		if err := dt.AddFile(fmt.Sprintf(path.Join(testOption.WorkDir, "%d-%d"), i*100, (i+1)*100)); err != nil {
+		filePath := fmt.Sprintf(path.Join(testOption.WorkDir, "%d-%d"), i*100, (i+1)*100)
+		touch(filePath)
+		if err := dt.AddFile(filePath); err != nil {
 			t.Fatal(err)
 		}
 	}
 
-	if len(dt.files) != 10 {
+	// The evicted files are closed but stay in the table.
+	if len(dt.files) != 100 {
 		t.Errorf("wrong files count: %d", len(dt.files))
 	}
 
-	for i, file := range dt.files {
-		expectPath := fmt.Sprintf(path.Join(testOption.WorkDir, "%d-%d"), (i+90)*100, (i+91)*100)
-		if file.path != expectPath {
-			t.Errorf("wrong file name: expect: %s, got: %s", file.path, file.path)
+	for i := 0; i < 100; i++ {
+		filePath := fmt.Sprintf(path.Join(testOption.WorkDir, "%d-%d"), i*100, (i+1)*100)
+		if cached := dt.cache.Get(filePath) != nil; cached != (i >= 90) {
+			t.Errorf("file %s: expect cached %v, got %v", filePath, i >= 90, cached)
+		}
+	}
+}
+
+func TestParseFileName(t *testing.T) {
+	minKey, maxKey, seq, err := parseFileName("10-20-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if minKey != 10 || maxKey != 20 || seq != 3 {
+		t.Errorf("wrong parse result: %d-%d-%d", minKey, maxKey, seq)
+	}
+
+	if _, _, seq, err = parseFileName("10-20"); err != nil || seq != 0 {
+		t.Errorf("expect legacy file name to parse with seq 0, got %d, %v", seq, err)
+	}
+
+	minKey, maxKey, seq, err = parseFileName("-20--10-4")
+	if err != nil || minKey != -20 || maxKey != -10 || seq != 4 {
+		t.Errorf("wrong parse result of negative keys: %d-%d-%d, %v", minKey, maxKey, seq, err)
+	}
+
+	if _, _, _, err = parseFileName("MANIFEST"); err == nil {
+		t.Error("expect error for a wrong file name")
+	}
+}
+
+func TestDiskTableTimestamps(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	// Nanosecond timestamps don't fit in 32 bits, the blocks are pruned on
+	// their full range.
+	base := int64(1700000000000000000)
+	keys := []int64{-base, -1, 0, base, base + 1<<32}
+
+	for _, key := range keys {
+		mt := NewMemtable()
+		mt.insert(&db.Entry{KV: db.KV{Key: key, Value: key}, Type: db.IntType, Tags: []string{"test"}})
+		dt.flush(mt)
+	}
+
+	for _, key := range keys {
+		result, err := dt.getRange(key, key+1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectResult := []db.KV{{Key: key, Value: key}}
+		if !reflect.DeepEqual(expectResult, result) {
+			t.Errorf("expect %v, got %v\n", expectResult, result)
 		}
 	}
 }
@@ -2,25 +2,165 @@ package lsmt
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
-	"os"
+	"math"
 
 	db "github.com/dovics/pangolin"
+	"github.com/dovics/pangolin/utils/rbtree"
+)
+
+// A SSTable is a sequence of blocks followed by the header, which holds an
+// index entry for every block, and a trailer locating the header.
+//
+// Version 1 files end with the 32-bit offset of the header. Version 2 files
+// end with a fixed footer, their index entries have a 64-bit offset and the
+// CRC32C of the block. Version 3 index entries hold 64-bit timestamps, the
+// older versions truncated them to 32 bits. Old files stay readable, the
+// files older than version 3 are rewritten in the latest version when the
+// storage is opened and the others when they are compacted. Version 4 blocks
+// are indexed by canonical series keys and the tombstones hold matchers, the
+// older versions used the tags of the entries and of the filters. Version 5
+// index entries of numeric blocks hold the statistics of their values. Version
+// 6 tombstones hold the series key of their filter.
+//
+// +------------------+------------------+-----------------+-----------------+
+// |                  |                  |                 |                 |
+// |   header offset  |    header crc    |     version     |      magic      |
+// |                  |                  |                 |                 |
+// +------------------+------------------+-----------------+-----------------+
+
+const (
+	tableVersion1 = 1
+	tableVersion2 = 2
+	tableVersion3 = 3
+	tableVersion4 = 4
+	tableVersion5 = 5
+	tableVersion6 = 6
+	tableVersion  = tableVersion6
+
+	tableMagic      uint64 = 0x50414e474f4c494e // "PANGOLIN"
+	tableFooterSize        = 24
+)
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+	errTableCorrupt = errors.New("sstable is corrupt")
 )
 
 type index struct {
-	index  string
-	t      db.ValueType
-	count  uint32
-	min    uint32
-	max    uint32
-	offset uint32
-	length uint32
+	index    string
+	t        db.ValueType
+	count    uint32
+	min      int64
+	max      int64
+	offset   uint64
+	length   uint32
+	checksum uint32
+
+	// stats is nil for the blocks without numbers and in the files before
+	// version 5.
+	stats *blockStats
+}
+
+// blockStats summarizes the numeric values of a block. The NaN values are only
+// counted by nan, first and last are the values at firstTime and lastTime.
+type blockStats struct {
+	nan       uint32
+	sum       float64
+	min       float64
+	max       float64
+	first     float64
+	last      float64
+	firstTime int64
+	lastTime  int64
+}
+
+const blockStatsSize = 4 + 5*8 + 2*8
+
+func newBlockStats(b *block) *blockStats {
+	if b.valueType != db.IntType && b.valueType != db.FloatType && b.valueType != db.UnsignedType {
+		return nil
+	}
+
+	stats := &blockStats{}
+	numbers := 0
+	iter := rbtree.NewTreeIter(b.data)
+	for iter.HasNext() {
+		item := iter.Next().(rbtree.TimestampItem)
+		v, ok := db.ToFloat64(item.Value)
+		if !ok {
+			return nil
+		}
+
+		if math.IsNaN(v) {
+			stats.nan++
+			continue
+		}
+
+		numbers++
+		if numbers == 1 {
+			stats.min, stats.max = v, v
+			stats.first, stats.firstTime = v, item.Time
+		}
+
+		stats.min = math.Min(stats.min, v)
+		stats.max = math.Max(stats.max, v)
+		stats.sum += v
+		stats.last, stats.lastTime = v, item.Time
+	}
+
+	return stats
 }
 
-func (i *index) bytes() []byte {
+func (s *blockStats) appendTo(dst []byte) []byte {
+	offset := len(dst)
+	dst = append(dst, make([]byte, blockStatsSize)...)
+	buffer := dst[offset:]
+
+	binary.BigEndian.PutUint32(buffer, s.nan)
+	for i, v := range []float64{s.sum, s.min, s.max, s.first, s.last} {
+		binary.BigEndian.PutUint64(buffer[4+8*i:], math.Float64bits(v))
+	}
+	binary.BigEndian.PutUint64(buffer[44:], uint64(s.firstTime))
+	binary.BigEndian.PutUint64(buffer[52:], uint64(s.lastTime))
+
+	return dst
+}
+
+func readBlockStats(buffer []byte) *blockStats {
+	values := make([]float64, 5)
+	for i := range values {
+		values[i] = math.Float64frombits(binary.BigEndian.Uint64(buffer[4+8*i:]))
+	}
+
+	return &blockStats{
+		nan:       binary.BigEndian.Uint32(buffer),
+		sum:       values[0],
+		min:       values[1],
+		max:       values[2],
+		first:     values[3],
+		last:      values[4],
+		firstTime: int64(binary.BigEndian.Uint64(buffer[44:])),
+		lastTime:  int64(binary.BigEndian.Uint64(buffer[52:])),
+	}
+}
+
+func (i *index) bytes(version uint32) []byte {
+	size := 28 + len(i.index)
+	if version >= tableVersion2 {
+		size += 8
+	}
+
+	if version >= tableVersion3 {
+		size += 8
+	}
+
 	offset := 0
-	buffer := make([]byte, 28+len(i.index))
+	buffer := make([]byte, size)
 	binary.BigEndian.PutUint32(buffer[offset:], uint32(len(i.index)))
 	offset += 4
 
@@ -33,24 +173,50 @@ func (i *index) bytes() []byte {
 	binary.BigEndian.PutUint32(buffer[offset:], uint32(i.count))
 	offset += 4
 
-	binary.BigEndian.PutUint32(buffer[offset:], uint32(i.max))
-	offset += 4
+	if version >= tableVersion3 {
+		binary.BigEndian.PutUint64(buffer[offset:], uint64(i.max))
+		offset += 8
 
-	binary.BigEndian.PutUint32(buffer[offset:], uint32(i.min))
-	offset += 4
+		binary.BigEndian.PutUint64(buffer[offset:], uint64(i.min))
+		offset += 8
+	} else {
+		binary.BigEndian.PutUint32(buffer[offset:], uint32(i.max))
+		offset += 4
 
-	binary.BigEndian.PutUint32(buffer[offset:], i.offset)
-	offset += 4
+		binary.BigEndian.PutUint32(buffer[offset:], uint32(i.min))
+		offset += 4
+	}
+
+	if version >= tableVersion2 {
+		binary.BigEndian.PutUint64(buffer[offset:], i.offset)
+		offset += 8
+	} else {
+		binary.BigEndian.PutUint32(buffer[offset:], uint32(i.offset))
+		offset += 4
+	}
 
 	binary.BigEndian.PutUint32(buffer[offset:], i.length)
 	offset += 4
 
+	if version >= tableVersion2 {
+		binary.BigEndian.PutUint32(buffer[offset:], i.checksum)
+		offset += 4
+	}
+
+	if version >= tableVersion5 {
+		if i.stats == nil {
+			return append(buffer, 0)
+		}
+
+		return i.stats.appendTo(append(buffer, 1))
+	}
+
 	return buffer
 }
 
-func writeHeader(w io.Writer, indexes []*index) error {
+func writeHeader(w io.Writer, indexes []*index, version uint32) error {
 	for _, index := range indexes {
-		if _, err := w.Write(index.bytes()); err != nil {
+		if _, err := w.Write(index.bytes(version)); err != nil {
 			return err
 		}
 	}
@@ -58,87 +224,254 @@ func writeHeader(w io.Writer, indexes []*index) error {
 	return nil
 }
 
-func findHeader(r io.ReadSeeker) error {
-	if _, err := r.Seek(0, os.SEEK_END); err != nil {
-		return err
+func writeFooter(w io.Writer, headerOffset uint64, headerChecksum uint32) error {
+	buffer := make([]byte, tableFooterSize)
+	binary.BigEndian.PutUint64(buffer, headerOffset)
+	binary.BigEndian.PutUint32(buffer[8:], headerChecksum)
+	binary.BigEndian.PutUint32(buffer[12:], tableVersion)
+	binary.BigEndian.PutUint64(buffer[16:], tableMagic)
+
+	_, err := w.Write(buffer)
+	return err
+}
+
+// readTableVersion reads the version of a file from its trailer, without
+// reading the header.
+func readTableVersion(r io.ReadSeeker) (uint32, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+
+	if size < tableFooterSize {
+		return tableVersion1, nil
+	}
+
+	if _, err := r.Seek(-tableFooterSize, io.SeekEnd); err != nil {
+		return 0, err
+	}
+
+	trailer := make([]byte, tableFooterSize)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return 0, err
+	}
+
+	if binary.BigEndian.Uint64(trailer[16:]) != tableMagic {
+		return tableVersion1, nil
+	}
+
+	return binary.BigEndian.Uint32(trailer[12:]), nil
+}
+
+// findHeader reads the trailer of a file and returns its version with the
+// header, which is verified against its checksum in version 2 files.
+func findHeader(r io.ReadSeeker) (uint32, []byte, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, nil, err
 	}
 
-	if _, err := r.Seek(-4, os.SEEK_CUR); err != nil {
-		return err
+	if size < 4 {
+		return 0, nil, errTableCorrupt
+	}
+
+	version, headerOffset, headerEnd := uint32(tableVersion1), uint64(0), size-4
+	var checksum uint32
+
+	trailer := make([]byte, tableFooterSize)
+	if size >= tableFooterSize {
+		if _, err := r.Seek(-tableFooterSize, io.SeekEnd); err != nil {
+			return 0, nil, err
+		}
+
+		if _, err := io.ReadFull(r, trailer); err != nil {
+			return 0, nil, err
+		}
 	}
 
-	buffer := make([]byte, 4)
-	if _, err := r.Read(buffer); err != nil {
-		return err
+	if size >= tableFooterSize && binary.BigEndian.Uint64(trailer[16:]) == tableMagic {
+		headerOffset = binary.BigEndian.Uint64(trailer)
+		checksum = binary.BigEndian.Uint32(trailer[8:])
+		version = binary.BigEndian.Uint32(trailer[12:])
+		headerEnd = size - tableFooterSize
+
+		if version < tableVersion2 || version > tableVersion {
+			return 0, nil, fmt.Errorf("unknown sstable version %d", version)
+		}
+	} else {
+		if _, err := r.Seek(-4, io.SeekEnd); err != nil {
+			return 0, nil, err
+		}
+
+		if _, err := io.ReadFull(r, trailer[:4]); err != nil {
+			return 0, nil, err
+		}
+
+		headerOffset = uint64(binary.BigEndian.Uint32(trailer))
 	}
 
-	headerOffset := binary.BigEndian.Uint32(buffer)
+	if headerOffset > uint64(headerEnd) {
+		return 0, nil, errTableCorrupt
+	}
 
 	if _, err := r.Seek(int64(headerOffset), io.SeekStart); err != nil {
-		return err
+		return 0, nil, err
 	}
 
-	return nil
+	header := make([]byte, uint64(headerEnd)-headerOffset)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	if version >= tableVersion2 && crc32.Checksum(header, castagnoli) != checksum {
+		return 0, nil, errTableCorrupt
+	}
+
+	return version, header, nil
 }
 
-func readHeader(r io.Reader) ([db.TypeCount]map[string]*index, error) {
+// readHeader reads the block indexes of a file, the entry of the tombstone
+// block is returned separately and is nil if the file has no tombstones.
+func readHeader(r io.Reader, version uint32) ([db.TypeCount]map[string]*index, *index, error) {
 	indexes := [db.TypeCount]map[string]*index{}
 	for i := range indexes {
 		indexes[i] = make(map[string]*index)
 	}
 
-	var err error
-	buffer := make([]byte, 4)
+	var (
+		err        error
+		tombstones *index
+	)
+	buffer := make([]byte, 8)
 	for {
-		if _, err = r.Read(buffer); err != nil {
+		if _, err = io.ReadFull(r, buffer[:4]); err != nil {
 			break
 		}
 
 		indexLength := binary.BigEndian.Uint32(buffer)
 		indexBuffer := make([]byte, indexLength)
 
-		if _, err := r.Read(indexBuffer); err != nil {
+		if _, err = io.ReadFull(r, indexBuffer); err != nil {
 			break
 		}
 
 		index := &index{index: string(indexBuffer)}
 
-		if _, err := r.Read(buffer); err != nil {
+		if _, err = io.ReadFull(r, buffer[:4]); err != nil {
 			break
 		}
 		index.t = db.ValueType(binary.BigEndian.Uint32(buffer))
 
-		if _, err := r.Read(buffer); err != nil {
+		if _, err = io.ReadFull(r, buffer[:4]); err != nil {
 			break
 		}
 		index.count = binary.BigEndian.Uint32(buffer)
 
-		if _, err := r.Read(buffer); err != nil {
-			break
+		if version >= tableVersion3 {
+			if _, err = io.ReadFull(r, buffer); err != nil {
+				break
+			}
+			index.max = int64(binary.BigEndian.Uint64(buffer))
+
+			if _, err = io.ReadFull(r, buffer); err != nil {
+				break
+			}
+			index.min = int64(binary.BigEndian.Uint64(buffer))
+		} else {
+			if _, err = io.ReadFull(r, buffer[:4]); err != nil {
+				break
+			}
+			index.max = int64(binary.BigEndian.Uint32(buffer))
+
+			if _, err = io.ReadFull(r, buffer[:4]); err != nil {
+				break
+			}
+			index.min = int64(binary.BigEndian.Uint32(buffer))
 		}
-		index.max = binary.BigEndian.Uint32(buffer)
 
-		if _, err := r.Read(buffer); err != nil {
-			break
+		if version >= tableVersion2 {
+			if _, err = io.ReadFull(r, buffer); err != nil {
+				break
+			}
+			index.offset = binary.BigEndian.Uint64(buffer)
+		} else {
+			if _, err = io.ReadFull(r, buffer[:4]); err != nil {
+				break
+			}
+			index.offset = uint64(binary.BigEndian.Uint32(buffer))
 		}
-		index.min = binary.BigEndian.Uint32(buffer)
 
-		if _, err := r.Read(buffer); err != nil {
+		if _, err = io.ReadFull(r, buffer[:4]); err != nil {
 			break
 		}
-		index.offset = binary.BigEndian.Uint32(buffer)
+		index.length = binary.BigEndian.Uint32(buffer)
 
-		if _, err := r.Read(buffer); err != nil {
-			break
+		if version >= tableVersion2 {
+			if _, err = io.ReadFull(r, buffer[:4]); err != nil {
+				break
+			}
+			index.checksum = binary.BigEndian.Uint32(buffer)
+		}
+
+		if version >= tableVersion5 {
+			if _, err = io.ReadFull(r, buffer[:1]); err != nil {
+				break
+			}
+
+			if buffer[0] != 0 {
+				statsBuffer := make([]byte, blockStatsSize)
+				if _, err = io.ReadFull(r, statsBuffer); err != nil {
+					break
+				}
+				index.stats = readBlockStats(statsBuffer)
+			}
+		}
+
+		if index.t == tombstoneType {
+			tombstones = index
+			continue
+		}
+
+		if index.t >= db.TypeCount {
+			return indexes, tombstones, fmt.Errorf("unknown value type %d", index.t)
 		}
-		index.length = binary.BigEndian.Uint32(buffer)
 
 		indexes[index.t][index.index] = index
 	}
 
+	if err == io.ErrUnexpectedEOF {
+		return indexes, tombstones, errTableCorrupt
+	}
+
 	if err != io.EOF {
-		return indexes, err
+		return indexes, tombstones, err
+	}
+
+	return indexes, tombstones, nil
+}
+
+// readBlockData reads the block of the index entry from r, verifying its
+// checksum in version 2 files.
+func readBlockData(r io.ReaderAt, i *index, version uint32) ([]byte, error) {
+	data := make([]byte, i.length)
+	if _, err := r.ReadAt(data, int64(i.offset)); err != nil {
+		return nil, err
+	}
+
+	if version >= tableVersion2 && crc32.Checksum(data, castagnoli) != i.checksum {
+		return nil, errTableCorrupt
+	}
+
+	return data, nil
+}
+
+// overlaps reports whether the block of the index entry may hold points in
+// [startTime, endTime]. The timestamps of the versions before 3 were truncated
+// to 32 bits, they are only compared when the range fits in 32 bits.
+func (i *index) overlaps(startTime, endTime int64, version uint32) bool {
+	if version < tableVersion3 && (startTime < 0 || endTime > math.MaxUint32) {
+		return true
 	}
 
-	return indexes, nil
+	return i.max >= startTime && i.min <= endTime
 }
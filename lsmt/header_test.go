@@ -2,6 +2,7 @@ package lsmt
 
 import (
 	"bytes"
+	"encoding/binary"
 	"reflect"
 	"strconv"
 	"testing"
@@ -10,14 +11,18 @@ import (
 )
 
 func TestHeader(t *testing.T) {
+	for _, version := range []uint32{tableVersion1, tableVersion2, tableVersion3, tableVersion4, tableVersion5, tableVersion6} {
+		testHeader(t, version)
+	}
+}
+
+func testHeader(t *testing.T, version uint32) {
 	buffer := new(bytes.Buffer)
 
 	indexes := []*index{}
-	expectResult := [db.TypeCount]map[string]*index{
-		make(map[string]*index),
-		make(map[string]*index),
-		make(map[string]*index),
-		make(map[string]*index),
+	expectResult := [db.TypeCount]map[string]*index{}
+	for i := range expectResult {
+		expectResult[i] = make(map[string]*index)
 	}
 
 	for i := 0; i < 100; i++ {
@@ -25,31 +30,126 @@ func TestHeader(t *testing.T) {
 			index:  "test" + strconv.Itoa(i),
 			t:      db.IntType,
 			count:  10,
-			max:    uint32(10 * (i + 1)),
-			min:    uint32(10 * i),
-			offset: uint32(100 * i),
+			max:    int64(10 * (i + 1)),
+			min:    int64(10 * i),
+			offset: uint64(100 * i),
 			length: 100,
 		})
+
+		if version >= tableVersion5 && i%2 == 0 {
+			indexes[i].stats = &blockStats{nan: 1, sum: 45, min: -1, max: 9.5, first: 1, last: 2, firstTime: int64(10 * i), lastTime: int64(10 * (i + 1))}
+		}
 	}
 
 	for _, index := range indexes {
 		expectResult[index.t][index.index] = index
 	}
 
-	if err := writeHeader(buffer, indexes); err != nil {
+	if err := writeHeader(buffer, indexes, version); err != nil {
 		t.Fatal(err)
 	}
 
 	t.Log(buffer.Bytes())
 
-	result, err := readHeader(buffer)
+	result, tombstones, err := readHeader(buffer, version)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	if tombstones != nil {
+		t.Errorf("expect no tombstones, got %v", tombstones)
+	}
+
 	if !reflect.DeepEqual(expectResult, result) {
 		t.Errorf("expect equal, expectResult: %v, result: %v", indexes, result)
 	}
 
 	t.Log(result)
 }
+
+func TestTableFormat(t *testing.T) {
+	mt := NewMemtable()
+	for i := int64(0); i < 100; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"test"}})
+	}
+
+	v3 := new(bytes.Buffer)
+	if err := mt.write(v3); err != nil {
+		t.Fatal(err)
+	}
+
+	// A version 1 file ends with the 32-bit header offset.
+	v1 := new(bytes.Buffer)
+	b := mt.blocks[db.IntType][`{test=""}`]
+	length, err := b.writeBlock(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := &index{index: "test", t: db.IntType, count: uint32(b.count), max: 99, length: uint32(length)}
+	if err := writeHeader(v1, []*index{i}, tableVersion1); err != nil {
+		t.Fatal(err)
+	}
+	trailer := make([]byte, 4)
+	binary.BigEndian.PutUint32(trailer, uint32(length))
+	v1.Write(trailer)
+
+	for expectVersion, data := range map[uint32][]byte{tableVersion1: v1.Bytes(), tableVersion: v3.Bytes()} {
+		version, header, err := findHeader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if version != expectVersion {
+			t.Errorf("expect version %d, got %d", expectVersion, version)
+		}
+
+		indexes, _, err := readHeader(bytes.NewReader(header), version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The blocks of a version 1 file are indexed by tags.
+		key := `{test=""}`
+		if version == tableVersion1 {
+			key = "test"
+		}
+
+		blockData, err := readBlockData(bytes.NewReader(data), indexes[db.IntType][key], version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := readBlock(bytes.NewReader(blockData))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(result.getRange(0, 100), b.getRange(0, 100)) {
+			t.Errorf("version %d: wrong block", version)
+		}
+	}
+
+	corrupt := append([]byte(nil), v3.Bytes()...)
+	corrupt[10] ^= 0xff
+
+	version, header, err := findHeader(bytes.NewReader(corrupt))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	indexes, _, err := readHeader(bytes.NewReader(header), version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readBlockData(bytes.NewReader(corrupt), indexes[db.IntType][`{test=""}`], version); err != errTableCorrupt {
+		t.Errorf("expect a corrupt block, got %v", err)
+	}
+
+	corrupt = append([]byte(nil), v3.Bytes()...)
+	corrupt[len(corrupt)-tableFooterSize-1] ^= 0xff
+	if _, _, err := findHeader(bytes.NewReader(corrupt)); err != errTableCorrupt {
+		t.Errorf("expect a corrupt header, got %v", err)
+	}
+}
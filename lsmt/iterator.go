@@ -0,0 +1,456 @@
+package lsmt
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	db "github.com/dovics/pangolin"
+)
+
+// chunk is the points of one series read from a single block.
+type chunk struct {
+	index string
+	t     db.ValueType
+	kvs   []db.KV
+}
+
+// source yields the chunks of a memtable or a SSTable one block at a time,
+// ordered by series. Chunks are never empty, next returns a nil chunk once the
+// source is exhausted. The tombstones of a source hide the points of the
+// older sources, they are available once next has been called.
+type source interface {
+	next() (*chunk, error)
+	tombstones() []*tombstone
+	Close() error
+}
+
+func seriesLess(indexA string, typeA db.ValueType, indexB string, typeB db.ValueType) bool {
+	if typeA != typeB {
+		return typeA < typeB
+	}
+
+	return indexA < indexB
+}
+
+type cursor struct {
+	src   source
+	pos   int
+	chunk *chunk
+	i     int
+
+	tombstones []*tombstone
+}
+
+func (c *cursor) at() db.KV {
+	return c.chunk.kvs[c.i]
+}
+
+// advance moves the cursor to the next point, fetching the next chunk of the
+// source when the current one is exhausted.
+func (c *cursor) advance() error {
+	c.i++
+	for c.chunk != nil && c.i >= len(c.chunk.kvs) {
+		next, err := c.src.next()
+		if err != nil {
+			return err
+		}
+
+		c.chunk, c.i = next, 0
+	}
+
+	return nil
+}
+
+// iterator is a k-way merge of its sources. The sources must be ordered from
+// the newest to the oldest, the points are returned grouped by series and in
+// timestamp order within a series. When several sources hold the same
+// timestamp of a series, only the point of the newest one is returned. Only
+// the current block of every source is held in memory.
+type iterator struct {
+	ctx     context.Context
+	cursors []*cursor
+
+	started bool
+	index   string
+	t       db.ValueType
+	active  []*cursor
+	masks   [][]*tombstone
+
+	kv  db.KV
+	err error
+}
+
+func newIterator(ctx context.Context, sources []source) *iterator {
+	it := &iterator{ctx: ctx, cursors: make([]*cursor, len(sources))}
+	for i, src := range sources {
+		it.cursors[i] = &cursor{src: src, pos: i}
+	}
+
+	return it
+}
+
+func (it *iterator) start() error {
+	it.started = true
+	for _, c := range it.cursors {
+		chunk, err := c.src.next()
+		if err != nil {
+			return err
+		}
+
+		c.chunk = chunk
+		c.tombstones = c.src.tombstones()
+	}
+
+	it.masks = make([][]*tombstone, len(it.cursors))
+	return nil
+}
+
+// nextSeries selects the cursors positioned at the smallest series.
+func (it *iterator) nextSeries() bool {
+	var first *chunk
+	for _, c := range it.cursors {
+		if c.chunk == nil {
+			continue
+		}
+
+		if first == nil || seriesLess(c.chunk.index, c.chunk.t, first.index, first.t) {
+			first = c.chunk
+		}
+	}
+
+	if first == nil {
+		return false
+	}
+
+	it.index, it.t = first.index, first.t
+	it.active = it.active[:0]
+
+	// The points of a cursor are hidden by the tombstones of every newer
+	// cursor which match the series.
+	var masks []*tombstone
+	for _, c := range it.cursors {
+		it.masks[c.pos] = masks[:len(masks):len(masks)]
+		for _, t := range c.tombstones {
+			if t.match(it.index, it.t) {
+				masks = append(masks, t)
+			}
+		}
+
+		if c.chunk != nil && c.chunk.index == it.index && c.chunk.t == it.t {
+			it.active = append(it.active, c)
+		}
+	}
+
+	return true
+}
+
+func (it *iterator) masked(c *cursor, key int64) bool {
+	for _, t := range it.masks[c.pos] {
+		if t.covers(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (it *iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+
+	if it.err = it.ctx.Err(); it.err != nil {
+		return false
+	}
+
+	if !it.started {
+		if it.err = it.start(); it.err != nil {
+			return false
+		}
+	}
+
+	for {
+		for len(it.active) == 0 {
+			if !it.nextSeries() {
+				return false
+			}
+		}
+
+		// The cursors are ordered from the newest source, so the first one
+		// with the smallest timestamp wins.
+		var winner *cursor
+		for _, c := range it.active {
+			if winner == nil || c.at().Key < winner.at().Key {
+				winner = c
+			}
+		}
+		kv := winner.at()
+
+		active := it.active[:0]
+		for _, c := range it.active {
+			if c.at().Key == kv.Key {
+				if it.err = c.advance(); it.err != nil {
+					return false
+				}
+			}
+
+			if c.chunk != nil && c.chunk.index == it.index && c.chunk.t == it.t {
+				active = append(active, c)
+			}
+		}
+		it.active = active
+
+		if !it.masked(winner, kv.Key) {
+			it.kv = kv
+			return true
+		}
+	}
+}
+
+func (it *iterator) At() db.KV {
+	return it.kv
+}
+
+// series returns the key of the series of the current point.
+func (it *iterator) series() string {
+	return it.index
+}
+
+func (it *iterator) Err() error {
+	return it.err
+}
+
+func (it *iterator) Close() error {
+	var err error
+	for _, c := range it.cursors {
+		if closeErr := c.src.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	it.cursors = nil
+	it.active = nil
+	return err
+}
+
+type memtableSource struct {
+	m         *memtable
+	startTime int64
+	endTime   int64
+
+	indexes []string
+	blocks  []*block
+	deleted []*tombstone
+}
+
+func (m *memtable) newSource(startTime, endTime int64, filter *db.QueryFilter) source {
+	return m.newSeriesSource(startTime, endTime, filter, nil)
+}
+
+// newSeriesSource is like newSource but only reads the given series, every
+// series is read if series is nil.
+func (m *memtable) newSeriesSource(startTime, endTime int64, filter *db.QueryFilter, series []string) source {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	s := &memtableSource{m: m, startTime: startTime, endTime: endTime, deleted: m.tombstones}
+	if endTime < m.minKey || startTime > m.maxKey {
+		return s
+	}
+
+	for t, indexMap := range m.blocks {
+		if filter != nil && filter.Type != db.UnknownType && filter.Type != db.ValueType(t) {
+			continue
+		}
+
+		if series != nil {
+			for _, i := range series {
+				if block, ok := indexMap[i]; ok && filter.Match(i) {
+					s.indexes = append(s.indexes, i)
+					s.blocks = append(s.blocks, block)
+				}
+			}
+			continue
+		}
+
+		for i, block := range indexMap {
+			if !filter.Match(i) {
+				continue
+			}
+
+			s.indexes = append(s.indexes, i)
+			s.blocks = append(s.blocks, block)
+		}
+	}
+
+	sort.Sort(s)
+	return s
+}
+
+func (s *memtableSource) Len() int { return len(s.blocks) }
+func (s *memtableSource) Less(i, j int) bool {
+	return seriesLess(s.indexes[i], s.blocks[i].valueType, s.indexes[j], s.blocks[j].valueType)
+}
+func (s *memtableSource) Swap(i, j int) {
+	s.indexes[i], s.indexes[j] = s.indexes[j], s.indexes[i]
+	s.blocks[i], s.blocks[j] = s.blocks[j], s.blocks[i]
+}
+
+func (s *memtableSource) next() (*chunk, error) {
+	for len(s.blocks) > 0 {
+		index, block := s.indexes[0], s.blocks[0]
+		s.indexes, s.blocks = s.indexes[1:], s.blocks[1:]
+
+		s.m.mutex.RLock()
+		kvs := block.getRange(s.startTime, s.endTime)
+		s.m.mutex.RUnlock()
+
+		if len(kvs) == 0 {
+			continue
+		}
+
+		return &chunk{index: index, t: block.valueType, kvs: kvs}, nil
+	}
+
+	return nil, nil
+}
+
+func (s *memtableSource) tombstones() []*tombstone {
+	return s.deleted
+}
+
+func (s *memtableSource) Close() error {
+	s.indexes, s.blocks = nil, nil
+	return nil
+}
+
+// fileSource reads the blocks of a SSTable through its own file handle, so
+// the shared handle of the diskFile is never seeked concurrently.
+type fileSource struct {
+	ctx       context.Context
+	file      *diskFile
+	startTime int64
+	endTime   int64
+	filter    *db.QueryFilter
+	series    []string
+
+	data     tableFile
+	indexes  []*index
+	deleted  []*tombstone
+	released bool
+}
+
+// newSource returns a source holding a reference to the file until it is
+// closed.
+func (d *diskFile) newSource(ctx context.Context, startTime, endTime int64, filter *db.QueryFilter) source {
+	d.t.mutex.Lock()
+	d.refs++
+	d.t.mutex.Unlock()
+
+	return newFileSource(ctx, d, startTime, endTime, filter)
+}
+
+// newFileSource expects the caller to have taken a reference to the file. A
+// file evicted from the local disk is read from the remote tier under ctx.
+func newFileSource(ctx context.Context, d *diskFile, startTime, endTime int64, filter *db.QueryFilter) *fileSource {
+	return &fileSource{ctx: ctx, file: d, startTime: startTime, endTime: endTime, filter: filter}
+}
+
+func (s *fileSource) open() error {
+	indexes, tombstones, err := s.file.loadIndexes(s.ctx)
+	if err != nil {
+		return err
+	}
+
+	s.deleted = tombstones
+
+	for t, indexMap := range indexes {
+		if s.filter != nil && s.filter.Type != db.UnknownType && s.filter.Type != db.ValueType(t) {
+			continue
+		}
+
+		if s.series != nil {
+			for _, key := range s.series {
+				if i, ok := indexMap[key]; ok && s.filter.Match(key) && i.overlaps(s.startTime, s.endTime, s.file.version) {
+					s.indexes = append(s.indexes, i)
+				}
+			}
+			continue
+		}
+
+		for _, i := range indexMap {
+			if !s.filter.Match(i.index) {
+				continue
+			}
+
+			if !i.overlaps(s.startTime, s.endTime, s.file.version) {
+				continue
+			}
+
+			s.indexes = append(s.indexes, i)
+		}
+	}
+
+	sort.Slice(s.indexes, func(i, j int) bool {
+		return seriesLess(s.indexes[i].index, s.indexes[i].t, s.indexes[j].index, s.indexes[j].t)
+	})
+
+	s.data, err = s.file.open(s.ctx)
+	return err
+}
+
+func (s *fileSource) next() (*chunk, error) {
+	if s.data == nil {
+		if err := s.open(); err != nil {
+			return nil, err
+		}
+	}
+
+	for len(s.indexes) > 0 {
+		i := s.indexes[0]
+		s.indexes = s.indexes[1:]
+
+		data, err := readBlockData(s.data, i, s.file.version)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := readBlock(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		kvs := b.getRange(s.startTime, s.endTime)
+		if len(kvs) == 0 {
+			continue
+		}
+
+		return &chunk{index: i.index, t: i.t, kvs: kvs}, nil
+	}
+
+	return nil, nil
+}
+
+func (s *fileSource) tombstones() []*tombstone {
+	return s.deleted
+}
+
+func (s *fileSource) Close() error {
+	s.indexes = nil
+
+	var err error
+	if s.data != nil {
+		err = s.data.Close()
+		s.data = nil
+	}
+
+	if !s.released {
+		s.released = true
+		if releaseErr := s.file.release(); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,166 @@
+package lsmt
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestIterator(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	dt.prepare(0, 100)
+
+	mt := NewMemtable()
+	for i := int64(100); i < 200; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"test"}})
+	}
+
+	sources := append([]source{mt.newSource(50, 150, nil)}, dt.newSources(50, 150, nil)...)
+	result, err := db.Collect(newIterator(context.Background(), sources))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectResult := make([]db.KV, 0, 100)
+	for i := int64(50); i < 150; i++ {
+		expectResult = append(expectResult, db.KV{Key: i, Value: i})
+	}
+
+	if !reflect.DeepEqual(expectResult, result) {
+		t.Errorf("expect %v, got %v\n", expectResult, result)
+	}
+}
+
+func TestIteratorMerge(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	dt.prepare(0, 100)
+
+	mt := NewMemtable()
+	for i := int64(0); i < 100; i += 2 {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i * 10}, Type: db.IntType, Tags: []string{"test"}})
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i * 100}, Type: db.IntType, Tags: []string{"test"}})
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"other"}})
+	}
+
+	sources := append([]source{mt.newSource(0, 100, nil)}, dt.newSources(0, 100, nil)...)
+	result, err := db.Collect(newIterator(context.Background(), sources))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectResult := make([]db.KV, 0, 150)
+	for i := int64(0); i < 100; i += 2 {
+		expectResult = append(expectResult, db.KV{Key: i, Value: i})
+	}
+	for i := int64(0); i < 100; i++ {
+		if i%2 == 0 {
+			expectResult = append(expectResult, db.KV{Key: i, Value: i * 100})
+		} else {
+			expectResult = append(expectResult, db.KV{Key: i, Value: i})
+		}
+	}
+
+	if !reflect.DeepEqual(expectResult, result) {
+		t.Errorf("expect %v, got %v\n", expectResult, result)
+	}
+}
+
+func TestIteratorCancel(t *testing.T) {
+	mt := NewMemtable()
+	for i := int64(0); i < 100; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"a"}})
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"b"}})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	it := newIterator(ctx, []source{mt.newSource(0, 100, nil)})
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		count++
+		if count == 10 {
+			cancel()
+		}
+	}
+
+	if it.Err() != context.Canceled {
+		t.Errorf("expect context canceled, got %v", it.Err())
+	}
+
+	if count != 10 {
+		t.Errorf("expect the iterator to stop once canceled, got %d points", count)
+	}
+}
+
+func TestGetRangeContext(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	mt := NewMemtable()
+	for i := int64(0); i < 100; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu"})
+	}
+	dt.flush(mt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := dt.getRangeContext(ctx, 0, 100, nil); err != context.Canceled {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+
+	if refs := dt.files[0].refs; refs != 0 {
+		t.Errorf("expect the file to be released, got %d references", refs)
+	}
+
+	result, err := dt.getRangeContext(context.Background(), 0, 100, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 100 {
+		t.Errorf("expect 100 points, got %d", len(result))
+	}
+}
+
+func TestIteratorMatchers(t *testing.T) {
+	mt := NewMemtable()
+	for _, host := range []string{"a", "ab"} {
+		mt.insert(&db.Entry{KV: db.KV{Key: 1, Value: int64(1)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": host}})
+	}
+
+	filter := &db.QueryFilter{Metric: "cpu", Matchers: []*db.Matcher{db.MustNewMatcher(db.MatchEqual, "host", "a")}}
+	result, err := db.Collect(newIterator(context.Background(), []source{mt.newSource(0, 10, filter)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 1 {
+		t.Errorf("expect only host=a, got %v", result)
+	}
+}
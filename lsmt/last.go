@@ -0,0 +1,211 @@
+package lsmt
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"sort"
+
+	db "github.com/dovics/pangolin"
+	"github.com/dovics/pangolin/utils/rbtree"
+)
+
+// Last returns the newest point of every series and type matching the
+// filter. The memtables are checked first, then the disk files from the
+// newest. The blocks whose max time isn't after the point already found for
+// their series and type aren't read, and the files are no longer walked once
+// every indexed series and type is found or deleted by a newer tombstone and
+// the remaining files end before the points found.
+func (s *Storage) Last(filter *db.QueryFilter) ([]*db.SeriesPoint, error) {
+	sources := s.sources(context.Background(), db.QueryRequest{StartTime: math.MinInt64, EndTime: math.MaxInt64, Filter: filter})
+	defer func() {
+		for _, src := range sources {
+			src.Close()
+		}
+	}()
+
+	keys := s.series.match(filter)
+	if keys == nil {
+		keys = s.series.all()
+	}
+
+	matched := keys[:0:0]
+	for _, key := range keys {
+		if filter.Match(key) {
+			matched = append(matched, key)
+		}
+	}
+
+	t := db.UnknownType
+	if filter != nil {
+		t = filter.Type
+	}
+	wanted := s.series.typed(matched, t)
+
+	// remaining is the max time of the files from a source on, first their
+	// min time.
+	remaining := make([]int64, len(sources)+1)
+	first := make([]int64, len(sources)+1)
+	remaining[len(sources)], first[len(sources)] = math.MinInt64, math.MaxInt64
+	for pos := len(sources) - 1; pos >= 0; pos-- {
+		remaining[pos], first[pos] = remaining[pos+1], first[pos+1]
+		if fs, ok := sources[pos].(*fileSource); ok {
+			if fs.file.maxKey > remaining[pos] {
+				remaining[pos] = fs.file.maxKey
+			}
+			if fs.file.minKey < first[pos] {
+				first[pos] = fs.file.minKey
+			}
+		}
+	}
+
+	last := map[seriesType]*db.SeriesPoint{}
+	var newer []*tombstone
+	update := func(index string, b *block) {
+		key := seriesType{key: index, t: b.valueType}
+		found, exists := last[key]
+		if kv, ok := lastPoint(b, index, newer, found, exists); ok {
+			last[key] = &db.SeriesPoint{KV: kv, Type: b.valueType}
+		}
+	}
+
+	for pos, src := range sources {
+		switch src := src.(type) {
+		case *memtableSource:
+			src.m.mutex.RLock()
+			for i, b := range src.blocks {
+				update(src.indexes[i], b)
+			}
+			src.m.mutex.RUnlock()
+		case *fileSource:
+			if resolved(wanted, last, newer, first[pos], remaining[pos]) {
+				return lastResult(last)
+			}
+
+			if err := src.open(); err != nil {
+				return nil, err
+			}
+
+			for _, i := range src.indexes {
+				if found, ok := last[seriesType{key: i.index, t: i.t}]; ok && i.max <= found.Key {
+					continue
+				}
+
+				data, err := readBlockData(src.data, i, src.file.version)
+				if err != nil {
+					return nil, err
+				}
+
+				b, err := readBlock(bytes.NewReader(data))
+				if err != nil {
+					return nil, err
+				}
+
+				update(i.index, b)
+			}
+		}
+
+		newer = append(newer, src.tombstones()...)
+	}
+
+	return lastResult(last)
+}
+
+// lastPoint returns the newest point of the block which isn't hidden by the
+// tombstones and is after the point found, if any.
+func lastPoint(b *block, index string, tombstones []*tombstone, found *db.SeriesPoint, exists bool) (db.KV, bool) {
+	masks := []*tombstone{}
+	for _, t := range tombstones {
+		if t.match(index, b.valueType) {
+			masks = append(masks, t)
+		}
+	}
+
+	masked := func(key int64) bool {
+		for _, t := range masks {
+			if t.covers(key) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	var (
+		result db.KV
+		ok     bool
+	)
+
+	if max := b.data.Max(); max != nil && !masked(max.(rbtree.TimestampItem).Time) {
+		item := max.(rbtree.TimestampItem)
+		result, ok = db.KV{Key: item.Time, Value: item.Value}, true
+	} else {
+		iter := rbtree.NewTreeIter(b.data)
+		for iter.HasNext() {
+			item := iter.Next().(rbtree.TimestampItem)
+			if !masked(item.Time) {
+				result, ok = db.KV{Key: item.Time, Value: item.Value}, true
+			}
+		}
+	}
+
+	if !ok || (exists && result.Key <= found.Key) {
+		return db.KV{}, false
+	}
+
+	return result, true
+}
+
+// resolved reports whether no file from the source on can hold a newer point
+// of a wanted series and type, the files hold the points in [first,
+// remaining]. A series and type is resolved once a point after the files is
+// found or the points of the files are deleted by a newer tombstone.
+func resolved(wanted []seriesType, last map[seriesType]*db.SeriesPoint, tombstones []*tombstone, first, remaining int64) bool {
+	for _, st := range wanted {
+		if found, ok := last[st]; ok && found.Key >= remaining {
+			continue
+		}
+
+		deleted := false
+		for _, t := range tombstones {
+			if t.start <= first && t.end > remaining && t.match(st.key, st.t) {
+				deleted = true
+				break
+			}
+		}
+
+		if !deleted {
+			return false
+		}
+	}
+
+	return true
+}
+
+func lastResult(last map[seriesType]*db.SeriesPoint) ([]*db.SeriesPoint, error) {
+	keys := make([]seriesType, 0, len(last))
+	for key := range last {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].key != keys[j].key {
+			return keys[i].key < keys[j].key
+		}
+
+		return keys[i].t < keys[j].t
+	})
+
+	result := make([]*db.SeriesPoint, len(keys))
+	for i, key := range keys {
+		metric, labels, err := db.ParseSeriesKey(key.key)
+		if err != nil {
+			return nil, err
+		}
+
+		p := last[key]
+		p.Metric, p.Labels = metric, labels
+		result[i] = p
+	}
+
+	return result, nil
+}
@@ -0,0 +1,225 @@
+package lsmt
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestLast(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	x, _, err := openSeriesIndex(testOption.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	s := &Storage{mem: NewMemtable(), disk: dt, series: x}
+	insert := func(mt *memtable, key int64, value interface{}, host string) {
+		e := &db.Entry{KV: db.KV{Key: key, Value: value}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": host}}
+		if _, ok := value.(string); ok {
+			e.Type = db.StringType
+		}
+
+		if err := x.add(seriesType{e.Index(), e.Type}); err != nil {
+			t.Fatal(err)
+		}
+		mt.insert(e)
+	}
+
+	mt := NewMemtable()
+	for i := int64(0); i < 10; i++ {
+		insert(mt, i, i, "a")
+		insert(mt, i, i, "b")
+	}
+	insert(mt, 100, "up", "c")
+	dt.flush(mt)
+
+	// The newest point of b is deleted by a newer file.
+	mt = NewMemtable()
+	for i := int64(20); i < 30; i++ {
+		insert(mt, i, i, "a")
+	}
+	mt.deleteRange(newTombstone(5, 10, &db.QueryFilter{Matchers: []*db.Matcher{db.MustNewMatcher(db.MatchEqual, "host", "b")}}))
+	dt.flush(mt)
+
+	insert(s.mem, 15, int64(15), "a")
+	insert(s.mem, 50, int64(50), "d")
+
+	result, err := s.Last(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []*db.SeriesPoint{
+		{KV: db.KV{Key: 29, Value: int64(29)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}},
+		{KV: db.KV{Key: 4, Value: int64(4)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "b"}},
+		{KV: db.KV{Key: 100, Value: "up"}, Type: db.StringType, Metric: "cpu", Labels: map[string]string{"host": "c"}},
+		{KV: db.KV{Key: 50, Value: int64(50)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "d"}},
+	}
+
+	if !reflect.DeepEqual(expect, result) {
+		for _, p := range result {
+			t.Logf("%+v", *p)
+		}
+		t.Errorf("wrong last points")
+	}
+
+	result, err = s.Last(&db.QueryFilter{Matchers: []*db.Matcher{db.MustNewMatcher(db.MatchRegexp, "host", "a|d")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 2 || result[0].Key != 29 || result[1].Key != 50 {
+		t.Errorf("expect the points of a and d, got %v", result)
+	}
+}
+
+func TestLastSkipFiles(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	x, _, err := openSeriesIndex(testOption.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	s := &Storage{mem: NewMemtable(), disk: dt, series: x}
+	e := &db.Entry{KV: db.KV{Key: 0, Value: int64(0)}, Type: db.IntType, Metric: "cpu"}
+	x.add(seriesType{e.Index(), e.Type})
+
+	mt := NewMemtable()
+	mt.insert(e)
+	dt.flush(mt)
+
+	// The file ends before the point of the memtable, it isn't read.
+	if err := os.Truncate(dt.files[0].path, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	s.mem.insert(&db.Entry{KV: db.KV{Key: 10, Value: int64(10)}, Type: db.IntType, Metric: "cpu"})
+
+	result, err := s.Last(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 1 || result[0].Key != 10 {
+		t.Errorf("expect the point of the memtable, got %v", result)
+	}
+}
+
+func TestLastTypes(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	x, _, err := openSeriesIndex(testOption.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	insert := func(mt *memtable, key int64, value interface{}, metric, host string) {
+		e := &db.Entry{KV: db.KV{Key: key, Value: value}, Type: db.TypeOf(value), Metric: metric, Labels: map[string]string{"host": host}}
+		if err := x.add(seriesType{e.Index(), e.Type}); err != nil {
+			t.Fatal(err)
+		}
+		mt.insert(e)
+	}
+
+	// The oldest file holds the points of every series.
+	mt := NewMemtable()
+	for i := int64(0); i < 10; i++ {
+		insert(mt, i, i, "cpu", "a")
+		insert(mt, i, float64(i), "cpu", "b")
+		insert(mt, i, i, "mem", "a")
+	}
+	dt.flush(mt)
+
+	mt = NewMemtable()
+	for i := int64(10); i < 20; i++ {
+		insert(mt, i, float64(i), "cpu", "b")
+	}
+	dt.flush(mt)
+
+	// The newest file holds the last integer of cpu and deletes mem.
+	mt = NewMemtable()
+	for i := int64(20); i < 30; i++ {
+		insert(mt, i, i, "cpu", "a")
+	}
+	insert(mt, 25, 2.5, "cpu", "a")
+	mt.deleteRange(newTombstone(math.MinInt64, math.MaxInt64, &db.QueryFilter{Metric: "mem"}))
+	dt.flush(mt)
+	dt.Close()
+
+	// The files are opened again by the reads only.
+	if dt, err = NewDiskTable(testOption.WorkDir, testOption.DiskfileCount); err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	s := &Storage{mem: NewMemtable(), disk: dt, series: x}
+	result, err := s.Last(&db.QueryFilter{Type: db.IntType})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []*db.SeriesPoint{{KV: db.KV{Key: 29, Value: int64(29)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}}}
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf("expect %v, got %v", expect, result)
+	}
+
+	// The float series and the deleted series don't hold newer integers.
+	opened := 0
+	for _, file := range dt.files {
+		if file.data != nil {
+			opened++
+		}
+	}
+
+	if opened != 1 {
+		t.Errorf("expect only the newest file to be opened, got %d", opened)
+	}
+
+	// Every type of a series has its newest point.
+	result, err = s.Last(&db.QueryFilter{Metric: "cpu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect = []*db.SeriesPoint{
+		{KV: db.KV{Key: 29, Value: int64(29)}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}},
+		{KV: db.KV{Key: 25, Value: 2.5}, Type: db.FloatType, Metric: "cpu", Labels: map[string]string{"host": "a"}},
+		{KV: db.KV{Key: 19, Value: float64(19)}, Type: db.FloatType, Metric: "cpu", Labels: map[string]string{"host": "b"}},
+	}
+
+	if !reflect.DeepEqual(expect, result) {
+		for _, p := range result {
+			t.Logf("%+v", *p)
+		}
+		t.Errorf("wrong last points")
+	}
+}
@@ -0,0 +1,371 @@
+package lsmt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+)
+
+// The manifest is a log of version edits in WorkDir, every edit adds or
+// removes SSTables from the live set, or marks them uploaded to the remote
+// tier. A record is framed like a WAL record, so an edit is applied at once or
+// not at all.
+//
+// +---------+-------+------+----------------+------+----------------+-----+
+// |         |       |      |                |      |                |     |
+// | version | count | kind | add / remove   | kind | add / remove   | ... |
+// |         |       |      |                |      |                |     |
+// +---------+-------+------+----------------+------+----------------+-----+
+//
+// add:    | name | id | level | minKey | maxKey | size | checksum |
+// remove: | name |
+// upload: | name |
+
+const (
+	manifestName    = "MANIFEST"
+	manifestVersion = 1
+
+	manifestAddFile    = 0
+	manifestRemoveFile = 1
+	manifestUploadFile = 2
+)
+
+var errManifestCorrupt = errors.New("manifest record is corrupt")
+
+// fileMeta describes a live SSTable. The id is the sequence of the file name,
+// level is 0 for a flushed memtable and 1 for a compaction output.
+type fileMeta struct {
+	name     string
+	id       uint64
+	level    int
+	minKey   int64
+	maxKey   int64
+	size     int64
+	checksum uint32
+
+	// uploaded is set once the file is on the remote tier, the files which
+	// aren't are uploaded again after a restart.
+	uploaded bool
+}
+
+// newFileMeta reads the file at p to compute its size and checksum.
+func newFileMeta(p string, level int) (*fileMeta, error) {
+	name := path.Base(p)
+	minKey, maxKey, id, err := parseFileName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	size, checksum, err := fileChecksum(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileMeta{
+		name:     name,
+		id:       id,
+		level:    level,
+		minKey:   minKey,
+		maxKey:   maxKey,
+		size:     size,
+		checksum: checksum,
+	}, nil
+}
+
+func fileChecksum(p string) (int64, uint32, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	h := crc32.NewIEEE()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return size, h.Sum32(), nil
+}
+
+type versionEdit struct {
+	added    []*fileMeta
+	removed  []string
+	uploaded []string
+}
+
+type manifest struct {
+	dir   string
+	file  *os.File
+	files map[string]*fileMeta
+}
+
+// openManifest replays the manifest of dir, the returned bool reports whether
+// it existed. A torn tail left by a crash is truncated.
+func openManifest(dir string) (*manifest, bool, error) {
+	m := &manifest{dir: dir, files: map[string]*fileMeta{}}
+
+	p := path.Join(dir, manifestName)
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return m, false, nil
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to open file %s: %w", p, err)
+	}
+
+	valid, err := readFramed(bufio.NewReader(file), func(payload []byte) error {
+		edit, err := decodeVersionEdit(payload)
+		if err != nil {
+			return err
+		}
+
+		m.apply(edit)
+		return nil
+	})
+	file.Close()
+
+	if err != nil {
+		if !errors.Is(err, errWALCorrupt) && !errors.Is(err, errManifestCorrupt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, false, err
+		}
+
+		log.Printf("truncate manifest %s at %d: %v\n", p, valid, err)
+		if err := os.Truncate(p, valid); err != nil {
+			return nil, false, fmt.Errorf("failed to truncate the manifest %s: %w", p, err)
+		}
+	}
+
+	return m, true, nil
+}
+
+func (m *manifest) apply(edit *versionEdit) {
+	for _, name := range edit.removed {
+		delete(m.files, name)
+	}
+
+	for _, meta := range edit.added {
+		m.files[meta.name] = meta
+	}
+
+	for _, name := range edit.uploaded {
+		if meta, ok := m.files[name]; ok {
+			meta.uploaded = true
+		}
+	}
+}
+
+// log durably appends the edit before applying it.
+func (m *manifest) log(edit *versionEdit) error {
+	if m.file == nil {
+		return errors.New("manifest is closed")
+	}
+
+	record, err := appendVersionEdit(nil, edit)
+	if err != nil {
+		return err
+	}
+
+	if _, err := m.file.Write(record); err != nil {
+		return fmt.Errorf("failed to write the manifest: %w", err)
+	}
+
+	if err := m.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the manifest: %w", err)
+	}
+
+	m.apply(edit)
+	return nil
+}
+
+// rewrite replaces the log with a single edit holding the live set and opens
+// it for appending.
+func (m *manifest) rewrite() error {
+	if m.file != nil {
+		if err := m.file.Close(); err != nil {
+			return err
+		}
+		m.file = nil
+	}
+
+	edit := &versionEdit{}
+	for _, meta := range m.files {
+		edit.added = append(edit.added, meta)
+	}
+	sort.Slice(edit.added, func(i, j int) bool { return edit.added[i].id < edit.added[j].id })
+
+	for _, meta := range edit.added {
+		if meta.uploaded {
+			edit.uploaded = append(edit.uploaded, meta.name)
+		}
+	}
+
+	record, err := appendVersionEdit(nil, edit)
+	if err != nil {
+		return err
+	}
+
+	p := path.Join(m.dir, manifestName)
+	tmpPath := p + tmpFileSuffix
+	if err := writeFileSync(tmpPath, record); err != nil {
+		return fmt.Errorf("failed to write the manifest: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, p); err != nil {
+		return fmt.Errorf("failed to rename the manifest: %w", err)
+	}
+
+	file, err := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the manifest: %w", err)
+	}
+
+	m.file = file
+	return nil
+}
+
+func (m *manifest) Close() error {
+	if m.file == nil {
+		return nil
+	}
+
+	file := m.file
+	m.file = nil
+	return file.Close()
+}
+
+func writeFileSync(p string, data []byte) error {
+	file, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func appendVersionEdit(dst []byte, edit *versionEdit) ([]byte, error) {
+	return appendFramed(dst, func(dst []byte) ([]byte, error) {
+		dst = append(dst, manifestVersion)
+		dst = appendUvarint(dst, uint64(len(edit.added)+len(edit.removed)+len(edit.uploaded)))
+
+		for _, name := range edit.removed {
+			dst = append(dst, manifestRemoveFile)
+			dst = appendString(dst, name)
+		}
+
+		for _, meta := range edit.added {
+			dst = append(dst, manifestAddFile)
+			dst = appendString(dst, meta.name)
+			dst = appendUvarint(dst, meta.id)
+			dst = appendUvarint(dst, uint64(meta.level))
+			dst = appendInt64(dst, meta.minKey)
+			dst = appendInt64(dst, meta.maxKey)
+			dst = appendUvarint(dst, uint64(meta.size))
+			dst = append(dst, make([]byte, 4)...)
+			binary.BigEndian.PutUint32(dst[len(dst)-4:], meta.checksum)
+		}
+
+		for _, name := range edit.uploaded {
+			dst = append(dst, manifestUploadFile)
+			dst = appendString(dst, name)
+		}
+
+		return dst, nil
+	})
+}
+
+func decodeVersionEdit(payload []byte) (*versionEdit, error) {
+	if len(payload) < 1 || payload[0] != manifestVersion {
+		return nil, errManifestCorrupt
+	}
+	buf := payload[1:]
+
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errManifestCorrupt
+	}
+	buf = buf[n:]
+
+	edit := &versionEdit{}
+	for i := uint64(0); i < count; i++ {
+		if len(buf) < 1 {
+			return nil, errManifestCorrupt
+		}
+		kind := buf[0]
+
+		name, rest, err := readString(buf[1:])
+		if err != nil {
+			return nil, errManifestCorrupt
+		}
+		buf = rest
+
+		switch kind {
+		case manifestRemoveFile:
+			edit.removed = append(edit.removed, name)
+		case manifestUploadFile:
+			edit.uploaded = append(edit.uploaded, name)
+		case manifestAddFile:
+			meta := &fileMeta{name: name}
+			if buf, err = readFileMeta(buf, meta); err != nil {
+				return nil, err
+			}
+
+			edit.added = append(edit.added, meta)
+		default:
+			return nil, errManifestCorrupt
+		}
+	}
+
+	return edit, nil
+}
+
+func readFileMeta(buf []byte, meta *fileMeta) ([]byte, error) {
+	var n int
+	if meta.id, n = binary.Uvarint(buf); n <= 0 {
+		return nil, errManifestCorrupt
+	}
+	buf = buf[n:]
+
+	level, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errManifestCorrupt
+	}
+	meta.level = int(level)
+	buf = buf[n:]
+
+	if len(buf) < 16 {
+		return nil, errManifestCorrupt
+	}
+	meta.minKey = int64(binary.BigEndian.Uint64(buf))
+	meta.maxKey = int64(binary.BigEndian.Uint64(buf[8:]))
+	buf = buf[16:]
+
+	size, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errManifestCorrupt
+	}
+	meta.size = int64(size)
+	buf = buf[n:]
+
+	if len(buf) < 4 {
+		return nil, errManifestCorrupt
+	}
+	meta.checksum = binary.BigEndian.Uint32(buf)
+	return buf[4:], nil
+}
@@ -0,0 +1,191 @@
+package lsmt
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestManifest(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		mt := NewMemtable()
+		mt.insert(&db.Entry{KV: db.KV{Key: 1, Value: int64(i)}, Type: db.IntType, Tags: []string{"test"}})
+		dt.flush(mt)
+	}
+
+	if err := dt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stray := path.Join(testOption.WorkDir, "stray")
+	orphan := path.Join(testOption.WorkDir, "1-1-9")
+	touch(stray)
+	touch(orphan)
+
+	// A torn tail is truncated.
+	manifestFile, err := os.OpenFile(path.Join(testOption.WorkDir, manifestName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestFile.Write([]byte{1, 2, 3})
+	manifestFile.Close()
+
+	dt, err = NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	if dt.Len() != 2 {
+		t.Errorf("expect 2 files, got %d", dt.Len())
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("expect the orphaned file to be moved, got %v", err)
+	}
+
+	if _, err := os.Stat(path.Join(testOption.WorkDir, orphanDir, "1-1-9")); err != nil {
+		t.Errorf("expect the orphaned file to be kept aside, got %v", err)
+	}
+
+	if _, err := os.Stat(stray); err != nil {
+		t.Errorf("expect the stray file to be ignored, got %v", err)
+	}
+
+	result, err := dt.getRange(0, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 1 || result[0].Value != int64(1) {
+		t.Errorf("expect the newest point, got %v", result)
+	}
+
+	if dt.nextFileName(0, 0) != "0-0-3" {
+		t.Error("expect the sequence to be restored")
+	}
+}
+
+func TestManifestChecksum(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	mt := NewMemtable()
+	mt.insert(&db.Entry{KV: db.KV{Key: 1, Value: int64(1)}, Type: db.IntType, Tags: []string{"test"}})
+	dt.flush(mt)
+
+	file, err := os.OpenFile(dt.files[0].path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteAt([]byte{0xff}, 0)
+	file.Close()
+
+	if _, err := dt.getRange(0, 10, nil); err == nil {
+		t.Error("expect error for a corrupt file")
+	}
+}
+
+func TestManifestUploaded(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		mt := NewMemtable()
+		mt.insert(&db.Entry{KV: db.KV{Key: int64(i), Value: int64(i)}, Type: db.IntType, Metric: "cpu"})
+		dt.flush(mt)
+	}
+
+	uploaded, local := path.Join(testOption.WorkDir, "0-0-1"), path.Join(testOption.WorkDir, "1-1-2")
+	if live, err := dt.uploaded(uploaded); err != nil || !live {
+		t.Fatalf("expect the file to be marked uploaded, got %v, %v", live, err)
+	}
+
+	if err := dt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upload survives the rewrite of the manifest on load.
+	for i := 0; i < 2; i++ {
+		if dt, err = NewDiskTable(testOption.WorkDir, testOption.DiskfileCount); err != nil {
+			t.Fatal(err)
+		}
+
+		if pending := dt.pendingUploads(); len(pending) != 1 || pending[0] != local {
+			t.Errorf("expect %s to be pending, got %v", local, pending)
+		}
+
+		if err := dt.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A missing file is read from the remote tier only if it was uploaded.
+	os.Remove(uploaded)
+	os.Remove(local)
+	if dt, err = NewDiskTable(testOption.WorkDir, testOption.DiskfileCount); err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	if dt.Len() != 1 || dt.files[0].path != uploaded || !dt.files[0].remote {
+		t.Errorf("expect only the uploaded file on the remote tier, got %d files", dt.Len())
+	}
+}
+
+func TestManifestTruncatedFile(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		mt := NewMemtable()
+		mt.insert(&db.Entry{KV: db.KV{Key: int64(i), Value: int64(i)}, Type: db.IntType, Metric: "cpu"})
+		dt.flush(mt)
+	}
+
+	if err := dt.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	truncated, missing := path.Join(testOption.WorkDir, "0-0-1"), path.Join(testOption.WorkDir, "1-1-2")
+	if err := os.Truncate(truncated, 10); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(missing)
+
+	if dt, err = NewDiskTable(testOption.WorkDir, testOption.DiskfileCount); err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	if dt.Len() != 1 {
+		t.Errorf("expect 1 file, got %d", dt.Len())
+	}
+
+	// The truncated file is kept aside.
+	if info, err := os.Stat(path.Join(testOption.WorkDir, orphanDir, "0-0-1")); err != nil || info.Size() != 10 {
+		t.Errorf("expect the truncated file to be kept aside, got %v", err)
+	}
+}
@@ -1,8 +1,8 @@
 package lsmt
 
 import (
-	"encoding/binary"
 	"io"
+	"math"
 	"sync"
 
 	db "github.com/dovics/pangolin"
@@ -10,16 +10,17 @@ import (
 )
 
 type memtable struct {
-	mutex  sync.RWMutex
-	blocks [db.TypeCount]map[string]*block
-	size   uint64
+	mutex      sync.RWMutex
+	blocks     [db.TypeCount]map[string]*block
+	tombstones []*tombstone
+	size       uint64
 
 	minKey int64
 	maxKey int64
 }
 
 func NewMemtable() *memtable {
-	m := &memtable{minKey: -1, maxKey: -1}
+	m := &memtable{minKey: math.MaxInt64, maxKey: math.MinInt64}
 	for i := 0; i < int(db.TypeCount); i++ {
 		m.blocks[i] = make(map[string]*block)
 	}
@@ -27,10 +28,35 @@ func NewMemtable() *memtable {
 	return m
 }
 
+// bytes returns the size the entries and the tombstones are accounted for.
+func (m *memtable) bytes() uint64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.size
+}
+
 func (m *memtable) insert(e *db.Entry) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
+	return m.insertLocked(e)
+}
+
+func (m *memtable) insertBatch(entries []*db.Entry) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, e := range entries {
+		if err := m.insertLocked(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *memtable) insertLocked(e *db.Entry) error {
 	index := e.Index()
 
 	table, ok := m.blocks[e.Type][index]
@@ -42,17 +68,55 @@ func (m *memtable) insert(e *db.Entry) error {
 	table.set(e.Key, e.Value)
 	m.size += e.Size()
 
-	if m.minKey == -1 || e.Key < m.minKey {
+	if e.Key < m.minKey {
 		m.minKey = e.Key
 	}
 
-	if m.maxKey == -1 || e.Key > m.maxKey {
+	if e.Key > m.maxKey {
 		m.maxKey = e.Key
 	}
 
 	return nil
 }
 
+// deleteRange removes the points covered by the tombstone and keeps it to
+// hide the points of older sources. The key range of the memtable is
+// extended to the tombstone, so the file it is flushed to is never pruned
+// from a query the tombstone applies to.
+func (m *memtable) deleteRange(t *tombstone) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for valueType, indexMap := range m.blocks {
+		for i, b := range indexMap {
+			if !t.match(i, db.ValueType(valueType)) {
+				continue
+			}
+
+			b.deleteRange(t.start, t.end)
+			if b.count == 0 {
+				delete(indexMap, i)
+			}
+		}
+	}
+
+	m.tombstones = append(m.tombstones, t)
+	m.size += tombstoneSize
+
+	if t.end <= t.start {
+		return
+	}
+	start, end := t.start, t.end-1
+
+	if start < m.minKey {
+		m.minKey = start
+	}
+
+	if end > m.maxKey {
+		m.maxKey = end
+	}
+}
+
 func (m *memtable) getRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
@@ -64,7 +128,7 @@ func (m *memtable) getRange(startTime, endTime int64, filter *db.QueryFilter) ([
 	result := []db.KV{}
 	if filter != nil && filter.Type != db.UnknownType {
 		for i, block := range m.blocks[filter.Type] {
-			if !db.ContainTags(i, filter.Tags) {
+			if !filter.Match(i) {
 				continue
 			}
 
@@ -76,7 +140,7 @@ func (m *memtable) getRange(startTime, endTime int64, filter *db.QueryFilter) ([
 
 	for _, indexMap := range m.blocks {
 		for i, block := range indexMap {
-			if filter != nil && !db.ContainTags(i, filter.Tags) {
+			if !filter.Match(i) {
 				continue
 			}
 
@@ -91,39 +155,18 @@ func (m *memtable) write(w io.Writer) error {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
 
-	indexes := []*index{}
-	currentOffset := uint32(0)
+	tw := newTableWriter(w)
 	for t := 0; t < int(db.TypeCount); t++ {
 		for i, table := range m.blocks[t] {
-			length, err := table.writeBlock(w)
-			if err != nil {
+			if err := tw.writeBlock(i, table); err != nil {
 				return err
 			}
-
-			indexes = append(indexes, &index{
-				index:  i,
-				t:      table.valueType,
-				count:  uint32(table.count),
-				min:    uint32(table.data.Min().(rbtree.TimestampItem).Time),
-				max:    uint32(table.data.Max().(rbtree.TimestampItem).Time),
-				offset: currentOffset,
-				length: uint32(length),
-			})
-
-			currentOffset += uint32(length)
 		}
-
 	}
 
-	if err := writeHeader(w, indexes); err != nil {
+	if err := tw.writeTombstones(m.tombstones); err != nil {
 		return err
 	}
 
-	buffer := make([]byte, 4)
-	binary.BigEndian.PutUint32(buffer, currentOffset)
-	if _, err := w.Write(buffer); err != nil {
-		return err
-	}
-
-	return nil
+	return tw.finish()
 }
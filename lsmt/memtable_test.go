@@ -1 +1,39 @@
 package lsmt
+
+import (
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestMemtableInsertBatch(t *testing.T) {
+	mt := NewMemtable()
+
+	entries := make([]*db.Entry, 0, 100)
+	for i := int64(0); i < 100; i++ {
+		entries = append(entries, &db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"test"}})
+	}
+
+	if err := mt.insertBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if mt.minKey != 0 || mt.maxKey != 99 {
+		t.Errorf("wrong key range: %d-%d", mt.minKey, mt.maxKey)
+	}
+
+	result, err := mt.getRange(20, 40, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectResult := make([]db.KV, 20)
+	for i := 20; i < 40; i++ {
+		expectResult[i-20] = db.KV{Key: int64(i), Value: int64(i)}
+	}
+
+	if !reflect.DeepEqual(expectResult, result) {
+		t.Errorf("expect %v, got %v\n", expectResult, result)
+	}
+}
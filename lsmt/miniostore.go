@@ -0,0 +1,190 @@
+package lsmt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type RemoteOption struct {
+	Endpoint string
+	Creds    *credentials.Credentials
+	UseSSL   bool
+
+	BucketName string
+}
+
+// NewRemoteOption resolves the credentials of the MinIO server of the option,
+// a missing or partial configuration is an error.
+func NewRemoteOption(o *Option) (*RemoteOption, error) {
+	if len(o.MinioEndpoint) == 0 {
+		return nil, errors.New("missing minio endpoint")
+	}
+
+	if (len(o.MinioAccessKeyID) == 0) != (len(o.MinioSecretAccessKey) == 0) {
+		return nil, errors.New("MinioAccessKeyID and MinioSecretAccessKey must be set together")
+	}
+
+	if len(o.MinioCredentialsFile) != 0 {
+		if _, err := os.Stat(o.MinioCredentialsFile); err != nil {
+			return nil, fmt.Errorf("failed to read the minio credentials file: %w", err)
+		}
+	}
+
+	creds := o.MinioCredentials
+	if creds == nil {
+		creds = credentials.NewChainCredentials(credentialProviders(o))
+	}
+
+	// The chain falls back to anonymous access, which can't create a bucket.
+	value, err := creds.Get()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the minio credentials: %w", err)
+	}
+
+	if value.SignerType.IsAnonymous() || len(value.AccessKeyID) == 0 {
+		return nil, fmt.Errorf("no credentials found for the minio server %s", o.MinioEndpoint)
+	}
+
+	return &RemoteOption{
+		Endpoint:   o.MinioEndpoint,
+		Creds:      creds,
+		UseSSL:     o.MinioUseSSL,
+		BucketName: o.uuid.String(),
+	}, nil
+}
+
+// iamTimeout bounds the requests to the metadata endpoint of the host.
+const iamTimeout = 2 * time.Second
+
+// credentialProviders returns the providers of the credentials lookup of the
+// option, see Option.MinioAccessKeyID.
+func credentialProviders(o *Option) []credentials.Provider {
+	return []credentials.Provider{
+		&credentials.Static{Value: credentials.Value{
+			AccessKeyID:     o.MinioAccessKeyID,
+			SecretAccessKey: o.MinioSecretAccessKey,
+			SignerType:      credentials.SignatureV4,
+		}},
+		&credentials.EnvMinio{},
+		&credentials.EnvAWS{},
+		&credentials.FileAWSCredentials{Filename: o.MinioCredentialsFile, Profile: o.MinioCredentialsProfile},
+		&credentials.FileMinioClient{},
+		// The metadata endpoint isn't reachable off the cloud, the probe gives
+		// up quickly so opening the store doesn't hang.
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport, Timeout: iamTimeout}},
+	}
+}
+
+// minioStore keeps the objects in a bucket of a MinIO or S3 server.
+type minioStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewMinioStore connects to the server of the option and creates the bucket
+// if it doesn't exist.
+func NewMinioStore(option *RemoteOption) (ObjectStore, error) {
+	return newMinioStore(option)
+}
+
+func newMinioStore(option *RemoteOption) (*minioStore, error) {
+	// Initialize minio client object.
+	client, err := minio.New(option.Endpoint, &minio.Options{
+		Creds:  option.Creds,
+		Secure: option.UseSSL,
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid minio endpoint %s: %w", option.Endpoint, err)
+	}
+
+	ctx := context.Background()
+
+	err = client.MakeBucket(ctx, option.BucketName, minio.MakeBucketOptions{})
+	if err != nil {
+		// Check to see if we already own this bucket (which happens if you run this twice)
+		exists, errBucketExists := client.BucketExists(ctx, option.BucketName)
+		if errBucketExists == nil && exists {
+			log.Printf("We already own %s\n", option.BucketName)
+		} else {
+			return nil, fmt.Errorf("failed to create the bucket %s on %s: %w", option.BucketName, option.Endpoint, err)
+		}
+	} else {
+		log.Printf("Successfully created %s\n", option.BucketName)
+	}
+
+	return &minioStore{client: client, bucket: option.BucketName}, nil
+}
+
+// minioError maps the missing objects to ErrObjectNotFound.
+func minioError(name string, err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+	}
+
+	return err
+}
+
+func (m *minioStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	_, err := m.client.PutObject(ctx, m.bucket, name, r, size, minio.PutObjectOptions{})
+	return err
+}
+
+func (m *minioStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return m.get(ctx, name, minio.GetObjectOptions{})
+}
+
+func (m *minioStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+
+	return m.get(ctx, name, opts)
+}
+
+// get stats the object, GetObject only fails on the first read.
+func (m *minioStore) get(ctx context.Context, name string, opts minio.GetObjectOptions) (io.ReadCloser, error) {
+	object, err := m.client.GetObject(ctx, m.bucket, name, opts)
+	if err != nil {
+		return nil, minioError(name, err)
+	}
+
+	if _, err := object.Stat(); err != nil {
+		object.Close()
+		return nil, minioError(name, err)
+	}
+
+	return object, nil
+}
+
+func (m *minioStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	objects := []ObjectInfo{}
+	for object := range m.client.ListObjects(ctx, m.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+
+		objects = append(objects, ObjectInfo{Name: object.Key, Size: object.Size})
+	}
+
+	return objects, nil
+}
+
+func (m *minioStore) Delete(ctx context.Context, name string) error {
+	return m.client.RemoveObject(ctx, m.bucket, name, minio.RemoveObjectOptions{})
+}
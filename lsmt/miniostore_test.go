@@ -0,0 +1,96 @@
+package lsmt
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+func TestRemoteOption(t *testing.T) {
+	for _, key := range []string{
+		"MINIO_ROOT_USER", "MINIO_ROOT_PASSWORD", "MINIO_ACCESS_KEY", "MINIO_SECRET_KEY",
+		"AWS_ACCESS_KEY_ID", "AWS_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY", "AWS_SECRET_KEY",
+	} {
+		t.Setenv(key, "")
+	}
+
+	static := &Option{MinioEndpoint: "localhost:9000", MinioAccessKeyID: "id", MinioSecretAccessKey: "secret"}
+	remoteOption, err := NewRemoteOption(static)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := remoteOption.Creds.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value.AccessKeyID != "id" || value.SecretAccessKey != "secret" {
+		t.Errorf("expect the static credentials, got %s:%s", value.AccessKeyID, value.SecretAccessKey)
+	}
+
+	if _, err := NewRemoteOption(&Option{MinioEndpoint: "localhost:9000", MinioAccessKeyID: "id"}); err == nil {
+		t.Error("expect an error for a key without its secret")
+	}
+
+	t.Setenv("MINIO_ACCESS_KEY", "env-id")
+	t.Setenv("MINIO_SECRET_KEY", "env-secret")
+	if remoteOption, err = NewRemoteOption(&Option{MinioEndpoint: "localhost:9000"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := remoteOption.Creds.Get(); value.AccessKeyID != "env-id" || value.SecretAccessKey != "env-secret" {
+		t.Errorf("expect the environment credentials, got %s:%s", value.AccessKeyID, value.SecretAccessKey)
+	}
+	t.Setenv("MINIO_ACCESS_KEY", "")
+	t.Setenv("MINIO_SECRET_KEY", "")
+
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	file := path.Join(testOption.WorkDir, "credentials")
+	content := "[pangolin]\naws_access_key_id = file-id\naws_secret_access_key = file-secret\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Option{MinioEndpoint: "localhost:9000", MinioCredentialsFile: file, MinioCredentialsProfile: "pangolin"}
+	if remoteOption, err = NewRemoteOption(o); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := remoteOption.Creds.Get(); value.AccessKeyID != "file-id" || value.SecretAccessKey != "file-secret" {
+		t.Errorf("expect the file credentials, got %s:%s", value.AccessKeyID, value.SecretAccessKey)
+	}
+
+	o.MinioCredentialsFile = path.Join(testOption.WorkDir, "missing")
+	if _, err := NewRemoteOption(o); err == nil {
+		t.Error("expect an error for a missing credentials file")
+	}
+}
+
+func TestOpenObjectStore(t *testing.T) {
+	store, err := openObjectStore(&Option{})
+	if err != nil || store != nil {
+		t.Errorf("expect no remote tier, got %v, %v", store, err)
+	}
+
+	if _, err := openObjectStore(&Option{MinioAccessKeyID: "id", MinioSecretAccessKey: "secret"}); err == nil {
+		t.Error("expect an error for credentials without an endpoint")
+	}
+
+	memory := NewMemoryStore()
+	if store, err := openObjectStore(&Option{ObjectStore: memory, MinioEndpoint: "localhost:9000"}); err != nil || store != memory {
+		t.Errorf("expect the object store of the option, got %v, %v", store, err)
+	}
+}
+
+func TestIAMTimeout(t *testing.T) {
+	for _, provider := range credentialProviders(&Option{}) {
+		if iam, ok := provider.(*credentials.IAM); ok && (iam.Client == nil || iam.Client.Timeout == 0) {
+			t.Error("expect the IAM probe to time out")
+		}
+	}
+}
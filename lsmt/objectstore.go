@@ -0,0 +1,271 @@
+package lsmt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrObjectNotFound is returned by an ObjectStore reading a missing object.
+var ErrObjectNotFound = errors.New("object not found")
+
+// ObjectStore is the remote tier the files are uploaded to once they are
+// written, see Option.ObjectStore.
+type ObjectStore interface {
+	// Put writes the size bytes of r as the object name, replacing it.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Get reads the whole object.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// GetRange reads length bytes of the object from offset, fewer if the
+	// object ends first.
+	GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error)
+	// List returns the objects whose name starts with prefix, sorted by name.
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+	// Delete removes the object, deleting a missing object isn't an error.
+	Delete(ctx context.Context, name string) error
+}
+
+type ObjectInfo struct {
+	Name string
+	Size int64
+}
+
+// openObjectStore returns the remote tier of the option, nil if the files are
+// only kept on the local disk.
+func openObjectStore(o *Option) (ObjectStore, error) {
+	if o.ObjectStore != nil {
+		return o.ObjectStore, nil
+	}
+
+	if len(o.MinioEndpoint) == 0 {
+		if len(o.MinioAccessKeyID) != 0 || o.MinioCredentials != nil || len(o.MinioCredentialsFile) != 0 {
+			return nil, errors.New("minio credentials are set without MinioEndpoint")
+		}
+
+		return nil, nil
+	}
+
+	remoteOption, err := NewRemoteOption(o)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMinioStore(remoteOption)
+}
+
+// memoryStore keeps the objects in memory, they are lost when the process
+// exits.
+type memoryStore struct {
+	mutex   sync.RWMutex
+	objects map[string][]byte
+}
+
+func NewMemoryStore() ObjectStore {
+	return &memoryStore{objects: map[string][]byte{}}
+}
+
+func (m *memoryStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+
+	if int64(len(data)) != size {
+		return fmt.Errorf("failed to put %s: %w", name, io.ErrUnexpectedEOF)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.objects[name] = data
+	return nil
+}
+
+func (m *memoryStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return m.GetRange(ctx, name, 0, -1)
+}
+
+func (m *memoryStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	m.mutex.RLock()
+	data, ok := m.objects[name]
+	m.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+	}
+
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	data = data[offset:]
+
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+
+	// The objects are never modified, Put replaces them.
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	objects := []ObjectInfo{}
+	for name, data := range m.objects {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, ObjectInfo{Name: name, Size: int64(len(data))})
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+func (m *memoryStore) Delete(ctx context.Context, name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.objects, name)
+	return nil
+}
+
+// fileStore keeps the objects as the files of a local directory, which may
+// be a mounted network filesystem.
+type fileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (ObjectStore, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create the object directory %s: %w", dir, err)
+	}
+
+	return &fileStore{dir: dir}, nil
+}
+
+func (f *fileStore) path(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, '/') || strings.HasSuffix(name, tmpFileSuffix) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+
+	return path.Join(f.dir, name), nil
+}
+
+// Put writes the object through a temporary file, so a reader never sees a
+// partial object.
+func (f *fileStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := p + tmpFileSuffix
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(file, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to put %s: %w", name, err)
+	}
+
+	return os.Rename(tmpPath, p)
+}
+
+func (f *fileStore) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	p, err := f.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", name, ErrObjectNotFound)
+	}
+
+	return file, err
+}
+
+type limitedFile struct {
+	io.Reader
+	file *os.File
+}
+
+func (l *limitedFile) Close() error {
+	return l.file.Close()
+}
+
+func (f *fileStore) GetRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	rc, err := f.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	file := rc.(*os.File)
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &limitedFile{Reader: io.LimitReader(file, length), file: file}, nil
+}
+
+func (f *fileStore) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries are sorted by name.
+	objects := []ObjectInfo{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || strings.HasSuffix(name, tmpFileSuffix) {
+			continue
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, ObjectInfo{Name: name, Size: info.Size()})
+	}
+
+	return objects, nil
+}
+
+func (f *fileStore) Delete(ctx context.Context, name string) error {
+	p, err := f.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package lsmt
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testObjectStore checks the operations of a store, which must not hold
+// objects starting with "test-".
+func testObjectStore(t *testing.T, store ObjectStore) {
+	ctx := context.Background()
+	objects := map[string]string{
+		"test-a": "hello world",
+		"test-b": "pangolin",
+		"test-c": "",
+	}
+
+	for name, data := range objects {
+		if err := store.Put(ctx, name, strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := func(rc io.ReadCloser, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+
+		data, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(data)
+	}
+
+	for name, data := range objects {
+		if got := read(store.Get(ctx, name)); got != data {
+			t.Errorf("expect %s to hold %q, got %q", name, data, got)
+		}
+	}
+
+	if got := read(store.GetRange(ctx, "test-a", 6, 5)); got != "world" {
+		t.Errorf("expect %q, got %q", "world", got)
+	}
+
+	if got := read(store.GetRange(ctx, "test-a", 6, 100)); got != "world" {
+		t.Errorf("expect a range past the end to be cut, got %q", got)
+	}
+
+	if _, err := store.Get(ctx, "test-missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expect %v, got %v", ErrObjectNotFound, err)
+	}
+
+	// Put replaces the object.
+	if err := store.Put(ctx, "test-b", bytes.NewReader([]byte("lsm")), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := read(store.Get(ctx, "test-b")); got != "lsm" {
+		t.Errorf("expect the object to be replaced, got %q", got)
+	}
+
+	list, err := store.List(ctx, "test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []ObjectInfo{{Name: "test-a", Size: 11}, {Name: "test-b", Size: 3}, {Name: "test-c", Size: 0}}
+	if !reflect.DeepEqual(list, expect) {
+		t.Errorf("expect %v, got %v", expect, list)
+	}
+
+	for name := range objects {
+		if err := store.Delete(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Delete(ctx, "test-a"); err != nil {
+		t.Errorf("expect deleting a missing object to succeed, got %v", err)
+	}
+
+	if list, err := store.List(ctx, "test-"); err != nil || len(list) != 0 {
+		t.Errorf("expect no objects, got %v, %v", list, err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testObjectStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir := path.Join(testOption.WorkDir, "objects")
+	defer os.RemoveAll(testOption.WorkDir)
+
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testObjectStore(t, store)
+
+	// A short reader leaves no object behind.
+	if err := store.Put(context.Background(), "test-short", strings.NewReader("abc"), 10); err == nil {
+		t.Error("expect an error for a short reader")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expect an empty directory, got %d entries", len(entries))
+	}
+}
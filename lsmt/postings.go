@@ -0,0 +1,417 @@
+package lsmt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	db "github.com/dovics/pangolin"
+)
+
+// The series index is a log of the series of the database in WorkDir, every
+// record assigns the next ID to a series key the first time it is recorded and
+// marks the series as holding points of the type. The postings lists mapping
+// the label pairs to the series IDs are rebuilt from it on load. The records
+// written before the types were recorded have no type, their series may hold
+// points of any type.
+//
+// +-------------+-------------+-------------+-------------+-----+
+// |             |             |             |             |     |
+// |  seriesKey  |  valueType  |  seriesKey  |  valueType  | ... |
+// |             |             |             |             |     |
+// +-------------+-------------+-------------+-------------+-----+
+
+const seriesIndexName = "SERIES"
+
+// anyType marks a series which may hold points of any type.
+const anyType = 1<<db.TypeCount - 1
+
+// seriesType is a series holding points of the type.
+type seriesType struct {
+	key string
+	t   db.ValueType
+}
+
+type seriesIndex struct {
+	mutex sync.RWMutex
+	file  *os.File
+
+	ids  map[string]uint64
+	keys []string
+
+	// types holds a bit for every type of the points of a series, by ID.
+	types []uint32
+
+	// postings maps a label name and value to the sorted IDs of the series
+	// with the label, the metric is the label db.MetricLabel.
+	postings map[string]map[string][]uint64
+}
+
+// openSeriesIndex loads the series index of dir, the returned bool reports
+// whether it existed. A torn tail left by a crash is truncated.
+func openSeriesIndex(dir string) (*seriesIndex, bool, error) {
+	x := &seriesIndex{
+		ids:      map[string]uint64{},
+		postings: map[string]map[string][]uint64{},
+	}
+
+	p := path.Join(dir, seriesIndexName)
+	existed := true
+	if file, err := os.Open(p); os.IsNotExist(err) {
+		existed = false
+	} else if err != nil {
+		return nil, false, fmt.Errorf("failed to open file %s: %w", p, err)
+	} else {
+		valid, err := readFramed(bufio.NewReader(file), func(payload []byte) error {
+			key, rest, err := readString(payload)
+			if err != nil {
+				return err
+			}
+
+			var types uint32 = anyType
+			if len(rest) > 0 {
+				if db.ValueType(rest[0]) >= db.TypeCount {
+					return errWALCorrupt
+				}
+				types = 1 << rest[0]
+			}
+
+			return x.register(key, types)
+		})
+		file.Close()
+
+		if err != nil {
+			if !errors.Is(err, errWALCorrupt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, false, err
+			}
+
+			log.Printf("truncate series index %s at %d: %v\n", p, valid, err)
+			if err := os.Truncate(p, valid); err != nil {
+				return nil, false, fmt.Errorf("failed to truncate the series index %s: %w", p, err)
+			}
+		}
+	}
+
+	file, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to open the series index: %w", err)
+	}
+
+	x.file = file
+	return x, existed, nil
+}
+
+// register marks the series as holding points of the types, a new series is
+// assigned the next ID and added to the postings.
+func (x *seriesIndex) register(key string, types uint32) error {
+	if id, ok := x.ids[key]; ok {
+		x.types[id] |= types
+		return nil
+	}
+
+	metric, labels, err := db.ParseSeriesKey(key)
+	if err != nil {
+		return err
+	}
+
+	id := uint64(len(x.keys))
+	x.ids[key] = id
+	x.keys = append(x.keys, key)
+	x.types = append(x.types, types)
+
+	if metric != "" {
+		x.addPosting(db.MetricLabel, metric, id)
+	}
+	for name, value := range labels {
+		x.addPosting(name, value, id)
+	}
+
+	return nil
+}
+
+func (x *seriesIndex) addPosting(name, value string, id uint64) {
+	values, ok := x.postings[name]
+	if !ok {
+		values = map[string][]uint64{}
+		x.postings[name] = values
+	}
+
+	values[value] = append(values[value], id)
+}
+
+// add records the series and types which aren't indexed yet.
+func (x *seriesIndex) add(series ...seriesType) error {
+	x.mutex.RLock()
+	missing := false
+	for _, st := range series {
+		if !x.hasLocked(st) {
+			missing = true
+			break
+		}
+	}
+	x.mutex.RUnlock()
+
+	if !missing {
+		return nil
+	}
+
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	var records []byte
+	for _, st := range series {
+		if x.hasLocked(st) {
+			continue
+		}
+
+		var err error
+		records, err = appendFramed(records, func(dst []byte) ([]byte, error) {
+			return append(appendString(dst, st.key), byte(st.t)), nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := x.register(st.key, 1<<st.t); err != nil {
+			return err
+		}
+	}
+
+	if len(records) == 0 {
+		return nil
+	}
+
+	if _, err := x.file.Write(records); err != nil {
+		return fmt.Errorf("failed to write the series index: %w", err)
+	}
+
+	if err := x.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the series index: %w", err)
+	}
+
+	return nil
+}
+
+// match returns the sorted keys of the series matching the label matchers of
+// the filter, or nil if the filter has none and every series matches.
+func (x *seriesIndex) match(filter *db.QueryFilter) []string {
+	if filter == nil {
+		return nil
+	}
+
+	matchers := filter.LabelMatchers()
+	if len(matchers) == 0 {
+		return nil
+	}
+
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	// The matchers which can't match a missing label select the series from
+	// their postings, the others exclude the series of the values they don't
+	// match.
+	var (
+		ids     []uint64
+		started bool
+	)
+	excluded := [][]uint64{}
+	for _, m := range matchers {
+		values := x.postings[m.Name]
+		if m.Matches("", false) {
+			lists := [][]uint64{}
+			for value, list := range values {
+				if !m.Matches(value, true) {
+					lists = append(lists, list)
+				}
+			}
+
+			excluded = append(excluded, union(lists))
+			continue
+		}
+
+		lists := [][]uint64{}
+		for value, list := range values {
+			if m.Matches(value, true) {
+				lists = append(lists, list)
+			}
+		}
+
+		if !started {
+			ids, started = union(lists), true
+		} else {
+			ids = intersect(ids, union(lists))
+		}
+	}
+
+	if !started {
+		ids = make([]uint64, len(x.keys))
+		for i := range ids {
+			ids[i] = uint64(i)
+		}
+	}
+
+	for _, list := range excluded {
+		ids = subtract(ids, list)
+	}
+
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = x.keys[id]
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (x *seriesIndex) hasLocked(st seriesType) bool {
+	id, ok := x.ids[st.key]
+	return ok && x.types[id]&(1<<st.t) != 0
+}
+
+// typed returns the series and types of the keys, only of type t unless it is
+// db.UnknownType.
+func (x *seriesIndex) typed(keys []string, t db.ValueType) []seriesType {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	result := []seriesType{}
+	for _, key := range keys {
+		id, ok := x.ids[key]
+		if !ok {
+			continue
+		}
+
+		for vt := db.ValueType(0); vt < db.TypeCount; vt++ {
+			if (t == db.UnknownType || t == vt) && x.types[id]&(1<<vt) != 0 {
+				result = append(result, seriesType{key: key, t: vt})
+			}
+		}
+	}
+
+	return result
+}
+
+// all returns the sorted keys of every series.
+func (x *seriesIndex) all() []string {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	keys := append([]string(nil), x.keys...)
+	sort.Strings(keys)
+	return keys
+}
+
+func (x *seriesIndex) Close() error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.file == nil {
+		return nil
+	}
+
+	file := x.file
+	x.file = nil
+	return file.Close()
+}
+
+func union(lists [][]uint64) []uint64 {
+	if len(lists) == 1 {
+		return lists[0]
+	}
+
+	result := []uint64{}
+	for _, list := range lists {
+		result = append(result, list...)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+
+	n := 0
+	for i, id := range result {
+		if i == 0 || id != result[n-1] {
+			result[n] = id
+			n++
+		}
+	}
+
+	return result[:n]
+}
+
+func intersect(a, b []uint64) []uint64 {
+	result := []uint64{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+
+	return result
+}
+
+func subtract(a, b []uint64) []uint64 {
+	result := []uint64{}
+	j := 0
+	for _, id := range a {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+
+		if j < len(b) && b[j] == id {
+			continue
+		}
+
+		result = append(result, id)
+	}
+
+	return result
+}
+
+func (m *memtable) seriesKeys() []seriesType {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	keys := []seriesType{}
+	for t, indexMap := range m.blocks {
+		for key := range indexMap {
+			keys = append(keys, seriesType{key: key, t: db.ValueType(t)})
+		}
+	}
+
+	return keys
+}
+
+func (d *disktable) seriesKeys() ([]seriesType, error) {
+	d.mutex.Lock()
+	files := append([]*diskFile(nil), d.files...)
+	d.mutex.Unlock()
+
+	keys := []seriesType{}
+	for _, file := range files {
+		indexes, _, err := file.loadIndexes(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		for t, indexMap := range indexes {
+			for key := range indexMap {
+				keys = append(keys, seriesType{key: key, t: db.ValueType(t)})
+			}
+		}
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,115 @@
+package lsmt
+
+import (
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestSeriesIndex(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	x, existed, err := openSeriesIndex(testOption.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if existed {
+		t.Error("expect a new series index")
+	}
+
+	a := db.SeriesKey("cpu", map[string]string{"host": "a", "region": "eu"})
+	b := db.SeriesKey("cpu", map[string]string{"host": "b"})
+	c := db.SeriesKey("mem", map[string]string{"host": "a", "region": "us"})
+	if err := x.add(seriesType{a, db.IntType}, seriesType{b, db.IntType}, seriesType{a, db.FloatType}); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.add(seriesType{c, db.StringType}); err != nil {
+		t.Fatal(err)
+	}
+	x.Close()
+
+	// A torn tail is truncated.
+	file, err := os.OpenFile(path.Join(testOption.WorkDir, seriesIndexName), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{1, 2, 3})
+	file.Close()
+
+	x, existed, err = openSeriesIndex(testOption.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer x.Close()
+
+	if !existed || len(x.keys) != 3 {
+		t.Fatalf("expect 3 series, got %v", x.keys)
+	}
+
+	cases := []struct {
+		matchers []*db.Matcher
+		expect   []string
+	}{
+		{[]*db.Matcher{db.MustNewMatcher(db.MatchEqual, db.MetricLabel, "cpu")}, []string{a, b}},
+		{[]*db.Matcher{db.MustNewMatcher(db.MatchEqual, "host", "a")}, []string{a, c}},
+		{[]*db.Matcher{db.MustNewMatcher(db.MatchEqual, "host", "a"), db.MustNewMatcher(db.MatchRegexp, "region", "u.*")}, []string{c}},
+		{[]*db.Matcher{db.MustNewMatcher(db.MatchNotEqual, "region", "eu")}, []string{b, c}},
+		{[]*db.Matcher{db.MustNewMatcher(db.MatchNotRegexp, db.MetricLabel, "c.*")}, []string{c}},
+		{[]*db.Matcher{db.MustNewMatcher(db.MatchEqual, "host", "c")}, []string{}},
+	}
+
+	for _, tc := range cases {
+		result := x.match(&db.QueryFilter{Matchers: tc.matchers})
+		if !reflect.DeepEqual(result, tc.expect) {
+			t.Errorf("%v: expect %v, got %v", tc.matchers, tc.expect, result)
+		}
+	}
+
+	if result := x.match(&db.QueryFilter{Type: db.IntType}); result != nil {
+		t.Errorf("expect every series, got %v", result)
+	}
+
+	// The types of the series are indexed too.
+	expect := []seriesType{{a, db.IntType}, {a, db.FloatType}, {b, db.IntType}, {c, db.StringType}}
+	if result := x.typed([]string{a, b, c}, db.UnknownType); !reflect.DeepEqual(result, expect) {
+		t.Errorf("expect %v, got %v", expect, result)
+	}
+
+	if result := x.typed([]string{a, b, c}, db.FloatType); !reflect.DeepEqual(result, expect[1:2]) {
+		t.Errorf("expect %v, got %v", expect[1:2], result)
+	}
+}
+
+func TestSeriesSources(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	mt := NewMemtable()
+	for i := int64(0); i < 10; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "a"}})
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: map[string]string{"host": "b"}})
+	}
+	dt.flush(mt)
+
+	series := []string{db.SeriesKey("cpu", map[string]string{"host": "b"})}
+	result, err := db.Collect(newIterator(context.Background(), dt.newSeriesSources(context.Background(), 0, 10, nil, series)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 10 {
+		t.Errorf("expect 10 results, got %d", len(result))
+	}
+}
@@ -2,137 +2,106 @@ package lsmt
 
 import (
 	"context"
-	"fmt"
-	"io/ioutil"
+	"errors"
+	"io"
 	"os"
 	"path"
 	"reflect"
-	"strconv"
 	"testing"
-	"time"
 
 	db "github.com/dovics/pangolin"
 )
 
-func (rt *remotetable) prepare(start, end int64) {
-	if _, err := os.Stat(rt.option.WorkDir); os.IsNotExist(err) {
-		if err := os.Mkdir(rt.option.WorkDir, 0750); err != nil {
-			panic(err)
-		}
+// TestMinioStore runs against the MinIO server of PANGOLIN_MINIO_ENDPOINT, its
+// credentials are looked up like those of Option, e.g. from MINIO_ROOT_USER
+// and MINIO_ROOT_PASSWORD.
+func TestMinioStore(t *testing.T) {
+	endpoint := os.Getenv("PANGOLIN_MINIO_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("PANGOLIN_MINIO_ENDPOINT isn't set")
 	}
 
-	rt.dt.prepare(start, end)
-
-	if err := rt.upload(path.Join(rt.option.WorkDir, fmt.Sprintf("%d-%d", start, end))); err != nil {
-		panic(err)
-	}
-}
-
-func TestNewRemoteTable(t *testing.T) {
-	remoteOption, err := NewRemoteOption(testOption)
+	remoteOption, err := NewRemoteOption(&Option{MinioEndpoint: endpoint})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	rt, err := NewRemoteTable(remoteOption, nil)
+	store, err := newMinioStore(remoteOption)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if err := rt.client.RemoveBucket(context.Background(), rt.option.BucketName); err != nil {
-		t.Fatal(err)
-	}
-}
-
-func TestUploadAndDownload(t *testing.T) {
-	remoteOption, err := NewRemoteOption(testOption)
-	if err != nil {
-		t.Fatal(err)
-	}
+	testObjectStore(t, store)
 
-	rt, err := NewRemoteTable(remoteOption, nil)
-	if err != nil {
+	if err := store.client.RemoveBucket(context.Background(), store.bucket); err != nil {
 		t.Fatal(err)
 	}
+}
 
-	defer func() {
-		if err := rt.client.RemoveBucketReplication(context.Background(), rt.option.BucketName); err != nil {
-			t.Fatal(err)
-		}
-	}()
+func TestUpload(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
 
-	tempFileName := "test_temp"
-	file, err := os.Create(tempFileName)
-	if err != nil {
-		t.Fatal(err)
-	}
+	store := NewMemoryStore()
+	rt := NewRemoteTable(store, testOption.WorkDir)
 
+	p := path.Join(testOption.WorkDir, "test_temp")
 	fileContent := []byte("hello world")
-	if _, err := file.Write(fileContent); err != nil {
-		t.Fatal(err)
-	}
-
-	if err := file.Close(); err != nil {
+	if err := os.WriteFile(p, fileContent, 0600); err != nil {
 		t.Fatal(err)
 	}
 
-	defer func() {
-		if err := os.Remove(tempFileName); err != nil {
-			t.Fatal(err)
-		}
-	}()
-
-	if err := rt.upload(tempFileName); err != nil {
+	if err := rt.upload(context.Background(), p); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := rt.download(tempFileName); err != nil {
+	object, err := store.Get(context.Background(), "test_temp")
+	if err != nil {
 		t.Fatal(err)
 	}
+	defer object.Close()
 
-	defer func() {
-		if err := os.RemoveAll(rt.option.WorkDir); err != nil {
-			t.Fatal(err)
-		}
-	}()
-
-	buffer, err := ioutil.ReadFile(path.Join(rt.option.WorkDir, tempFileName))
+	buffer, err := io.ReadAll(object)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	if !reflect.DeepEqual(buffer, fileContent) {
-		t.Error(err)
+		t.Errorf("expect %q, got %q", fileContent, buffer)
+	}
+
+	if err := rt.upload(context.Background(), path.Join(testOption.WorkDir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expect %v, got %v", os.ErrNotExist, err)
 	}
 }
 
 func TestGetRange(t *testing.T) {
 	os.Mkdir(testOption.WorkDir, 0750)
 	defer os.RemoveAll(testOption.WorkDir)
-	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
-	if err != nil {
-		panic(err)
-	}
-
-	remoteOption, err := NewRemoteOption(testOption)
+	dt, err := NewDiskTable(testOption.WorkDir, 1)
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer dt.Close()
 
-	rt, err := NewRemoteTable(remoteOption, dt)
-	if err != nil {
+	store := NewMemoryStore()
+	rt := NewRemoteTable(store, testOption.WorkDir)
+	dt.remote = newBlockCache(store, 0)
+
+	dt.prepare(0, 1000)
+	p := path.Join(testOption.WorkDir, "0-1000")
+	if err := rt.upload(context.Background(), p); err != nil {
 		t.Fatal(err)
 	}
+	dt.uploaded(p)
 
-	defer func() {
-		if err := rt.client.RemoveBucketReplication(context.Background(), rt.option.BucketName); err != nil {
-			t.Fatal(err)
-		}
-	}()
-
-	rt.prepare(0, 1000)
+	// The next file evicts the uploaded one from the local disk.
+	dt.prepare(1000, 2000)
+	if _, err := os.Stat(p); !os.IsNotExist(err) {
+		t.Fatalf("expect the local copy to be removed, got %v", err)
+	}
 
-	result, err := rt.getRange(20, 40, nil)
+	result, err := dt.getRange(20, 40, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -146,16 +115,3 @@ func TestGetRange(t *testing.T) {
 		t.Errorf("expect %v, got %v\n", expectResult, result)
 	}
 }
-
-func TestParseObjectKey(t *testing.T) {
-	start, end := time.Now().UnixMicro(), time.Now().UnixMicro()
-	key := strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10)
-	file, err := parseObjectKey(key)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if file.end != end || file.start != start {
-		t.Errorf("wrong parse result, expect: start(%d) end(%d), got start(%d) end(%d)\n", start, end, file.end, file.start)
-	}
-}
@@ -1,16 +1,20 @@
 package lsmt
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path"
-	"strconv"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	db "github.com/dovics/pangolin"
 	"github.com/dovics/pangolin/compress"
 	"github.com/google/uuid"
+	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
 func init() {
@@ -25,181 +29,557 @@ func init() {
 		}
 
 		option.uuid = uuid
-
-		if _, err := os.Stat(option.WorkDir); os.IsNotExist(err) {
-			if err := os.Mkdir(option.WorkDir, 0750); err != nil {
-				return nil, err
-			}
-		}
-
-		wal, err := NewWAL(option.WalPath)
-		if err != nil {
-			return nil, err
-		}
-
-		mt, err := wal.Load()
-		if err != nil {
-			return nil, err
-		}
-
-		dt, err := NewDiskTable(option.WorkDir, option.DiskfileCount)
-		if err != nil {
-			return nil, err
-		}
-
-		remoteOption, err := NewRemoteOption(option)
-		if err != nil {
-			return nil, err
-		}
-
-		rt, err := NewRemoteTable(remoteOption, dt)
-		if err != nil {
-			return nil, err
-		}
-
-		s := &Storage{
-			option: option,
-			mem:    mt,
-			disk:   dt,
-			remote: rt,
-		}
-
-		return s, nil
+		return NewStorage(option)
 	})
 }
 
+// Durability controls when the WAL is committed to stable storage.
+type Durability int
+
+const (
+	// SyncEveryWrite fsyncs the WAL before every Insert returns.
+	SyncEveryWrite Durability = iota
+	// SyncGroupCommit fsyncs the WAL every SyncInterval, a crash loses at
+	// most the writes of the last interval.
+	SyncGroupCommit
+	// SyncOS leaves the WAL in the OS buffers and never fsyncs it explicitly.
+	SyncOS
+)
+
+var defaultSyncInterval = 10 * time.Millisecond
+
 type Option struct {
 	uuid           uuid.UUID
 	WorkDir        string
 	WalPath        string
+	WalSegmentSize int64
 	CompressEnable bool
 	MemtableSize   uint64
 	DiskfileCount  int
 
-	MinioEndpoint        string
+	Durability   Durability
+	SyncInterval time.Duration
+
+	// CompactionInterval is how often the compactor looks for files to
+	// merge, zero disables the compaction.
+	CompactionInterval time.Duration
+	// CompactionMinFiles is the number of small files which triggers a
+	// compaction.
+	CompactionMinFiles int
+	// CompactionFileSize is the size under which a file is merged.
+	CompactionFileSize int64
+	// CompactionWindow partitions the merged files by key, zero writes a
+	// single file.
+	CompactionWindow int64
+	// CompactionRateLimit caps the bytes written per second by the
+	// compactor, zero means unlimited.
+	CompactionRateLimit int64
+
+	// ObjectStore is the remote tier the files are uploaded to, see
+	// NewFileStore and NewMemoryStore. The bucket of the MinIO server below
+	// is used if it is nil, the files are only kept on the local disk if
+	// MinioEndpoint is empty too.
+	ObjectStore ObjectStore
+
+	MinioEndpoint string
+	// The credentials of the MinIO server are looked up in order from the
+	// static keys, the MINIO_ROOT_USER, MINIO_ACCESS_KEY and AWS_ACCESS_KEY_ID
+	// environment variables, the AWS shared credentials file, the MinIO client
+	// config and the IAM role of the host.
 	MinioAccessKeyID     string
 	MinioSecretAccessKey string
-	MinioUseSSL          bool
+	// MinioCredentialsFile is the AWS shared credentials file, its profile is
+	// MinioCredentialsProfile. The file of AWS_SHARED_CREDENTIALS_FILE or
+	// ~/.aws/credentials is read if it is empty.
+	MinioCredentialsFile    string
+	MinioCredentialsProfile string
+	// MinioCredentials replaces the lookup above, for the other providers of
+	// minio-go.
+	MinioCredentials *credentials.Credentials
+	MinioUseSSL      bool
+
+	// RemoteCacheSize is the disk quota of the blocks read from the remote
+	// tier once the local copy of their file is evicted, see DiskfileCount.
+	// They are kept in WorkDir.
+	RemoteCacheSize int64
+	// RemoteMemoryCacheSize is the memory quota of the most recently read of
+	// these blocks.
+	RemoteMemoryCacheSize int64
+
+	// UploadRetryInterval is the delay before a failed upload to the remote
+	// tier is retried, it is doubled on every failure up to
+	// UploadRetryMaxInterval.
+	UploadRetryInterval    time.Duration
+	UploadRetryMaxInterval time.Duration
 }
 
 var DefaultOption *Option = &Option{
 	WorkDir:        "./lsm",
 	WalPath:        "./wal",
+	WalSegmentSize: defaultWalSegmentSize,
 	CompressEnable: true,
 	MemtableSize:   1024 * 1024,
 	DiskfileCount:  10,
 
-	MinioEndpoint:        "192.168.0.251:9000",
-	MinioAccessKeyID:     "wangrushen",
-	MinioSecretAccessKey: "wangrushen",
-	MinioUseSSL:          false,
+	Durability:   SyncGroupCommit,
+	SyncInterval: defaultSyncInterval,
+
+	CompactionInterval:  time.Minute,
+	CompactionMinFiles:  defaultCompactionMinFiles,
+	CompactionFileSize:  defaultCompactionFileSize,
+	CompactionRateLimit: 16 * 1024 * 1024,
+
+	RemoteCacheSize:       defaultRemoteCacheSize,
+	RemoteMemoryCacheSize: defaultRemoteMemoryCacheSize,
+
+	UploadRetryInterval:    defaultUploadRetryInterval,
+	UploadRetryMaxInterval: defaultUploadRetryMaxInterval,
 }
 
 type Storage struct {
 	option *Option
 
+	mutex      sync.RWMutex
 	isFlashing int32
+	// flashTable is the memtable being flushed, flashSeq the last WAL segment
+	// holding its entries.
 	flashTable *memtable
+	flashSeq   int
+
+	mem     *memtable
+	wal     *wal
+	disk    *disktable
+	remote  *remotetable
+	uploads *uploadQueue
+	series  *seriesIndex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// flushes counts the flushes started by the writes.
+	flushes sync.WaitGroup
+}
+
+func NewStorage(option *Option) (*Storage, error) {
+	if _, err := os.Stat(option.WorkDir); os.IsNotExist(err) {
+		if err := os.Mkdir(option.WorkDir, 0750); err != nil {
+			return nil, err
+		}
+	}
+
+	wal, err := NewWAL(option.WalPath, option.WalSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	mt, err := wal.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	dt, err := NewDiskTable(option.WorkDir, option.DiskfileCount)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := openObjectStore(option)
+	if err != nil {
+		return nil, err
+	}
+
+	var rt *remotetable
+	if store != nil {
+		rt = NewRemoteTable(store, option.WorkDir)
+		// An unreachable catalog is loaded again by its first update.
+		if err := rt.catalog.load(context.Background()); err != nil {
+			log.Println("catalog load error: ", err)
+		}
+
+		// The files evicted from the local disk are read through the cache.
+		dt.remote = newBlockCache(store, option.RemoteMemoryCacheSize)
+		if dt.remote.disk, err = newDiskBlockCache(path.Join(option.WorkDir, remoteCacheDir), option.RemoteCacheSize); err != nil {
+			return nil, err
+		}
+		dt.catalog = rt.catalog
+	}
+
+	dt.upgrade(context.Background())
+
+	series, existed, err := openSeriesIndex(option.WorkDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The series of the tables written before the series index are indexed
+	// once, the memtable replayed from the WAL may hold new ones.
+	keys := mt.seriesKeys()
+	if !existed {
+		diskKeys, err := dt.seriesKeys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, diskKeys...)
+	}
+
+	if err := series.add(keys...); err != nil {
+		return nil, err
+	}
 
-	mem    *memtable
-	disk   *disktable
-	remote *remotetable
+	s := &Storage{
+		option: option,
+		mem:    mt,
+		wal:    wal,
+		disk:   dt,
+		remote: rt,
+		series: series,
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+
+	if option.Durability == SyncGroupCommit {
+		s.wg.Add(1)
+		go s.syncLoop()
+	}
+
+	if option.CompactionInterval > 0 {
+		s.wg.Add(1)
+		go s.compactLoop()
+	}
+
+	if rt != nil {
+		// The files not uploaded or catalogued before the last shutdown are
+		// queued first.
+		s.uploads = newUploadQueue(rt, dt, option)
+		for _, p := range dt.pendingUploads() {
+			s.uploads.push(p)
+		}
+
+		for _, p := range dt.obsoleteUploads() {
+			s.uploads.pushRemove(p)
+		}
+
+		s.wg.Add(1)
+		go s.uploadLoop()
+	}
+
+	return s, nil
+}
+
+func (s *Storage) syncLoop() {
+	defer s.wg.Done()
+
+	interval := s.option.SyncInterval
+	if interval <= 0 {
+		interval = defaultSyncInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.wal.Sync(); err != nil {
+				log.Println("wal sync error: ", err)
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Storage) uploadLoop() {
+	defer s.wg.Done()
+	s.uploads.run(s.ctx)
+}
+
+// UploadStats returns the number of files waiting to be uploaded to the remote
+// tier, it is zero without a remote tier.
+func (s *Storage) UploadStats() UploadStats {
+	if s.uploads == nil {
+		return UploadStats{}
+	}
+
+	return s.uploads.stats()
 }
 
 func (s *Storage) Close() error {
+	s.flushes.Wait()
+	s.cancel()
+	s.wg.Wait()
+
+	if err := s.wal.Close(); err != nil {
+		return err
+	}
+
+	if err := s.series.Close(); err != nil {
+		return err
+	}
+
 	return s.disk.Close()
 }
 
 func (s *Storage) Insert(e *db.Entry) error {
-	if err := s.mem.insert(e); err != nil {
+	return s.InsertContext(context.Background(), e)
+}
+
+// InsertContext inserts the entry unless the context is done, the insert
+// isn't interrupted once the entry is written to the WAL.
+func (s *Storage) InsertContext(ctx context.Context, e *db.Entry) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	if err := s.series.add(seriesType{key: e.Index(), t: e.Type}); err != nil {
+		s.mutex.RUnlock()
+		return err
+	}
+
+	if err := s.wal.AppendEntry(*e); err != nil {
+		s.mutex.RUnlock()
+		return err
+	}
+
+	if s.option.Durability == SyncEveryWrite {
+		if err := s.wal.Sync(); err != nil {
+			s.mutex.RUnlock()
+			return err
+		}
+	}
+
+	err := s.mem.insert(e)
+	s.mutex.RUnlock()
+	if err != nil {
 		return err
 	}
 
-	go s.saveToFileIfNeeded()
+	s.flushIfNeeded()
 	return nil
 }
 
-func (s *Storage) GetRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
-	result := []db.KV{}
+func (s *Storage) InsertBatch(entries []*db.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
 
-	memResult, err := s.mem.getRange(startTime, endTime, filter)
-	if err != nil {
-		return nil, err
+	keys := make([]seriesType, len(entries))
+	for i, e := range entries {
+		keys[i] = seriesType{key: e.Index(), t: e.Type}
+	}
+
+	s.mutex.RLock()
+	if err := s.series.add(keys...); err != nil {
+		s.mutex.RUnlock()
+		return err
 	}
 
-	result = append(result, memResult...)
+	if err := s.wal.AppendEntries(entries); err != nil {
+		s.mutex.RUnlock()
+		return err
+	}
 
-	if s.flashTable != nil {
-		flashResult, err := s.flashTable.getRange(startTime, endTime, filter)
-		if err != nil {
-			return nil, err
+	if s.option.Durability == SyncEveryWrite {
+		if err := s.wal.Sync(); err != nil {
+			s.mutex.RUnlock()
+			return err
 		}
+	}
+
+	err := s.mem.insertBatch(entries)
+	s.mutex.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	s.flushIfNeeded()
+	return nil
+}
 
-		result = append(result, flashResult...)
+// DeleteRange records a tombstone for the points in [startTime, endTime) of
+// the series matching the filter. The tombstone is applied to the memtable at
+// once and hides the points of the older tables on reads.
+func (s *Storage) DeleteRange(startTime, endTime int64, filter *db.QueryFilter) error {
+	// An invalid matcher would be recorded in the tombstone.
+	if err := filter.Validate(); err != nil {
+		return err
 	}
 
-	diskResult, err := s.disk.getRange(startTime, endTime, filter)
+	t := newTombstone(startTime, endTime, filter)
+
+	s.mutex.RLock()
+	if err := s.wal.AppendTombstone(t); err != nil {
+		s.mutex.RUnlock()
+		return err
+	}
+
+	if s.option.Durability == SyncEveryWrite {
+		if err := s.wal.Sync(); err != nil {
+			s.mutex.RUnlock()
+			return err
+		}
+	}
+
+	s.mem.deleteRange(t)
+	s.mutex.RUnlock()
+
+	s.flushIfNeeded()
+	return nil
+}
+
+func (s *Storage) GetRange(startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+	return s.GetRangeContext(context.Background(), startTime, endTime, filter)
+}
+
+// GetRangeContext stops reading the tables once the context is done and
+// closes the files opened by the read.
+func (s *Storage) GetRangeContext(ctx context.Context, startTime, endTime int64, filter *db.QueryFilter) ([]db.KV, error) {
+	it, err := s.Query(ctx, db.QueryRequest{StartTime: startTime, EndTime: endTime, Filter: filter})
 	if err != nil {
 		return nil, err
 	}
 
-	result = append(result, diskResult...)
+	return db.Collect(it)
+}
+
+// Query streams the points from the memtable, the flushing table and the disk
+// files, only the block currently being read is held in memory. The series
+// matching the label matchers of the filter are looked up in the series index,
+// so the tables only read their blocks.
+func (s *Storage) Query(ctx context.Context, req db.QueryRequest) (db.Iterator, error) {
+	return s.query(ctx, req), nil
+}
 
-	return result, nil
+func (s *Storage) query(ctx context.Context, req db.QueryRequest) *iterator {
+	return newIterator(ctx, s.sources(ctx, req))
 }
 
-func (s *Storage) saveToFileIfNeeded() {
-	if s.mem.size < s.option.MemtableSize {
+// sources returns the sources of the query ordered from the newest. The files
+// evicted from the local disk are downloaded from the remote tier under ctx.
+func (s *Storage) sources(ctx context.Context, req db.QueryRequest) []source {
+	s.mutex.RLock()
+	mem, flashTable := s.mem, s.flashTable
+	s.mutex.RUnlock()
+
+	series := s.series.match(req.Filter)
+	sources := []source{mem.newSeriesSource(req.StartTime, req.EndTime, req.Filter, series)}
+	if flashTable != nil {
+		sources = append(sources, flashTable.newSeriesSource(req.StartTime, req.EndTime, req.Filter, series))
+	}
+
+	return append(sources, s.disk.newSeriesSources(ctx, req.StartTime, req.EndTime, req.Filter, series)...)
+}
+
+// flushIfNeeded flushes the memtable in the background once it is full, Close
+// waits for the flush.
+func (s *Storage) flushIfNeeded() {
+	s.mutex.RLock()
+	full := s.mem.bytes() >= s.option.MemtableSize || s.flashTable != nil
+	s.mutex.RUnlock()
+
+	if !full || atomic.LoadInt32(&s.isFlashing) != 0 {
 		return
 	}
 
+	s.flushes.Add(1)
+	go func() {
+		defer s.flushes.Done()
+		s.saveToFileIfNeeded()
+	}()
+}
+
+// saveToFileIfNeeded writes the memtable to a new file once it is full. A
+// table whose flush failed is kept with its WAL segments and written again by
+// the next call, before the memtable is swapped again.
+func (s *Storage) saveToFileIfNeeded() {
 	if !atomic.CompareAndSwapInt32(&s.isFlashing, 0, 1) {
 		return
 	}
 
-	s.flashTable, s.mem = s.mem, NewMemtable()
+	s.mutex.Lock()
+	if s.flashTable == nil {
+		if s.mem.bytes() < s.option.MemtableSize {
+			s.mutex.Unlock()
+			atomic.StoreInt32(&s.isFlashing, 0)
+			return
+		}
 
-	filePath := path.Join(s.option.WorkDir,
-		strconv.FormatInt(s.flashTable.minKey, 10)+"-"+strconv.FormatInt(s.flashTable.maxKey, 10))
-	log.Printf("save %s\n", filePath)
+		walSeq, err := s.wal.Rotate()
+		if err != nil {
+			s.mutex.Unlock()
+			atomic.StoreInt32(&s.isFlashing, 0)
+			log.Println("wal rotate error: ", err)
+			return
+		}
+
+		s.flashTable, s.flashSeq, s.mem = s.mem, walSeq, NewMemtable()
+	}
+	flashTable, walSeq := s.flashTable, s.flashSeq
+	s.mutex.Unlock()
 
-	file, err := os.Create(filePath)
+	filePath, err := s.writeFile(flashTable)
 	if err != nil {
-		log.Println("create file error: ", err)
+		atomic.StoreInt32(&s.isFlashing, 0)
+		log.Println("memtable flush error: ", err)
 		return
 	}
 
-	if err := s.flashTable.write(file); err != nil {
-		log.Println("memtable write error: ", err)
-		file.Close()
-		return
+	s.mutex.Lock()
+	s.flashTable = nil
+	s.mutex.Unlock()
+
+	if err := s.wal.RemoveSealed(walSeq); err != nil {
+		log.Println("wal remove error: ", err)
 	}
 
-	if err := file.Sync(); err != nil {
-		log.Println("file sync error: ", err)
-		file.Close()
-		return
+	atomic.StoreInt32(&s.isFlashing, 0)
+	if s.uploads != nil {
+		s.uploads.push(filePath)
+	}
+}
+
+// writeFile writes the table to a new file and adds it to the disk table, the
+// file is removed if it can't be added.
+func (s *Storage) writeFile(mt *memtable) (string, error) {
+	name := s.disk.nextFileName(mt.minKey, mt.maxKey)
+	filePath := path.Join(s.option.WorkDir, name)
+
+	if err := writeTableFile(filePath, mt); err != nil {
+		s.disk.abortFile(name)
+		return "", err
 	}
 
 	if err := s.disk.AddFile(filePath); err != nil {
-		log.Println("file add error: ", err)
-		file.Close()
-		return
+		os.Remove(filePath)
+		s.disk.abortFile(name)
+		return "", fmt.Errorf("failed to add the file: %w", err)
 	}
 
-	if err := file.Close(); err != nil {
-		log.Println("file close error: ", err)
-		return
+	return filePath, nil
+}
+
+// writeTableFile writes the table to a new file at filePath, which is removed
+// if it isn't complete.
+func writeTableFile(filePath string, mt *memtable) error {
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to create the file: %w", err)
 	}
 
-	if !atomic.CompareAndSwapInt32(&s.isFlashing, 1, 0) {
-		return
+	err = mt.write(file)
+	if err == nil {
+		err = file.Sync()
 	}
 
-	if err := s.remote.upload(filePath); err != nil {
-		log.Println("file upload error: ", err)
-		return
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
 	}
+
+	if err != nil {
+		os.Remove(filePath)
+		return fmt.Errorf("failed to write the memtable: %w", err)
+	}
+
+	return nil
 }
 
 type Encoder interface {
@@ -217,6 +597,14 @@ func NewEncoder(t db.ValueType, size int) Encoder {
 		return compress.NewFloatEncoder()
 	case db.StringType:
 		return compress.NewStringEncoder(size)
+	case db.BoolType:
+		return compress.NewBooleanEncoder(size)
+	case db.UnsignedType:
+		return compress.NewUnsignedEncoder(size)
+	case db.BytesType:
+		return compress.NewBytesEncoder(size)
+	case db.CustomType:
+		return newCodecEncoder(size)
 	default:
 		return compress.NewStringEncoder(size)
 	}
@@ -237,6 +625,14 @@ func NewDecoder(t db.ValueType) Decoder {
 		return &compress.FloatDecoder{}
 	case db.StringType:
 		return &compress.StringDecoder{}
+	case db.BoolType:
+		return &compress.BooleanDecoder{}
+	case db.UnsignedType:
+		return &compress.UnsignedDecoder{}
+	case db.BytesType:
+		return &compress.BytesDecoder{}
+	case db.CustomType:
+		return &codecDecoder{}
 	default:
 		return &compress.StringDecoder{}
 	}
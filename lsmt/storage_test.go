@@ -2,7 +2,9 @@ package lsmt
 
 import (
 	"os"
+	"path"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -16,10 +18,8 @@ var testOption *Option = &Option{
 	MemtableSize:   1024,
 	DiskfileCount:  10,
 
-	MinioEndpoint:        "192.168.0.251:9000",
-	MinioAccessKeyID:     "wangrushen",
-	MinioSecretAccessKey: "wangrushen",
-	MinioUseSSL:          false,
+	// The tests don't need a MinIO server, see TestMinioStore.
+	ObjectStore: NewMemoryStore(),
 }
 
 func newTestStorage() (*Storage, error) {
@@ -27,39 +27,10 @@ func newTestStorage() (*Storage, error) {
 		return nil, err
 	}
 
-	wal, err := NewWAL(testOption.WalPath)
-	if err != nil {
-		return nil, err
-	}
-
-	mt, err := wal.Load()
-	if err != nil {
-		return nil, err
-	}
-
-	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
-	if err != nil {
-		return nil, err
-	}
-
-	remoteOption, err := NewRemoteOption(testOption)
-	if err != nil {
-		return nil, err
-	}
-
-	rt, err := NewRemoteTable(remoteOption, dt)
-	if err != nil {
-		return nil, err
-	}
-
-	s := &Storage{
-		option: testOption,
-		mem:    mt,
-		disk:   dt,
-		remote: rt,
-	}
-
-	return s, nil
+	// Every storage uploads to its own store.
+	option := *testOption
+	option.ObjectStore = NewMemoryStore()
+	return NewStorage(&option)
 }
 
 func clean(s *Storage) {
@@ -71,7 +42,7 @@ func clean(s *Storage) {
 		panic(err)
 	}
 
-	if err := os.Remove(testOption.WalPath); err != nil {
+	if err := os.RemoveAll(testOption.WalPath); err != nil {
 		panic(err)
 	}
 }
@@ -106,3 +77,273 @@ func TestStorage(t *testing.T) {
 
 	time.Sleep(10 * time.Second)
 }
+
+func TestLocalOnly(t *testing.T) {
+	if err := os.Mkdir(testOption.WorkDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	option := *testOption
+	option.ObjectStore = nil
+	option.DiskfileCount = 1
+	s, err := NewStorage(&option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clean(s)
+
+	if s.remote != nil || s.disk.remote != nil {
+		t.Fatal("expect no remote tier")
+	}
+
+	expect := make([]db.KV, 1000)
+	for i := int64(0); i < 1000; i++ {
+		if err := s.Insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu"}); err != nil {
+			t.Fatal(err)
+		}
+		expect[i] = db.KV{Key: i, Value: i}
+	}
+
+	s.flushes.Wait()
+
+	result, err := s.GetRange(0, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(expect, result) {
+		t.Errorf("expect %d points, got %d", len(expect), len(result))
+	}
+
+	// The files evicted from the cache stay on the local disk.
+	for _, file := range s.disk.files {
+		if _, err := os.Stat(file.path); err != nil || file.remote {
+			t.Errorf("expect %s on the local disk, got %v", file.path, err)
+		}
+	}
+}
+
+func TestFlushRetry(t *testing.T) {
+	if err := os.Mkdir(testOption.WorkDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	option := *testOption
+	option.ObjectStore = nil
+	option.MemtableSize = 1 << 20
+	s, err := NewStorage(&option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { clean(s) }()
+
+	insert := func(start, end int64) {
+		for i := start; i < end; i++ {
+			if err := s.Insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	check := func(n int) {
+		result, err := s.GetRange(0, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(result) != n {
+			t.Errorf("expect %d points, got %d", n, len(result))
+		}
+	}
+
+	insert(0, 10)
+
+	// The file of the flush can't be created over a directory.
+	blocker := path.Join(option.WorkDir, "0-9-1")
+	if err := os.Mkdir(blocker, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	s.option.MemtableSize = 1
+	s.saveToFileIfNeeded()
+	s.option.MemtableSize = 1 << 20
+
+	if s.flashTable == nil || atomic.LoadInt32(&s.isFlashing) != 0 || len(s.disk.files) != 0 {
+		t.Fatalf("expect the table kept for a retry, got %d files", len(s.disk.files))
+	}
+	check(10)
+
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed table is written before the memtable is swapped again.
+	insert(10, 20)
+	s.flushes.Wait()
+
+	if s.flashTable != nil || len(s.disk.files) != 1 {
+		t.Fatalf("expect the failed table flushed, got %d files", len(s.disk.files))
+	}
+	check(20)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = NewStorage(&option); err != nil {
+		t.Fatal(err)
+	}
+	check(20)
+}
+
+func TestDeleteSeries(t *testing.T) {
+	s, err := newTestStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { clean(s) }()
+
+	host := map[string]string{"host": "a"}
+	core := map[string]string{"host": "a", "core": "1"}
+	insert := func(start, end int64) {
+		for i := start; i < end; i++ {
+			for _, labels := range []map[string]string{host, core} {
+				if err := s.Insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu", Labels: labels}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	insert(0, 100)
+	s.flushes.Wait()
+
+	// The series key only selects the series with exactly its labels.
+	if err := s.DeleteRange(10, 90, &db.QueryFilter{Series: db.SeriesKey("cpu", host)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The tombstone is flushed with the newer points.
+	insert(100, 200)
+	s.flushes.Wait()
+
+	check := func() {
+		t.Helper()
+		for _, labels := range []map[string]string{host, core} {
+			result, err := s.GetRange(0, 200, &db.QueryFilter{Series: db.SeriesKey("cpu", labels)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expect := len(labels) == 1
+			if deleted := len(result) == 120; deleted != expect {
+				t.Errorf("%v: expect deleted %v, got %d points", labels, expect, len(result))
+			}
+		}
+	}
+
+	check()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	option := *testOption
+	option.ObjectStore = NewMemoryStore()
+	if s, err = NewStorage(&option); err != nil {
+		t.Fatal(err)
+	}
+
+	check()
+}
+
+func TestSeries(t *testing.T) {
+	if err := os.Mkdir(testOption.WorkDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testOption.WorkDir)
+	defer os.RemoveAll(testOption.WalPath)
+
+	open := func() *db.DB {
+		option := *testOption
+		option.ObjectStore = nil
+		d, err := db.OpenDB(&db.Option{UUID: "2d1a4d35-6b4a-4a2e-9a55-8f0a9f1c8b11", Engine: "lsm", EngineOption: &option})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return d
+	}
+
+	ints := make([]db.Point[int64], 100)
+	floats := make([]db.Point[float64], 100)
+	bools := make([]db.Point[bool], 100)
+	unsigned := make([]db.Point[uint64], 100)
+	strs := make([]db.Point[string], 100)
+	bytes := make([]db.Point[[]byte], 100)
+	for i := range ints {
+		ts := int64(i)
+		ints[i] = db.Point[int64]{Time: ts, Value: ts - 50}
+		floats[i] = db.Point[float64]{Time: ts, Value: float64(ts) / 4}
+		bools[i] = db.Point[bool]{Time: ts, Value: i%3 == 0}
+		unsigned[i] = db.Point[uint64]{Time: ts, Value: uint64(1)<<63 + uint64(i)}
+		strs[i] = db.Point[string]{Time: ts, Value: string(rune('a' + i%26))}
+		bytes[i] = db.Point[[]byte]{Time: ts, Value: []byte{byte(i), 0xff}}
+	}
+
+	d := open()
+	insertSeries(t, db.NewSeries[int64](d, "requests", map[string]string{"host": "a"}), ints)
+	insertSeries(t, db.NewSeries[float64](d, "cpu", map[string]string{"host": "a"}), floats)
+	insertSeries(t, db.NewSeries[bool](d, "up", nil), bools)
+	insertSeries(t, db.NewSeries[uint64](d, "total", nil), unsigned)
+	insertSeries(t, db.NewSeries[string](d, "state", nil), strs)
+	insertSeries(t, db.NewSeries[[]byte](d, "payload", nil), bytes)
+
+	// The points are read from the memtable, then from the files once the
+	// storage is reopened.
+	for i := 0; i < 2; i++ {
+		checkSeries(t, db.NewSeries[int64](d, "requests", map[string]string{"host": "a"}), ints)
+		checkSeries(t, db.NewSeries[float64](d, "cpu", map[string]string{"host": "a"}), floats)
+		checkSeries(t, db.NewSeries[bool](d, "up", nil), bools)
+		checkSeries(t, db.NewSeries[uint64](d, "total", nil), unsigned)
+		checkSeries(t, db.NewSeries[string](d, "state", nil), strs)
+		checkSeries(t, db.NewSeries[[]byte](d, "payload", nil), bytes)
+
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		d = open()
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func insertSeries[T db.Value](t *testing.T, s *db.Series[T], points []db.Point[T]) {
+	t.Helper()
+	if err := s.InsertBatch(points); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkSeries[T db.Value](t *testing.T, s *db.Series[T], points []db.Point[T]) {
+	t.Helper()
+	result, err := s.Range(0, int64(len(points)))
+	if err != nil {
+		t.Fatalf("%s: %v", s.Key(), err)
+	}
+
+	if !reflect.DeepEqual(points, result) {
+		t.Errorf("%s: expect %v, got %v", s.Key(), points, result)
+	}
+
+	last, ok, err := s.Last()
+	if err != nil || !ok {
+		t.Fatalf("%s: expect the last point, got %v, %v", s.Key(), ok, err)
+	}
+
+	if !reflect.DeepEqual(points[len(points)-1], last) {
+		t.Errorf("%s: expect %v, got %v", s.Key(), points[len(points)-1], last)
+	}
+}
@@ -0,0 +1,208 @@
+package lsmt
+
+import (
+	"encoding/binary"
+	"errors"
+
+	db "github.com/dovics/pangolin"
+)
+
+var errTombstoneCorrupt = errors.New("tombstone is corrupt")
+
+const (
+	// tombstoneType is the type of the header entry which points to the
+	// tombstone block of a SSTable.
+	tombstoneType db.ValueType = 1 << 31
+
+	// tombstoneSize is the size a tombstone is accounted for in the memtable.
+	tombstoneSize = 16
+)
+
+// tombstoneFormat is the layout of an encoded tombstone.
+type tombstoneFormat int
+
+const (
+	// tombstoneTags tombstones hold the tags of the filter.
+	tombstoneTags tombstoneFormat = iota
+	// tombstoneMatchers tombstones hold the matchers of the filter.
+	tombstoneMatchers
+	// tombstoneSeries tombstones hold the matchers and the series key of the
+	// filter.
+	tombstoneSeries
+)
+
+// tombstone marks the points in [start, end) of the series matching the
+// filter as deleted. A tombstone only hides the points of older sources, the
+// points of its own memtable are removed when it is recorded. The series is
+// the canonical key of the filter's series, empty if it has none.
+type tombstone struct {
+	start    int64
+	end      int64
+	t        db.ValueType
+	matchers []*db.Matcher
+	series   string
+}
+
+// newTombstone returns the tombstone of a valid filter, see
+// QueryFilter.Validate.
+func newTombstone(start, end int64, filter *db.QueryFilter) *tombstone {
+	t := &tombstone{start: start, end: end}
+	if filter != nil {
+		t.t = filter.Type
+		t.matchers = filter.LabelMatchers()
+		if filter.Series != "" {
+			t.series, _ = db.CanonicalSeriesKey(filter.Series)
+		}
+	}
+
+	return t
+}
+
+func (t *tombstone) match(index string, valueType db.ValueType) bool {
+	if t.t != db.UnknownType && t.t != valueType {
+		return false
+	}
+
+	if t.series != "" && t.series != index {
+		return false
+	}
+
+	if len(t.matchers) == 0 {
+		return true
+	}
+
+	metric, labels, err := db.ParseSeriesKey(index)
+	if err != nil {
+		return false
+	}
+
+	return db.MatchSeries(t.matchers, metric, labels)
+}
+
+func (t *tombstone) covers(key int64) bool {
+	return key >= t.start && key < t.end
+}
+
+func appendTombstone(dst []byte, t *tombstone) []byte {
+	dst = appendInt64(dst, t.start)
+	dst = appendInt64(dst, t.end)
+	dst = append(dst, byte(t.t))
+
+	dst = appendUvarint(dst, uint64(len(t.matchers)))
+	for _, m := range t.matchers {
+		dst = append(dst, byte(m.Type))
+		dst = appendString(dst, m.Name)
+		dst = appendString(dst, m.Value)
+	}
+
+	return appendString(dst, t.series)
+}
+
+// readTombstone reads a tombstone of the format.
+func readTombstone(buf []byte, format tombstoneFormat) (*tombstone, []byte, error) {
+	if len(buf) < 17 {
+		return nil, nil, errTombstoneCorrupt
+	}
+
+	t := &tombstone{
+		start: int64(binary.BigEndian.Uint64(buf)),
+		end:   int64(binary.BigEndian.Uint64(buf[8:])),
+		t:     db.ValueType(buf[16]),
+	}
+	buf = buf[17:]
+
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, nil, errTombstoneCorrupt
+	}
+	buf = buf[n:]
+
+	if format == tombstoneTags {
+		tags := []string{}
+		for i := uint64(0); i < count; i++ {
+			tag, rest, err := readString(buf)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			tags = append(tags, tag)
+			buf = rest
+		}
+
+		t.matchers = (&db.QueryFilter{Tags: tags}).LabelMatchers()
+		return t, buf, nil
+	}
+
+	for i := uint64(0); i < count; i++ {
+		if len(buf) < 1 {
+			return nil, nil, errTombstoneCorrupt
+		}
+		matchType := db.MatchType(buf[0])
+
+		name, rest, err := readString(buf[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		value, rest, err := readString(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m, err := db.NewMatcher(matchType, name, value)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		t.matchers = append(t.matchers, m)
+		buf = rest
+	}
+
+	if format == tombstoneSeries {
+		series, rest, err := readString(buf)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		t.series = series
+		buf = rest
+	}
+
+	return t, buf, nil
+}
+
+// +---------------+---------------+---------------+-----+
+// |               |               |               |     |
+// |     count     |   tombstone   |   tombstone   | ... |
+// |               |               |               |     |
+// +---------------+---------------+---------------+-----+
+
+func encodeTombstones(tombstones []*tombstone) []byte {
+	buffer := appendUvarint(nil, uint64(len(tombstones)))
+	for _, t := range tombstones {
+		buffer = appendTombstone(buffer, t)
+	}
+
+	return buffer
+}
+
+func decodeTombstones(buf []byte, format tombstoneFormat) ([]*tombstone, error) {
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errTombstoneCorrupt
+	}
+	buf = buf[n:]
+
+	tombstones := make([]*tombstone, 0, count)
+	for i := uint64(0); i < count; i++ {
+		t, rest, err := readTombstone(buf, format)
+		if err != nil {
+			return nil, err
+		}
+
+		tombstones = append(tombstones, t)
+		buf = rest
+	}
+
+	return tombstones, nil
+}
@@ -0,0 +1,166 @@
+package lsmt
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestTombstoneCodec(t *testing.T) {
+	tombstones := []*tombstone{
+		{start: 0, end: 10},
+		{start: 20, end: 30, t: db.IntType, matchers: []*db.Matcher{
+			db.MustNewMatcher(db.MatchEqual, "a", "1"),
+			db.MustNewMatcher(db.MatchNotRegexp, "b", "x.*"),
+		}},
+		{start: 40, end: 50, series: `cpu{host="a"}`},
+	}
+
+	result, err := decodeTombstones(encodeTombstones(tombstones), tombstoneSeries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tombstones, result) {
+		t.Errorf("expect %v, got %v", tombstones, result)
+	}
+
+	// The tombstones before version 6 have no series key.
+	encoded := encodeTombstones(tombstones[:1])
+	result, err = decodeTombstones(encoded[:len(encoded)-1], tombstoneMatchers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(tombstones[:1], result) {
+		t.Errorf("expect %v, got %v", tombstones[:1], result)
+	}
+
+	// A legacy tombstone holds the tags of the filter.
+	legacy := appendUvarint(nil, 1)
+	legacy = appendInt64(legacy, 20)
+	legacy = appendInt64(legacy, 30)
+	legacy = append(legacy, byte(db.IntType))
+	legacy = appendUvarint(legacy, 1)
+	legacy = appendString(legacy, "host=a")
+
+	result, err = decodeTombstones(legacy, tombstoneTags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 1 || !result[0].match(`cpu{host="a"}`, db.IntType) || result[0].match(`cpu{host="ab"}`, db.IntType) {
+		t.Errorf("wrong legacy tombstone %v", result)
+	}
+}
+
+func TestTombstone(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	dt.prepare(0, 100)
+
+	// The tombstone is flushed to a newer file and hides the points of the
+	// older one.
+	mt := NewMemtable()
+	for i := int64(40); i < 60; i++ {
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"test"}})
+	}
+	mt.deleteRange(newTombstone(20, 50, &db.QueryFilter{Tags: []string{"test"}}))
+
+	filePath := path.Join(dt.workDir, dt.nextFileName(mt.minKey, mt.maxKey))
+	file, err := os.Create(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mt.write(file); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	if err := dt.AddFile(filePath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Points written after the tombstone are kept.
+	newer := NewMemtable()
+	newer.insert(&db.Entry{KV: db.KV{Key: 30, Value: int64(300)}, Type: db.IntType, Tags: []string{"test"}})
+
+	sources := append([]source{newer.newSource(0, 100, nil)}, dt.newSources(0, 100, nil)...)
+	result, err := db.Collect(newIterator(context.Background(), sources))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectResult := []db.KV{}
+	for i := int64(0); i < 100; i++ {
+		if i == 30 {
+			expectResult = append(expectResult, db.KV{Key: i, Value: int64(300)})
+		} else if i < 20 || i >= 50 {
+			expectResult = append(expectResult, db.KV{Key: i, Value: i})
+		}
+	}
+
+	if !reflect.DeepEqual(expectResult, result) {
+		t.Errorf("expect %v, got %v\n", expectResult, result)
+	}
+}
+
+func TestWALTombstone(t *testing.T) {
+	defer os.RemoveAll(testOption.WalPath)
+
+	w, err := NewWAL(testOption.WalPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 10; i++ {
+		if err := w.AppendEntry(db.Entry{KV: db.KV{Key: i, Value: fmt.Sprint(i)}, Type: db.StringType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.AppendTombstone(newTombstone(2, 8, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWAL(testOption.WalPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	mt, err := w.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := mt.getRange(0, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectResult := []db.KV{{Key: 0, Value: "0"}, {Key: 1, Value: "1"}, {Key: 8, Value: "8"}, {Key: 9, Value: "9"}}
+	if !reflect.DeepEqual(expectResult, result) {
+		t.Errorf("expect %v, got %v\n", expectResult, result)
+	}
+
+	if len(mt.tombstones) != 1 {
+		t.Errorf("expect 1 tombstone, got %d", len(mt.tombstones))
+	}
+}
@@ -0,0 +1,254 @@
+package lsmt
+
+import (
+	"context"
+	"log"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	defaultUploadRetryInterval    = time.Second
+	defaultUploadRetryMaxInterval = 5 * time.Minute
+)
+
+// UploadStats counts the files waiting to be uploaded to or removed from the
+// remote tier, Failed is the number of pending files whose last attempt
+// failed.
+type UploadStats struct {
+	Pending int
+	Failed  int
+}
+
+// uploadQueue uploads the files to the remote tier in the background. The
+// files are only marked uploaded in the manifest once the upload succeeded,
+// so the queue is resumed from the manifest after a restart and no local
+// copy is removed before it is on the remote tier. The objects of the files
+// replaced by a compaction are removed through the same queue, they stay in
+// the catalog until they are deleted so the removal is resumed from it after a
+// restart. A failed task is retried after a delay doubled on every failure.
+type uploadQueue struct {
+	mutex  sync.Mutex
+	remote *remotetable
+	disk   *disktable
+
+	retryInterval    time.Duration
+	retryMaxInterval time.Duration
+
+	tasks map[string]*uploadTask
+	wake  chan struct{}
+}
+
+type uploadTask struct {
+	path     string
+	seq      uint64
+	remove   bool
+	attempts int
+	next     time.Time
+	err      error
+}
+
+func newUploadQueue(remote *remotetable, disk *disktable, option *Option) *uploadQueue {
+	q := &uploadQueue{
+		remote:           remote,
+		disk:             disk,
+		retryInterval:    option.UploadRetryInterval,
+		retryMaxInterval: option.UploadRetryMaxInterval,
+		tasks:            map[string]*uploadTask{},
+		wake:             make(chan struct{}, 1),
+	}
+
+	if q.retryInterval <= 0 {
+		q.retryInterval = defaultUploadRetryInterval
+	}
+
+	if q.retryMaxInterval <= 0 {
+		q.retryMaxInterval = defaultUploadRetryMaxInterval
+	}
+
+	if q.retryMaxInterval < q.retryInterval {
+		q.retryMaxInterval = q.retryInterval
+	}
+
+	return q
+}
+
+// push queues the upload of the file at p.
+func (q *uploadQueue) push(p string) {
+	q.mutex.Lock()
+	if _, ok := q.tasks[p]; !ok {
+		_, _, seq, _ := parseFileName(path.Base(p))
+		q.tasks[p] = &uploadTask{path: p, seq: seq}
+	}
+	q.mutex.Unlock()
+
+	q.notify()
+}
+
+// pushRemove queues the removal of the object of the replaced file at p, it
+// replaces a pending upload of the file.
+func (q *uploadQueue) pushRemove(p string) {
+	q.mutex.Lock()
+	task, ok := q.tasks[p]
+	if !ok {
+		_, _, seq, _ := parseFileName(path.Base(p))
+		task = &uploadTask{path: p, seq: seq}
+		q.tasks[p] = task
+	}
+	task.remove = true
+	q.mutex.Unlock()
+
+	q.notify()
+}
+
+func (q *uploadQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *uploadQueue) stats() UploadStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	stats := UploadStats{Pending: len(q.tasks)}
+	for _, task := range q.tasks {
+		if task.err != nil {
+			stats.Failed++
+		}
+	}
+
+	return stats
+}
+
+// next returns the task to upload first, the oldest of the tasks due the
+// earliest, or nil if the queue is empty.
+func (q *uploadQueue) next() *uploadTask {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	tasks := make([]*uploadTask, 0, len(q.tasks))
+	for _, task := range q.tasks {
+		tasks = append(tasks, task)
+	}
+
+	if len(tasks) == 0 {
+		return nil
+	}
+
+	sort.Slice(tasks, func(i, j int) bool {
+		if !tasks[i].next.Equal(tasks[j].next) {
+			return tasks[i].next.Before(tasks[j].next)
+		}
+
+		return tasks[i].seq < tasks[j].seq
+	})
+
+	return tasks[0]
+}
+
+// run uploads the queued files until the context is done, the files left are
+// uploaded on the next start.
+func (q *uploadQueue) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		task := q.next()
+		if task == nil {
+			select {
+			case <-q.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if wait := time.Until(task.next); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-q.wake:
+				timer.Stop()
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		q.upload(ctx, task)
+	}
+}
+
+func (q *uploadQueue) upload(ctx context.Context, task *uploadTask) {
+	q.mutex.Lock()
+	remove := task.remove
+	q.mutex.Unlock()
+
+	// A file replaced by a compaction is uploaded as part of its outputs.
+	var err error
+	if remove {
+		err = q.remote.remove(ctx, path.Base(task.path))
+	} else if q.disk.contains(task.path) {
+		err = q.uploadFile(ctx, task.path)
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// The task is kept if a removal was queued while the file was uploaded.
+	if err == nil && remove == task.remove {
+		delete(q.tasks, task.path)
+		return
+	} else if err == nil {
+		return
+	}
+
+	if remove {
+		log.Println("file remove error: ", err)
+	} else {
+		log.Println("file upload error: ", err)
+	}
+
+	delay := q.retryInterval
+	for i := 0; i < task.attempts && delay < q.retryMaxInterval; i++ {
+		delay *= 2
+	}
+	if delay > q.retryMaxInterval {
+		delay = q.retryMaxInterval
+	}
+
+	task.attempts++
+	task.err = err
+	task.next = time.Now().Add(delay)
+}
+
+// uploadFile writes the object of the file, then its catalog entry, and
+// finally marks it uploaded in the manifest. A file uploaded before its entry
+// was written is only added to the catalog.
+func (q *uploadQueue) uploadFile(ctx context.Context, p string) error {
+	entry, err := q.disk.catalogEntry(ctx, p)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	if !q.disk.isUploaded(p) {
+		if err := q.remote.upload(ctx, p); err != nil {
+			return err
+		}
+	}
+
+	if err := q.remote.catalog.add(ctx, entry); err != nil {
+		return err
+	}
+
+	// A file replaced while it was uploaded has its removal queued by the
+	// compaction.
+	_, err = q.disk.uploaded(p)
+	return err
+}
@@ -0,0 +1,270 @@
+package lsmt
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	db "github.com/dovics/pangolin"
+)
+
+// flakyStore fails the uploads and the removals while it is down.
+type flakyStore struct {
+	ObjectStore
+	mutex sync.Mutex
+	down  bool
+	fails int
+}
+
+func (f *flakyStore) setDown(down bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.down = down
+}
+
+func (f *flakyStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	f.mutex.Lock()
+	if f.down {
+		f.fails++
+		f.mutex.Unlock()
+		return errors.New("remote tier is down")
+	}
+	f.mutex.Unlock()
+
+	return f.ObjectStore.Put(ctx, name, r, size)
+}
+
+func (f *flakyStore) Delete(ctx context.Context, name string) error {
+	f.mutex.Lock()
+	if f.down {
+		f.fails++
+		f.mutex.Unlock()
+		return errors.New("remote tier is down")
+	}
+	f.mutex.Unlock()
+
+	return f.ObjectStore.Delete(ctx, name)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadQueue(t *testing.T) {
+	if err := os.Mkdir(testOption.WorkDir, 0750); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &flakyStore{ObjectStore: NewMemoryStore(), down: true}
+	option := *testOption
+	option.ObjectStore = store
+	option.DiskfileCount = 1
+	option.UploadRetryInterval = 10 * time.Millisecond
+	option.UploadRetryMaxInterval = 20 * time.Millisecond
+
+	s, err := NewStorage(&option)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 1000; i++ {
+		if err := s.Insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.flushes.Wait()
+
+	waitFor(t, func() bool {
+		stats := s.UploadStats()
+		return stats.Pending > 0 && stats.Failed == stats.Pending
+	})
+
+	// No local copy is removed before its upload succeeded.
+	files := len(s.disk.files)
+	for _, file := range s.disk.files {
+		if _, err := os.Stat(file.path); err != nil || file.remote || file.uploaded {
+			t.Errorf("expect %s on the local disk only, got %v", file.path, err)
+		}
+	}
+
+	// The pending uploads are resumed on the next start.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store.setDown(false)
+	if s, err = NewStorage(&option); err != nil {
+		t.Fatal(err)
+	}
+	defer clean(s)
+
+	if stats := s.UploadStats(); stats.Failed != 0 {
+		t.Errorf("expect no failed uploads after a restart, got %d", stats.Failed)
+	}
+
+	waitFor(t, func() bool { return s.UploadStats().Pending == 0 })
+
+	objects, err := store.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The catalog is written along with the files.
+	uploaded := []ObjectInfo{}
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Name, catalogName) {
+			uploaded = append(uploaded, object)
+		}
+	}
+
+	if len(uploaded) != files || len(objects) == files {
+		t.Errorf("expect %d files and the catalog, got %v", files, objects)
+	}
+
+	// The uploads are recorded in the manifest and the catalog.
+	m, _, err := openManifest(option.WorkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, object := range uploaded {
+		if meta, ok := m.files[object.Name]; !ok || !meta.uploaded {
+			t.Errorf("expect %s to be marked uploaded", object.Name)
+		}
+
+		if _, ok := s.remote.catalog.get(object.Name); !ok {
+			t.Errorf("expect %s in the catalog", object.Name)
+		}
+	}
+
+	result, err := s.GetRange(0, 1000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 1000 {
+		t.Errorf("expect 1000 points, got %d", len(result))
+	}
+}
+
+func TestUploadQueueReplacedFile(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dt.Close()
+
+	store := NewMemoryStore()
+	q := newUploadQueue(NewRemoteTable(store, testOption.WorkDir), dt, &Option{})
+
+	// A file replaced by a compaction isn't uploaded.
+	p := path.Join(testOption.WorkDir, "0-10-1")
+	q.push(p)
+	q.upload(context.Background(), q.next())
+
+	if stats := q.stats(); stats.Pending != 0 {
+		t.Errorf("expect the upload to be dropped, got %d pending", stats.Pending)
+	}
+
+	if objects, _ := store.List(context.Background(), ""); len(objects) != 0 {
+		t.Errorf("expect no objects, got %v", objects)
+	}
+}
+
+func TestUploadQueueRemove(t *testing.T) {
+	os.Mkdir(testOption.WorkDir, 0750)
+	defer os.RemoveAll(testOption.WorkDir)
+
+	dt, err := NewDiskTable(testOption.WorkDir, testOption.DiskfileCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { dt.Close() }()
+
+	ctx := context.Background()
+	store := &flakyStore{ObjectStore: NewMemoryStore()}
+	rt := NewRemoteTable(store, testOption.WorkDir)
+	dt.catalog = rt.catalog
+	q := newUploadQueue(rt, dt, &Option{UploadRetryInterval: time.Millisecond})
+
+	for i := int64(0); i < 2; i++ {
+		mt := NewMemtable()
+		mt.insert(&db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Metric: "cpu"})
+		dt.flush(mt)
+	}
+
+	for _, p := range dt.pendingUploads() {
+		q.push(p)
+		q.upload(ctx, q.next())
+	}
+
+	inputs, _, err := dt.compact(ctx, &Option{CompactionMinFiles: 2})
+	if err != nil || len(inputs) != 2 {
+		t.Fatalf("expect 2 files compacted, got %d, %v", len(inputs), err)
+	}
+
+	// A failed removal is retried and the objects stay catalogued meanwhile.
+	store.setDown(true)
+	for _, file := range inputs {
+		q.pushRemove(file.path)
+	}
+	q.upload(ctx, q.next())
+
+	if stats := q.stats(); stats.Pending != 2 || stats.Failed != 1 {
+		t.Errorf("expect 2 pending removals with 1 failed, got %+v", stats)
+	}
+
+	// The removals are resumed from the catalog after a restart.
+	dt.Close()
+	if dt, err = NewDiskTable(testOption.WorkDir, testOption.DiskfileCount); err != nil {
+		t.Fatal(err)
+	}
+	dt.catalog = rt.catalog
+
+	obsolete := dt.obsoleteUploads()
+	if len(obsolete) != 2 {
+		t.Fatalf("expect 2 obsolete uploads, got %v", obsolete)
+	}
+
+	store.setDown(false)
+	q = newUploadQueue(rt, dt, &Option{})
+	for _, p := range obsolete {
+		q.pushRemove(p)
+	}
+
+	for task := q.next(); task != nil; task = q.next() {
+		q.upload(ctx, task)
+	}
+
+	objects, err := store.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Name, catalogName) {
+			t.Errorf("expect only the catalog, got %v", objects)
+		}
+	}
+
+	if names := rt.catalog.names(); len(names) != 0 {
+		t.Errorf("expect an empty catalog, got %v", names)
+	}
+}
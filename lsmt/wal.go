@@ -1,91 +1,860 @@
 package lsmt
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
+	"math"
 	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 
 	db "github.com/dovics/pangolin"
 )
 
+// The WAL is a directory of segment files named by an increasing sequence.
+// New entries are appended to the active segment, which is rolled over when it
+// grows beyond the segment size. When the memtable is frozen for flushing, the
+// active segment is sealed and every segment up to it is removed once the
+// memtable is durably written to disk.
+//
+// Each segment is a list of records:
+//
+// +---------------+---------------+-----------------------------+
+// |               |               |                             |
+// |     crc32     |     length    |           payload           |
+// |               |               |                             |
+// +---------------+---------------+-----------------------------+
+//
+// The checksum covers the payload, which starts with the version and the kind
+// of the record. An entry record is encoded as:
+//
+// +---------+------+-----------+-------+-----------+---------+
+// |         |      |           |       |           |         |
+// | version | kind | valueType |  key  | seriesKey |  value  |
+// |         |      |           |       |           |         |
+// +---------+------+-----------+-------+-----------+---------+
+//
+// and a tombstone record as:
+//
+// +---------+------+-------+-----+-----------+---------------+----------+-----------+
+// |         |      |       |     |           |               |          |           |
+// | version | kind | start | end | valueType | matcherCount  | matchers | seriesKey |
+// |         |      |       |     |           |               |          |           |
+// +---------+------+-------+-----+-----------+---------------+----------+-----------+
+//
+// Version 1 and 2 records hold the tags of the entry or of the filter
+// instead of the series key and the matchers. Version 1 records have no kind
+// and are always entries. The tombstones before version 4 have no series key.
+
+const (
+	walVersion3 = 3
+	walVersion4 = 4
+	walVersion  = walVersion4
+
+	walEntryRecord     = 0
+	walTombstoneRecord = 1
+
+	walSegmentSuffix      = ".wal"
+	defaultWalSegmentSize = 16 * 1024 * 1024
+
+	walRecordHeaderSize = 8
+	walMaxRecordSize    = 64 * 1024 * 1024
+
+	// legacyWalSuffix is appended to the WAL file written before the WAL was
+	// segmented once it is upgraded.
+	legacyWalSuffix = ".legacy"
+)
+
+var errWALCorrupt = errors.New("wal record is corrupt")
+
 type wal struct {
-	filePath string
-	file     *os.File
+	mutex       sync.Mutex
+	dir         string
+	segmentSize int64
+
+	file  *os.File
+	seq   int
+	size  int64
+	dirty bool
+
+	segments []int
 }
 
-func NewWAL(path string) (*wal, error) {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+func NewWAL(dir string, segmentSize int64) (*wal, error) {
+	if segmentSize <= 0 {
+		segmentSize = defaultWalSegmentSize
+	}
+
+	if err := upgradeLegacyWAL(dir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory %s: %w", dir, err)
+	}
+
+	segments, err := listSegments(dir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file %s: %w", path, err)
+		return nil, err
 	}
 
-	return &wal{filePath: path, file: file}, nil
+	w := &wal{dir: dir, segmentSize: segmentSize, segments: segments}
+
+	// Always start from a new segment, so nothing is appended after a torn tail
+	// left by a previous crash.
+	if err := w.openSegment(w.nextSeq()); err != nil {
+		return nil, err
+	}
+
+	return w, nil
 }
 
-func (w *wal) Clear() error {
-	if err := w.file.Close(); err != nil {
-		return fmt.Errorf("failed to close the WAL file %s: %w", w.filePath, err)
+// upgradeLegacyWAL converts the WAL file written before the segmented WAL,
+// a list of JSON entries prefixed with their length, into the first segment
+// of the WAL directory. The segment is written to a temporary directory which
+// replaces the file once it is set aside with the legacyWalSuffix, so the
+// upgrade is resumed or restarted after a crash.
+func upgradeLegacyWAL(dir string) error {
+	tmpDir := dir + tmpFileSuffix
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(tmpDir); err == nil {
+			return os.Rename(tmpDir, dir)
+		}
+		return nil
+	} else if err != nil || info.IsDir() {
+		return err
+	}
+
+	entries, err := loadLegacyWAL(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(tmpDir, 0750); err != nil {
+		return fmt.Errorf("failed to create WAL directory %s: %w", tmpDir, err)
+	}
+
+	var records []byte
+	for _, e := range entries {
+		if records, err = appendRecord(records, e); err != nil {
+			return err
+		}
+	}
+
+	segment := path.Join(tmpDir, fmt.Sprintf("%08d%s", 1, walSegmentSuffix))
+	if err := writeFileSync(segment, records); err != nil {
+		return fmt.Errorf("failed to write the WAL file %s: %w", segment, err)
 	}
 
-	wf, err := os.OpenFile(w.filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err := os.Rename(dir, dir+legacyWalSuffix); err != nil {
+		return err
+	}
+
+	log.Printf("upgrade WAL file %s with %d entries\n", dir, len(entries))
+	return os.Rename(tmpDir, dir)
+}
+
+// loadLegacyWAL reads the entries of a legacy WAL file, a torn tail is
+// ignored.
+func loadLegacyWAL(p string) ([]*db.Entry, error) {
+	file, err := os.Open(p)
 	if err != nil {
-		return fmt.Errorf("failed to open the file %s: %w", w.filePath, err)
+		return nil, fmt.Errorf("failed to open file %s: %w", p, err)
 	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	entries := []*db.Entry{}
+	length := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, length); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			log.Printf("ignore the torn tail of WAL file %s: %v\n", p, err)
+			return entries, nil
+		}
+
+		n := binary.BigEndian.Uint64(length)
+		if n > walMaxRecordSize {
+			return nil, fmt.Errorf("WAL file %s: %w", p, errWALCorrupt)
+		}
+
+		buffer := make([]byte, n)
+		if _, err := io.ReadFull(r, buffer); err != nil {
+			log.Printf("ignore the torn tail of WAL file %s: %v\n", p, err)
+			return entries, nil
+		}
+
+		entry, err := decodeLegacyEntry(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("WAL file %s: %w", p, err)
+		}
 
-	w.file = wf
+		entries = append(entries, entry)
+	}
+}
+
+// decodeLegacyEntry decodes a JSON entry of a legacy WAL file, its value is
+// an int, a float or a string.
+func decodeLegacyEntry(data []byte) (*db.Entry, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	entry := &db.Entry{}
+	if err := decoder.Decode(entry); err != nil {
+		return nil, err
+	}
+
+	number, isNumber := entry.Value.(json.Number)
+	switch {
+	case entry.Type == db.IntType && isNumber:
+		v, err := number.Int64()
+		if err != nil {
+			return nil, err
+		}
+		entry.Value = v
+	case entry.Type == db.FloatType && isNumber:
+		v, err := number.Float64()
+		if err != nil {
+			return nil, err
+		}
+		entry.Value = v
+	case entry.Type == db.StringType:
+		if _, ok := entry.Value.(string); !ok {
+			return nil, errWALCorrupt
+		}
+	default:
+		return nil, errWALCorrupt
+	}
+
+	return entry, nil
+}
+
+func listSegments(dir string) ([]int, error) {
+	entrys, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL directory %s: %w", dir, err)
+	}
+
+	segments := []int{}
+	for _, entry := range entrys {
+		if !strings.HasSuffix(entry.Name(), walSegmentSuffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), walSegmentSuffix))
+		if err != nil {
+			continue
+		}
+
+		segments = append(segments, n)
+	}
+
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (w *wal) segmentPath(seq int) string {
+	return path.Join(w.dir, fmt.Sprintf("%08d%s", seq, walSegmentSuffix))
+}
+
+func (w *wal) nextSeq() int {
+	if len(w.segments) == 0 {
+		return 1
+	}
+
+	return w.segments[len(w.segments)-1] + 1
+}
+
+func (w *wal) openSegment(seq int) error {
+	file, err := os.OpenFile(w.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open file %s: %w", w.segmentPath(seq), err)
+	}
+
+	w.file = file
+	w.seq = seq
+	w.size = 0
+	w.dirty = false
+	w.segments = append(w.segments, seq)
 	return nil
 }
 
+// roll closes the active segment and opens the next one.
+func (w *wal) roll() error {
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the WAL file %s: %w", w.segmentPath(w.seq), err)
+	}
+
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("failed to close the WAL file %s: %w", w.segmentPath(w.seq), err)
+	}
+
+	return w.openSegment(w.seq + 1)
+}
+
 func (w *wal) AppendEntry(entry db.Entry) error {
-	entryBytes, err := json.Marshal(entry)
+	record, err := appendRecord(nil, &entry)
 	if err != nil {
 		return err
 	}
 
-	buffer := make([]byte, 8)
-	binary.BigEndian.PutUint64(buffer, uint64(len(entryBytes)))
+	return w.write(record)
+}
+
+// AppendEntries writes all the entries to the active segment with one write.
+func (w *wal) AppendEntries(entries []*db.Entry) error {
+	var (
+		records []byte
+		err     error
+	)
 
-	if _, err := w.file.Write(buffer); err != nil {
+	for _, e := range entries {
+		if records, err = appendRecord(records, e); err != nil {
+			return err
+		}
+	}
+
+	return w.write(records)
+}
+
+// AppendTombstone writes a tombstone to the active segment.
+func (w *wal) AppendTombstone(t *tombstone) error {
+	record, err := appendTombstoneRecord(nil, t)
+	if err != nil {
 		return err
 	}
 
-	if _, err := w.file.Write(entryBytes); err != nil {
+	return w.write(record)
+}
+
+func (w *wal) write(records []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.size >= w.segmentSize {
+		if err := w.roll(); err != nil {
+			return err
+		}
+	}
+
+	n, err := w.file.Write(records)
+	w.size += int64(n)
+	if err != nil {
 		return err
 	}
 
+	w.dirty = true
 	return nil
 }
 
-func (w *wal) Load() (*memtable, error) {
-	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
-		return nil, fmt.Errorf("failed to seek to the beginning: %w", err)
+// Sync commits the written entries to stable storage.
+func (w *wal) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the WAL file %s: %w", w.segmentPath(w.seq), err)
+	}
+
+	w.dirty = false
+	return nil
+}
+
+// Rotate seals the active segment and starts a new one. The entries of the
+// sealed segments belong to the memtable that is being flushed, the returned
+// sequence should be passed to RemoveSealed once the flush is durable.
+func (w *wal) Rotate() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	sealed := w.seq
+	if err := w.roll(); err != nil {
+		return 0, err
+	}
+
+	return sealed, nil
+}
+
+// RemoveSealed removes the segments up to and including seq.
+func (w *wal) RemoveSealed(seq int) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	remain := []int{}
+	for _, n := range w.segments {
+		if n > seq || n == w.seq {
+			remain = append(remain, n)
+			continue
+		}
+
+		if err := os.Remove(w.segmentPath(n)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove the WAL file %s: %w", w.segmentPath(n), err)
+		}
+	}
+
+	w.segments = remain
+	return nil
+}
+
+func (w *wal) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync the WAL file %s: %w", w.segmentPath(w.seq), err)
 	}
 
+	return w.file.Close()
+}
+
+// Load replays every segment before the active one into a new memtable. A
+// truncated or corrupt tail is cut off at the last valid record if no later
+// segment holds records, otherwise the load fails as replaying the later
+// segments would leave a gap in the acknowledged writes.
+func (w *wal) Load() (*memtable, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var (
+		torn    string
+		valid   int64
+		tornErr error
+	)
+
 	memtable := NewMemtable()
-	lengthBuffer := make([]byte, 8)
+	for _, seq := range w.segments {
+		if seq == w.seq {
+			continue
+		}
+
+		p := w.segmentPath(seq)
+		if torn != "" {
+			info, err := os.Stat(p)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat file %s: %w", p, err)
+			}
+
+			if info.Size() > 0 {
+				return nil, fmt.Errorf("WAL file %s is corrupt at %d and followed by %s: %w", torn, valid, p, errWALCorrupt)
+			}
+		}
+
+		n, err := w.loadSegment(p, memtable)
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, errWALCorrupt) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, err
+		}
+
+		if torn == "" {
+			torn, valid, tornErr = p, n, err
+		}
+	}
+
+	if torn == "" {
+		return memtable, nil
+	}
+
+	log.Printf("truncate WAL file %s at %d: %v\n", torn, valid, tornErr)
+	if err := os.Truncate(torn, valid); err != nil {
+		return nil, fmt.Errorf("failed to truncate the WAL file %s: %w", torn, err)
+	}
+
+	return memtable, nil
+}
+
+// loadSegment inserts the records of the segment into memtable and returns
+// the length of its valid prefix.
+func (w *wal) loadSegment(p string, memtable *memtable) (int64, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file %s: %w", p, err)
+	}
+	defer file.Close()
+
+	return loadRecords(bufio.NewReader(file), memtable)
+}
+
+// loadRecords inserts the records read from r into memtable and returns the
+// length of the valid prefix.
+func loadRecords(r io.Reader, memtable *memtable) (int64, error) {
+	return readFramed(r, func(payload []byte) error {
+		entry, tombstone, err := decodeRecord(payload)
+		if err != nil {
+			return err
+		}
+
+		if entry == nil {
+			memtable.deleteRange(tombstone)
+			return nil
+		}
+
+		return memtable.insert(entry)
+	})
+}
+
+// readFramed calls f with the payload of every framed record read from r and
+// returns the length of the valid prefix.
+func readFramed(r io.Reader, f func(payload []byte) error) (int64, error) {
+	var valid int64
+	header := make([]byte, walRecordHeaderSize)
 	for {
-		_, err := w.file.Read(lengthBuffer)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("failed to read: %w", err)
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return valid, nil
+		} else if err != nil {
+			return valid, err
+		}
+
+		checksum := binary.BigEndian.Uint32(header)
+		length := binary.BigEndian.Uint32(header[4:])
+		if length > walMaxRecordSize {
+			return valid, errWALCorrupt
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err == io.EOF {
+			return valid, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return valid, err
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return valid, errWALCorrupt
 		}
 
-		if err == io.EOF {
-			return memtable, nil
+		if err := f(payload); err != nil {
+			return valid, err
 		}
-		entryBuffer := make([]byte, binary.BigEndian.Uint64(lengthBuffer))
-		if _, err := w.file.Read(entryBuffer); err != nil {
+
+		valid += int64(walRecordHeaderSize + len(payload))
+	}
+}
+
+func appendRecord(dst []byte, e *db.Entry) ([]byte, error) {
+	return appendFramed(dst, func(dst []byte) ([]byte, error) {
+		dst = append(dst, walVersion, walEntryRecord, byte(e.Type))
+		dst = appendInt64(dst, e.Key)
+		dst = appendString(dst, e.Index())
+
+		return appendValue(dst, e.Type, e.Value)
+	})
+}
+
+func appendTombstoneRecord(dst []byte, t *tombstone) ([]byte, error) {
+	return appendFramed(dst, func(dst []byte) ([]byte, error) {
+		dst = append(dst, walVersion, walTombstoneRecord)
+		return appendTombstone(dst, t), nil
+	})
+}
+
+// appendFramed appends the payload written by f prefixed with its checksum
+// and length.
+func appendFramed(dst []byte, f func([]byte) ([]byte, error)) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, make([]byte, walRecordHeaderSize)...)
+
+	dst, err := f(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := dst[start+walRecordHeaderSize:]
+	binary.BigEndian.PutUint32(dst[start:], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(dst[start+4:], uint32(len(payload)))
+	return dst, nil
+}
+
+func appendValue(dst []byte, t db.ValueType, value interface{}) ([]byte, error) {
+	switch t {
+	case db.IntType:
+		v, ok := toInt64(value)
+		if !ok {
+			return nil, fmt.Errorf("wrong value type %T for int entry", value)
+		}
+
+		return appendInt64(dst, v), nil
+	case db.FloatType:
+		var v float64
+		switch f := value.(type) {
+		case float32:
+			v = float64(f)
+		case float64:
+			v = f
+		default:
+			return nil, fmt.Errorf("wrong value type %T for float entry", value)
+		}
+
+		return appendInt64(dst, int64(math.Float64bits(v))), nil
+	case db.BoolType:
+		v, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("wrong value type %T for bool entry", value)
+		}
+
+		if v {
+			return append(dst, 1), nil
+		}
+		return append(dst, 0), nil
+	case db.UnsignedType:
+		v, ok := toUint64(value)
+		if !ok {
+			return nil, fmt.Errorf("wrong value type %T for unsigned entry", value)
+		}
+
+		return appendInt64(dst, int64(v)), nil
+	case db.BytesType:
+		v, ok := value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("wrong value type %T for bytes entry", value)
+		}
+
+		return appendString(dst, string(v)), nil
+	case db.CustomType:
+		c, ok := db.CodecOf(value)
+		if !ok {
+			return nil, fmt.Errorf("no codec registered for %T", value)
+		}
+
+		data, err := c.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal with codec %s: %w", c.Name, err)
+		}
+
+		return appendString(appendString(dst, c.Name), string(data)), nil
+	default:
+		s, ok := value.(string)
+		if !ok {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+
+			s = string(data)
+		}
+
+		return appendString(dst, s), nil
+	}
+}
+
+func decodeRecord(payload []byte) (*db.Entry, *tombstone, error) {
+	if len(payload) < 2 {
+		return nil, nil, errWALCorrupt
+	}
+
+	legacy := payload[0] < walVersion3
+	switch payload[0] {
+	case 1:
+		e, err := decodeEntry(payload[1:], legacy)
+		return e, nil, err
+	case 2, walVersion3, walVersion:
+	default:
+		return nil, nil, fmt.Errorf("unknown wal record version %d", payload[0])
+	}
+
+	switch payload[1] {
+	case walEntryRecord:
+		e, err := decodeEntry(payload[2:], legacy)
+		return e, nil, err
+	case walTombstoneRecord:
+		format := tombstoneSeries
+		switch {
+		case legacy:
+			format = tombstoneTags
+		case payload[0] < walVersion4:
+			format = tombstoneMatchers
+		}
+
+		t, _, err := readTombstone(payload[2:], format)
+		return nil, t, err
+	default:
+		return nil, nil, fmt.Errorf("unknown wal record kind %d", payload[1])
+	}
+}
+
+// decodeEntry decodes the body of an entry record, the legacy records hold
+// the tags of the entry instead of its series key.
+func decodeEntry(buf []byte, legacy bool) (*db.Entry, error) {
+	if len(buf) < 9 {
+		return nil, errWALCorrupt
+	}
+
+	e := &db.Entry{Type: db.ValueType(buf[0])}
+	e.Key = int64(binary.BigEndian.Uint64(buf[1:]))
+	buf = buf[9:]
+
+	if legacy {
+		count, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errWALCorrupt
+		}
+		buf = buf[n:]
+
+		for i := uint64(0); i < count; i++ {
+			tag, rest, err := readString(buf)
+			if err != nil {
+				return nil, err
+			}
+
+			e.Tags = append(e.Tags, tag)
+			buf = rest
+		}
+	} else {
+		key, rest, err := readString(buf)
+		if err != nil {
 			return nil, err
 		}
-		entry := &db.Entry{}
-		if err := json.Unmarshal(entryBuffer, entry); err != nil {
+
+		if e.Metric, e.Labels, err = db.ParseSeriesKey(key); err != nil {
 			return nil, err
 		}
+		buf = rest
+	}
+
+	switch e.Type {
+	case db.IntType, db.FloatType, db.UnsignedType:
+		if len(buf) < 8 {
+			return nil, errWALCorrupt
+		}
 
-		if err := memtable.insert(entry); err != nil {
+		v := binary.BigEndian.Uint64(buf)
+		switch e.Type {
+		case db.IntType:
+			e.Value = int64(v)
+		case db.FloatType:
+			e.Value = math.Float64frombits(v)
+		default:
+			e.Value = v
+		}
+	case db.BoolType:
+		if len(buf) < 1 {
+			return nil, errWALCorrupt
+		}
+
+		e.Value = buf[0] != 0
+	case db.BytesType:
+		s, _, err := readString(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Value = []byte(s)
+	case db.CustomType:
+		name, rest, err := readString(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		data, _, err := readString(rest)
+		if err != nil {
 			return nil, err
 		}
+
+		c, ok := db.LookupCodec(name)
+		if !ok {
+			return nil, fmt.Errorf("codec %s is not registered", name)
+		}
+
+		if e.Value, err = c.Unmarshal([]byte(data)); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal with codec %s: %w", name, err)
+		}
+	default:
+		s, _, err := readString(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		e.Value = s
+	}
+
+	return e, nil
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch v := value.(type) {
+	case int:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint:
+		return int64(v), true
+	case uint8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	default:
+		return 0, false
+	}
+}
+
+func appendInt64(dst []byte, v int64) []byte {
+	buffer := make([]byte, 8)
+	binary.BigEndian.PutUint64(buffer, uint64(v))
+	return append(dst, buffer...)
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	buffer := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buffer, v)
+	return append(dst, buffer[:n]...)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+func readString(buf []byte) (string, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < length {
+		return "", nil, errWALCorrupt
 	}
 
+	return string(buf[n : n+int(length)]), buf[n+int(length):], nil
+}
+
+func toUint64(value interface{}) (uint64, bool) {
+	switch v := value.(type) {
+	case uint:
+		return uint64(v), true
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	default:
+		return 0, false
+	}
 }
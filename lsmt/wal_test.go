@@ -0,0 +1,311 @@
+package lsmt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	db "github.com/dovics/pangolin"
+)
+
+func TestWALRotate(t *testing.T) {
+	defer os.RemoveAll(testOption.WalPath)
+
+	w, err := NewWAL(testOption.WalPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 10; i++ {
+		if err := w.AppendEntry(db.Entry{KV: db.KV{Key: i, Value: "a"}, Type: db.StringType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seq, err := w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(10); i < 15; i++ {
+		if err := w.AppendEntry(db.Entry{KV: db.KV{Key: i, Value: "b"}, Type: db.StringType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWAL(testOption.WalPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mt, err := w.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mt.minKey != 0 || mt.maxKey != 14 {
+		t.Errorf("wrong key range after load: %d-%d", mt.minKey, mt.maxKey)
+	}
+
+	if err := w.RemoveSealed(seq); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWAL(testOption.WalPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	mt, err = w.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mt.minKey != 10 || mt.maxKey != 14 {
+		t.Errorf("wrong key range after remove: %d-%d", mt.minKey, mt.maxKey)
+	}
+}
+
+func TestWALSegment(t *testing.T) {
+	defer os.RemoveAll(testOption.WalPath)
+
+	w, err := NewWAL(testOption.WalPath, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 100; i++ {
+		if err := w.AppendEntry(db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType, Tags: []string{"test"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(w.segments) < 2 {
+		t.Errorf("expect the WAL to roll over, got %d segments", len(w.segments))
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWAL(testOption.WalPath, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	mt, err := w.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := mt.getRange(20, 40, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectResult := make([]db.KV, 20)
+	for i := 20; i < 40; i++ {
+		expectResult[i-20] = db.KV{Key: int64(i), Value: int64(i)}
+	}
+
+	if !reflect.DeepEqual(expectResult, result) {
+		t.Errorf("expect %v, got %v\n", expectResult, result)
+	}
+}
+
+func TestWALTornTail(t *testing.T) {
+	defer os.RemoveAll(testOption.WalPath)
+
+	w, err := NewWAL(testOption.WalPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 10; i++ {
+		if err := w.AppendEntry(db.Entry{KV: db.KV{Key: i, Value: float64(i)}, Type: db.FloatType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(w.segmentPath(w.seq))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the last record in half.
+	if err := os.Truncate(w.segmentPath(w.seq), info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWAL(testOption.WalPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	mt, err := w.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mt.minKey != 0 || mt.maxKey != 8 {
+		t.Errorf("wrong key range after load: %d-%d", mt.minKey, mt.maxKey)
+	}
+
+	result, err := mt.getRange(0, 10, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 9 || result[8].Value != float64(8) {
+		t.Errorf("wrong result after load: %v", result)
+	}
+}
+
+func TestWALCorruptSegment(t *testing.T) {
+	defer os.RemoveAll(testOption.WalPath)
+
+	w, err := NewWAL(testOption.WalPath, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := int64(0); i < 100; i++ {
+		if err := w.AppendEntry(db.Entry{KV: db.KV{Key: i, Value: i}, Type: db.IntType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the last record of the first segment, the later segments hold
+	// acknowledged writes.
+	first := w.segmentPath(w.segments[0])
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(first, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = NewWAL(testOption.WalPath, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if _, err := w.Load(); !errors.Is(err, errWALCorrupt) {
+		t.Errorf("expect %v, got %v", errWALCorrupt, err)
+	}
+
+	// The segment isn't truncated.
+	if info, err := os.Stat(first); err != nil || info.Size() != int64(len(data)) {
+		t.Errorf("expect %s to keep its %d bytes, got %v, %v", first, len(data), info, err)
+	}
+}
+
+func TestWALValueTypes(t *testing.T) {
+	entries := []*db.Entry{
+		{KV: db.KV{Key: 1, Value: true}, Type: db.BoolType, Metric: "up"},
+		{KV: db.KV{Key: 2, Value: uint64(1) << 63}, Type: db.UnsignedType, Metric: "bytes_total"},
+		{KV: db.KV{Key: 3, Value: []byte{0, 1, 0xff}}, Type: db.BytesType, Metric: "payload"},
+	}
+
+	for _, e := range entries {
+		record, err := appendRecord(nil, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, _, err := decodeRecord(record[walRecordHeaderSize:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(result.KV, e.KV) || result.Type != e.Type {
+			t.Errorf("expect %v, got %v", e.KV, result.KV)
+		}
+	}
+}
+
+func TestWALUpgradeLegacyFile(t *testing.T) {
+	defer os.RemoveAll(testOption.WalPath)
+	defer os.Remove(testOption.WalPath + legacyWalSuffix)
+
+	// The entries of a WAL file written before the WAL was segmented.
+	type legacyEntry struct {
+		db.KV
+		Type db.ValueType
+		Tags []string
+	}
+
+	legacy := []legacyEntry{
+		{KV: db.KV{Key: 1, Value: int64(1) << 60}, Type: db.IntType, Tags: []string{"int"}},
+		{KV: db.KV{Key: 2, Value: 2.5}, Type: db.FloatType, Tags: []string{"float"}},
+		{KV: db.KV{Key: 3, Value: "c"}, Type: db.StringType, Tags: []string{"string"}},
+	}
+
+	var data []byte
+	for _, e := range legacy {
+		entryBytes, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data = binary.BigEndian.AppendUint64(data, uint64(len(entryBytes)))
+		data = append(data, entryBytes...)
+	}
+
+	// The torn tail left by a crash is ignored.
+	data = append(data, 0, 0, 0)
+	if err := os.WriteFile(testOption.WalPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewWAL(testOption.WalPath, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	mt, err := w.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range legacy {
+		result, err := mt.getRange(0, 10, &db.QueryFilter{Type: e.Type})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(result, []db.KV{e.KV}) {
+			t.Errorf("expect %v, got %v", e.KV, result)
+		}
+	}
+
+	if _, err := os.Stat(testOption.WalPath + legacyWalSuffix); err != nil {
+		t.Errorf("expect the legacy file to be set aside, got %v", err)
+	}
+}
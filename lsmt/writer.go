@@ -0,0 +1,78 @@
+package lsmt
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+
+	"github.com/dovics/pangolin/utils/rbtree"
+)
+
+// tableWriter writes the blocks, the tombstones, the header and the footer of
+// a SSTable in the latest version.
+type tableWriter struct {
+	w       io.Writer
+	offset  uint64
+	indexes []*index
+	buffer  bytes.Buffer
+}
+
+func newTableWriter(w io.Writer) *tableWriter {
+	return &tableWriter{w: w}
+}
+
+func (tw *tableWriter) writeBlock(i string, b *block) error {
+	tw.buffer.Reset()
+	if _, err := b.writeBlock(&tw.buffer); err != nil {
+		return err
+	}
+
+	index := &index{
+		index: i,
+		t:     b.valueType,
+		count: uint32(b.count),
+		min:   b.data.Min().(rbtree.TimestampItem).Time,
+		max:   b.data.Max().(rbtree.TimestampItem).Time,
+		stats: newBlockStats(b),
+	}
+
+	return tw.write(index, tw.buffer.Bytes())
+}
+
+func (tw *tableWriter) writeTombstones(tombstones []*tombstone) error {
+	if len(tombstones) == 0 {
+		return nil
+	}
+
+	index := &index{t: tombstoneType, count: uint32(len(tombstones))}
+	return tw.write(index, encodeTombstones(tombstones))
+}
+
+func (tw *tableWriter) write(index *index, data []byte) error {
+	if _, err := tw.w.Write(data); err != nil {
+		return err
+	}
+
+	index.offset = tw.offset
+	index.length = uint32(len(data))
+	index.checksum = crc32.Checksum(data, castagnoli)
+	tw.indexes = append(tw.indexes, index)
+
+	tw.offset += uint64(len(data))
+	return nil
+}
+
+// finish writes the header after the blocks, followed by the footer.
+func (tw *tableWriter) finish() error {
+	tw.buffer.Reset()
+	if err := writeHeader(&tw.buffer, tw.indexes, tableVersion); err != nil {
+		return err
+	}
+
+	header := tw.buffer.Bytes()
+	if _, err := tw.w.Write(header); err != nil {
+		return err
+	}
+
+	return writeFooter(tw.w, tw.offset, crc32.Checksum(header, castagnoli))
+}
@@ -0,0 +1,173 @@
+package pangolin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrTypeMismatch is returned reading a point of a Series which doesn't hold
+// a T.
+var ErrTypeMismatch = errors.New("type mismatch")
+
+// Value is the set of the types a Series can hold.
+type Value interface {
+	int64 | uint64 | float64 | string | bool | []byte
+}
+
+type Point[T Value] struct {
+	Time  int64
+	Value T
+}
+
+// Series is a typed view of the series of a DB identified by the metric and
+// the labels. The points read from the series must hold a T, a point of
+// another type is an error instead of being converted.
+type Series[T Value] struct {
+	db     *DB
+	metric string
+	labels map[string]string
+	t      ValueType
+	filter *QueryFilter
+}
+
+func NewSeries[T Value](db *DB, metric string, labels map[string]string) *Series[T] {
+	var zero T
+	return &Series[T]{
+		db:     db,
+		metric: metric,
+		labels: labels,
+		t:      TypeOf(zero),
+		filter: &QueryFilter{Series: SeriesKey(metric, labels)},
+	}
+}
+
+// Key returns the series key of the series.
+func (s *Series[T]) Key() string {
+	return s.filter.Series
+}
+
+func (s *Series[T]) entry(ts int64, v T) *Entry {
+	return &Entry{KV: KV{Key: ts, Value: v}, Type: s.t, Metric: s.metric, Labels: s.labels}
+}
+
+func (s *Series[T]) Insert(ts int64, v T) error {
+	return s.db.InsertEntry(s.entry(ts, v))
+}
+
+func (s *Series[T]) InsertBatch(points []Point[T]) error {
+	entries := make([]*Entry, len(points))
+	for i, p := range points {
+		entries[i] = s.entry(p.Time, p.Value)
+	}
+
+	return s.db.InsertBatch(entries)
+}
+
+// Range returns the points in [start, end).
+func (s *Series[T]) Range(start, end int64) ([]Point[T], error) {
+	it, err := s.Query(context.Background(), start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Point[T]{}
+	for it.Next() {
+		result = append(result, it.At())
+	}
+
+	if err := it.Err(); err != nil {
+		it.Close()
+		return nil, err
+	}
+
+	return result, it.Close()
+}
+
+// Query streams the points in [start, end).
+func (s *Series[T]) Query(ctx context.Context, start, end int64) (*SeriesIterator[T], error) {
+	it, err := s.db.Query(ctx, QueryRequest{StartTime: start, EndTime: end, Filter: s.filter})
+	if err != nil {
+		return nil, err
+	}
+
+	return &SeriesIterator[T]{it: it}, nil
+}
+
+// Last returns the newest point of the series, ok is false if the series has
+// no point.
+func (s *Series[T]) Last() (p Point[T], ok bool, err error) {
+	points, err := s.db.Last(s.filter)
+	if err != nil || len(points) == 0 {
+		return p, false, err
+	}
+
+	// The newest point of every type is returned, a series without a point of
+	// the type of T is a mismatch.
+	last := points[0]
+	for _, point := range points {
+		if point.Type == s.t {
+			last = point
+			break
+		}
+	}
+
+	v, err := valueOf[T](last.Value)
+	if err != nil {
+		return p, false, err
+	}
+
+	return Point[T]{Time: last.Key, Value: v}, true, nil
+}
+
+// SeriesIterator streams the points of a Series, it stops at the first point
+// which doesn't hold a T and reports it with Err.
+type SeriesIterator[T Value] struct {
+	it    Iterator
+	point Point[T]
+	err   error
+}
+
+func (it *SeriesIterator[T]) Next() bool {
+	if it.err != nil || !it.it.Next() {
+		return false
+	}
+
+	kv := it.it.At()
+	v, err := valueOf[T](kv.Value)
+	if err != nil {
+		it.err = fmt.Errorf("failed to read the point at %d: %w", kv.Key, err)
+		return false
+	}
+
+	it.point = Point[T]{Time: kv.Key, Value: v}
+	return true
+}
+
+func (it *SeriesIterator[T]) At() Point[T] {
+	return it.point
+}
+
+func (it *SeriesIterator[T]) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+
+	return it.it.Err()
+}
+
+func (it *SeriesIterator[T]) Close() error {
+	return it.it.Close()
+}
+
+// valueOf returns the value read from an engine as a T. Only the native type
+// of the ValueType of T is accepted, a value of another type is a mismatch
+// instead of being converted.
+func valueOf[T Value](value interface{}) (T, error) {
+	v, ok := value.(T)
+	if !ok {
+		return v, fmt.Errorf("%w: value of type %T is not a %T", ErrTypeMismatch, value, v)
+	}
+
+	return v, nil
+}
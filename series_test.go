@@ -0,0 +1,126 @@
+package pangolin
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// memEngine keeps the points of every series in memory.
+type memEngine struct {
+	series map[string][]KV
+}
+
+func (e *memEngine) Insert(entry *Entry) error {
+	key := entry.Index()
+	e.series[key] = append(e.series[key], entry.KV)
+	return nil
+}
+
+func (e *memEngine) GetRange(startTime, endTime int64, filter *QueryFilter) ([]KV, error) {
+	keys := []string{}
+	for key := range e.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := []KV{}
+	for _, key := range keys {
+		if !filter.Match(key) {
+			continue
+		}
+
+		for _, kv := range e.series[key] {
+			if kv.Key >= startTime && kv.Key < endTime {
+				result = append(result, kv)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (e *memEngine) Close() error { return nil }
+
+func TestSeries(t *testing.T) {
+	engine := &memEngine{series: map[string][]KV{}}
+	db := &DB{engine: engine}
+
+	cpu := NewSeries[float64](db, "cpu", map[string]string{"host": "a"})
+	for i := int64(0); i < 10; i++ {
+		if err := cpu.Insert(i, float64(i)/2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A series with more labels isn't part of the series.
+	other := NewSeries[float64](db, "cpu", map[string]string{"host": "a", "core": "1"})
+	if err := other.InsertBatch([]Point[float64]{{Time: 1, Value: 100}}); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := cpu.Range(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expect := []Point[float64]{{2, 1}, {3, 1.5}}; !reflect.DeepEqual(expect, result) {
+		t.Errorf("expect %v, got %v", expect, result)
+	}
+
+	// The points of the series are floats, not integers.
+	if _, err := NewSeries[int64](db, "cpu", map[string]string{"host": "a"}).Range(0, 10); err == nil {
+		t.Error("expect a type mismatch")
+	}
+
+	if _, _, err := cpu.Last(); err == nil {
+		t.Error("expect the engine not to support last")
+	}
+}
+
+func TestValueOf(t *testing.T) {
+	if v, err := valueOf[int64](int64(3)); err != nil || v != 3 {
+		t.Errorf("expect 3, got %v, %v", v, err)
+	}
+
+	if v, err := valueOf[[]byte]([]byte("raw")); err != nil || string(v) != "raw" {
+		t.Errorf("expect raw, got %v, %v", v, err)
+	}
+
+	// The values of other types are neither widened nor decoded.
+	for _, value := range []interface{}{int8(1), int16(1), int32(1), 1, uint64(1), "1", 1.5, []byte("123"), true} {
+		if _, err := valueOf[int64](value); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expect %T not to be an int64, got %v", value, err)
+		}
+	}
+
+	for _, value := range []interface{}{uint8(1), uint16(1), uint32(1), uint(1), int64(1)} {
+		if _, err := valueOf[uint64](value); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("expect %T not to be an uint64, got %v", value, err)
+		}
+	}
+
+	if _, err := valueOf[float64](float32(1.5)); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expect a float32 not to be a float64, got %v", err)
+	}
+
+	if _, err := valueOf[string]([]byte(`"json"`)); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expect bytes not to be a string, got %v", err)
+	}
+}
+
+func TestSeriesBytesMismatch(t *testing.T) {
+	engine := &memEngine{series: map[string][]KV{}}
+	db := &DB{engine: engine}
+
+	raw := NewSeries[[]byte](db, "raw", nil)
+	if err := raw.Insert(1, []byte("123")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bytes holding a JSON number aren't read as an integer.
+	if _, err := NewSeries[int64](db, "raw", nil).Range(0, 10); !errors.Is(err, ErrTypeMismatch) {
+		t.Errorf("expect %v, got %v", ErrTypeMismatch, err)
+	}
+}
@@ -99,3 +99,15 @@ func (c *Cache) removeTail() *LinkedNode {
 	c.removeNode(node)
 	return node
 }
+
+// Remove deletes the key from the cache without cleaning its value.
+func (c *Cache) Remove(key string) {
+	node, ok := c.cache[key]
+	if !ok {
+		return
+	}
+
+	c.removeNode(node)
+	delete(c.cache, key)
+	c.size--
+}